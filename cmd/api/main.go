@@ -1,26 +1,159 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"portfolio-rebalancer/internal/auth"
 	"portfolio-rebalancer/internal/handlers"
+	"portfolio-rebalancer/internal/health"
 	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/middleware"
+	"portfolio-rebalancer/internal/outbox"
+	"portfolio-rebalancer/internal/router"
 	"portfolio-rebalancer/internal/storage"
+	"portfolio-rebalancer/internal/tracing"
+	"portfolio-rebalancer/internal/utils"
+	"syscall"
+	"time"
 )
 
+// maxBodyBytes limits the size of request bodies accepted by the API.
+const maxBodyBytes = 1 << 20 // 1MB
+
 func main() {
+	logging.Init("rebalancer-api")
+	// Recorded in the envelopes of events stored in the outbox
+	kafka.SetProducer("rebalancer-api")
+
+	shutdownTracing, err := tracing.Init(context.Background(), "rebalancer-api")
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", logging.Err(err))
+	}
+
+	store, err := storage.Open()
+	if err != nil {
+		logging.Fatal("Failed to initialize storage", "backend", storage.BackendKind(), logging.Err(err))
+	}
+
+	// With BROKER=memory this process also relays and consumes the rebalance
+	// events, for local development and integration tests without Kafka
+	stopPipeline := func() {}
+	if kafka.BrokerKind() == kafka.BrokerMemory {
+		stopPipeline = startPipeline(store)
+	}
+
+	secrets, err := auth.LoadProviderSecrets()
+	if err != nil {
+		logging.Fatal("Failed to load provider secrets", logging.Err(err))
+	}
+	verifier, err := auth.NewSignatureVerifier(secrets, auth.ReplayWindow())
+	if err != nil {
+		logging.Fatal("Invalid provider secrets", logging.Err(err))
+	}
+
+	// Reload provider secrets on SIGHUP so they can be rotated without a restart
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			secrets, err := auth.LoadProviderSecrets()
+			if err == nil {
+				err = verifier.SetSecrets(secrets)
+			}
+			if err != nil {
+				slog.Error("Failed to reload provider secrets", logging.Err(err))
+				continue
+			}
+			slog.Info("Provider secrets reloaded")
+		}
+	}()
+
+	authenticator, err := auth.NewAuthenticatorFromEnv()
+	if err != nil {
+		logging.Fatal("Failed to initialize authentication", logging.Err(err))
+	}
+
+	r := router.New(
+		middleware.RequestID,
+		middleware.Tracing,
+		middleware.Recover,
+		middleware.AccessLog,
+		middleware.Metrics,
+		middleware.CORS(middleware.AllowedOrigins()),
+		middleware.BodyLimit(maxBodyBytes),
+		middleware.Timeout(utils.EnvDuration("HTTP_HANDLER_TIMEOUT", 10*time.Second)),
+	)
 
-	if err := storage.InitElastic(); err != nil {
-		log.Fatalf("Failed to initialize Elasticsearch: %v", err)
+	// Users, advisors and admins manage portfolios; only providers may trigger a rebalance
+	portfolioAccess := []router.Middleware{authenticator.Middleware, auth.RequireRole(auth.RoleUser, auth.RoleAdvisor, auth.RoleAdmin)}
+	providerOnly := []router.Middleware{authenticator.Middleware, auth.RequireRole(auth.RoleProvider), verifier.Middleware}
+
+	h := handlers.NewPortfolioHandler(store, outbox.NewQueue(store))
+	registerRoutes := func(g *router.Router) {
+		g.Get("/portfolio", h.HandleGetPortfolio, portfolioAccess...)
+		g.Get("/portfolio/{user_id}", h.HandleGetPortfolio, portfolioAccess...)
+		g.Post("/portfolio", h.HandleCreatePortfolio, portfolioAccess...)
+		g.Post("/rebalance", h.HandleRebalance, providerOnly...)
+	}
+
+	registerRoutes(r.Group("/v1"))
+
+	// Unversioned paths are kept as deprecated aliases of /v1
+	registerRoutes(r.Group("", middleware.Deprecated("/v1")))
+
+	checker := health.NewChecker(utils.EnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	checker.Add(storage.BackendKind(), store.CheckHealth)
+
+	r.Get("/healthz", health.HandleHealthz)
+	r.Get("/readyz", checker.HandleReadyz)
+	r.Get("/metrics", metrics.Handler().ServeHTTP)
+
+	srv := &http.Server{
+		Addr:     ":8080",
+		Handler:  r,
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
 	}
 
-	if err := kafka.InitKafka(); err != nil {
-		log.Fatalf("Failed to initialize Kafka: %v", err)
+	// Capture Ctrl+C / SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		slog.Info("Server started", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("Server failed", logging.Err(err))
+		}
+	}()
+	health.SetReady(true)
+
+	<-stop
+	slog.Info("Shutting down server...")
+
+	// Fail readiness first so the orchestrator stops routing new requests,
+	// then drain in-flight requests
+	health.SetReady(false)
+	time.Sleep(utils.EnvDuration("SHUTDOWN_READINESS_DELAY", 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), utils.EnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Server shutdown did not complete", logging.Err(err))
+	}
+	stopPipeline()
+	if err := store.Close(); err != nil {
+		slog.Error("Failed to close storage", logging.Err(err))
 	}
 
-	http.HandleFunc("/portfolio", handlers.HandlePortfolio)
-	http.HandleFunc("/rebalance", handlers.HandleRebalance)
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", logging.Err(err))
+	}
 
-	log.Println("Server started at :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/outbox"
+	"portfolio-rebalancer/internal/storage"
+	"portfolio-rebalancer/internal/utils"
+	"sync"
+	"time"
+)
+
+// startPipeline runs the outbox relay and the rebalance consumer in this process
+// on an in-memory broker, so the whole pipeline runs without Kafka. The returned
+// function stops both and waits for the message being processed.
+func startPipeline(store storage.Store) (stop func()) {
+	broker := kafka.NewMemoryBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relay := outbox.NewRelay(store, broker, kafka.RebalanceTopic(),
+			utils.EnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+			utils.EnvInt("OUTBOX_BATCH_SIZE", 100),
+			utils.EnvInt("OUTBOX_MAX_ATTEMPTS", 0),
+		)
+		relay.Run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		if err := kafka.NewRebalanceConsumer(broker, store, store).Run(ctx, broker); err != nil {
+			slog.Error("In-process consumer failed", logging.Err(err))
+		}
+	}()
+
+	slog.Info("Running relay and consumer in process", "broker", kafka.BrokerMemory)
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
@@ -2,40 +2,130 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"portfolio-rebalancer/internal/health"
 	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
 	"portfolio-rebalancer/internal/storage"
+	"portfolio-rebalancer/internal/tracing"
+	"portfolio-rebalancer/internal/utils"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
+	logging.Init("rebalancer-consumer")
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Capture Ctrl+C / SIGTERM
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		log.Println("Shutting down consumer...")
+		slog.Info("Shutting down consumer...")
 		cancel()
 	}()
 
-	// Initialize Elasticsearch
-	if err := storage.InitElastic(); err != nil {
-		log.Fatalf("Failed to initialize Elasticsearch: %v", err)
+	shutdownTracing, err := tracing.Init(ctx, "rebalancer-consumer")
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", logging.Err(err))
+	}
+
+	// Initialize the storage backend
+	store, err := storage.Open()
+	if err != nil {
+		logging.Fatal("Failed to initialize storage", "backend", storage.BackendKind(), logging.Err(err))
+	}
+	defer store.Close()
+
+	broker, err := kafka.NewBroker()
+	if err != nil {
+		logging.Fatal("Kafka init failed", logging.Err(err))
+	}
+
+	// Serve liveness and readiness probes and metrics
+	checker := health.NewChecker(utils.EnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	checker.Add(storage.BackendKind(), store.CheckHealth)
+	if kafka.BrokerKind() == kafka.BrokerKafka {
+		checker.Add("kafka", kafka.CheckBroker)
+		checker.Add("consumer_lag", kafka.CheckConsumerLag(maxConsumerLag()))
 	}
 
-	// Optionally, ensure Kafka topic exists
-	if err := kafka.InitKafka(); err != nil {
-		log.Fatalf("Kafka init failed: %v", err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.HandleHealthz)
+	mux.HandleFunc("/readyz", checker.HandleReadyz)
+	mux.Handle("/metrics", metrics.Handler())
+
+	healthAddr := os.Getenv("HEALTH_ADDR")
+	if healthAddr == "" {
+		healthAddr = ":8081"
 	}
+	healthSrv := &http.Server{Addr: healthAddr, Handler: mux}
+	go func() {
+		slog.Info("Health server started", "addr", healthAddr)
+		if err := healthSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Health server failed", logging.Err(err))
+		}
+	}()
+	health.SetReady(true)
 
 	// Start consuming messages
-	kafka.StartRebalanceConsumer(ctx)
+	var consumerErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if consumerErr = kafka.NewRebalanceConsumer(broker, store, store).Run(ctx, broker); consumerErr != nil {
+			// Exit so the orchestrator restarts the consumer and the
+			// uncommitted message is redelivered
+			cancel()
+		}
+	}()
 
 	// Keep running until context is canceled
 	<-ctx.Done()
-	log.Println("Consumer stopped")
+	health.SetReady(false)
+
+	// Give the messages being processed a chance to finish
+	failed := false
+	select {
+	case <-done:
+		failed = consumerErr != nil
+	case <-time.After(utils.EnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)):
+		slog.Warn("Timed out waiting for in-flight messages to finish")
+	}
+
+	if err := broker.Close(); err != nil {
+		slog.Error("Failed to close Kafka writers", logging.Err(err))
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	healthSrv.Shutdown(shutdownCtx)
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", logging.Err(err))
+	}
+
+	if failed {
+		logging.Fatal("Consumer failed", logging.Err(consumerErr))
+	}
+	slog.Info("Consumer stopped")
+}
+
+// maxConsumerLag returns CONSUMER_MAX_LAG, the number of messages the consumer
+// may fall behind before it reports itself as not ready. Defaults to 1000.
+func maxConsumerLag() int64 {
+	lag, err := strconv.ParseInt(os.Getenv("CONSUMER_MAX_LAG"), 10, 64)
+	if err != nil || lag <= 0 {
+		return 1000
+	}
+	return lag
 }
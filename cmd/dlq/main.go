@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"syscall"
+)
+
+const usage = `Usage:
+  dlq list [-limit N]
+      Print the messages in the dead-letter topic as JSON lines.
+  dlq replay -partition P -offset O
+      Publish one dead-lettered message to the rebalance topic again.
+  dlq replay -all
+      Publish every message in the dead-letter topic to the rebalance topic again.
+
+KAFKA_BROKERS and KAFKA_TOPIC select the cluster and the rebalance topic; the
+dead-letter topic is KAFKA_DLQ_TOPIC (default <KAFKA_TOPIC>.dlq). TLS and SASL
+are configured with the same KAFKA_TLS_* and KAFKA_SASL_* variables as the services.
+`
+
+// errDone stops reading the dead-letter topic early.
+var errDone = errors.New("done")
+
+func main() {
+	logging.Init("rebalancer-dlq")
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "list":
+		err = list(ctx, os.Args[2:])
+	case "replay":
+		err = replay(ctx, os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		logging.Fatal("Command failed", "command", os.Args[1], logging.Err(err))
+	}
+}
+
+func list(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	limit := fs.Int("limit", 0, "maximum number of messages to print (0 for all)")
+	fs.Parse(args)
+
+	enc := json.NewEncoder(os.Stdout)
+	count := 0
+	err := kafka.ReadDeadLetters(ctx, func(dl kafka.DeadLetter) error {
+		if err := enc.Encode(dl); err != nil {
+			return err
+		}
+		count++
+		if *limit > 0 && count >= *limit {
+			return errDone
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDone) {
+		return err
+	}
+	slog.Info("Listed dead-lettered messages", "count", count)
+	return nil
+}
+
+func replay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	partition := fs.Int("partition", -1, "partition of the message to replay")
+	offset := fs.Int64("offset", -1, "offset of the message to replay")
+	all := fs.Bool("all", false, "replay every message in the dead-letter topic")
+	fs.Parse(args)
+
+	single := *partition >= 0 && *offset >= 0
+	if single == *all {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cluster, err := kafka.NewCluster()
+	if err != nil {
+		return fmt.Errorf("kafka init failed: %w", err)
+	}
+	defer cluster.Close()
+
+	count := 0
+	err = kafka.ReadDeadLetters(ctx, func(dl kafka.DeadLetter) error {
+		if single && (dl.Partition != *partition || dl.Offset != *offset) {
+			return nil
+		}
+		if err := kafka.ReplayDeadLetter(ctx, cluster, dl); err != nil {
+			return fmt.Errorf("failed to replay message %d/%d: %w", dl.Partition, dl.Offset, err)
+		}
+		slog.Info("Replayed message", logging.KeyPartition, dl.Partition, logging.KeyOffset, dl.Offset, "key", dl.Key)
+		count++
+		if single {
+			return errDone
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDone) {
+		return err
+	}
+	if single && count == 0 {
+		return fmt.Errorf("message %d/%d not found in dead-letter topic", *partition, *offset)
+	}
+	slog.Info("Replayed dead-lettered messages", "count", count)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/storage"
+	"syscall"
+)
+
+const usage = `Usage:
+  migrate [-dry-run] [-delete-old]
+
+Installs the Elasticsearch index templates and moves the aliases portfolios,
+rebalance_requests, rebalance_transactions and outbox to the current versioned
+indices, reindexing the data of the indices they pointed to. Indices created by
+dynamic mapping, with the name of an alias, are reindexed and deleted. Prints
+one JSON line per index.
+
+  -dry-run     print what would be migrated without changing the indices
+  -delete-old  delete the previous versioned indices after moving the aliases
+
+Stop the services writing to Elasticsearch first: documents written to the old
+indices while they are reindexed are not copied. ELASTICSEARCH_URL selects the
+cluster. PostgreSQL migrations are applied by the services at startup.
+`
+
+func main() {
+	logging.Init("rebalancer-migrate")
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	dryRun := fs.Bool("dry-run", false, "print what would be migrated without changing the indices")
+	deleteOld := fs.Bool("delete-old", false, "delete the previous versioned indices after moving the aliases")
+	fs.Parse(os.Args[1:])
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// MigrateIndices installs the templates and indices itself, and a dry run
+	// must not change the cluster
+	cfg := storage.LoadElasticConfig()
+	cfg.SkipIndexSetup = true
+	es, err := storage.NewElastic(cfg)
+	if err != nil {
+		logging.Fatal("Failed to initialize Elasticsearch", logging.Err(err))
+	}
+
+	migrations, err := es.MigrateIndices(ctx, *dryRun, *deleteOld)
+	enc := json.NewEncoder(os.Stdout)
+	for _, m := range migrations {
+		enc.Encode(m)
+	}
+	if err != nil {
+		logging.Fatal("Migration failed", logging.Err(err))
+	}
+}
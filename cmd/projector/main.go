@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"portfolio-rebalancer/internal/health"
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/storage"
+	"portfolio-rebalancer/internal/tracing"
+	"portfolio-rebalancer/internal/utils"
+	"syscall"
+	"time"
+)
+
+func main() {
+	logging.Init("rebalancer-projector")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Capture Ctrl+C / SIGTERM
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		slog.Info("Shutting down projector...")
+		cancel()
+	}()
+
+	shutdownTracing, err := tracing.Init(ctx, "rebalancer-projector")
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", logging.Err(err))
+	}
+
+	// The projection is always in Elasticsearch, whatever the storage backend
+	es, err := storage.NewElastic(storage.LoadElasticConfig())
+	if err != nil {
+		logging.Fatal("Failed to initialize Elasticsearch", logging.Err(err))
+	}
+
+	broker, err := kafka.NewBroker()
+	if err != nil {
+		logging.Fatal("Kafka init failed", logging.Err(err))
+	}
+
+	// Serve liveness and readiness probes and metrics
+	checker := health.NewChecker(utils.EnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	checker.Add(storage.BackendElasticsearch, es.CheckHealth)
+	if kafka.BrokerKind() == kafka.BrokerKafka {
+		checker.Add("kafka", kafka.CheckBroker)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.HandleHealthz)
+	mux.HandleFunc("/readyz", checker.HandleReadyz)
+	mux.Handle("/metrics", metrics.Handler())
+
+	healthAddr := os.Getenv("HEALTH_ADDR")
+	if healthAddr == "" {
+		healthAddr = ":8083"
+	}
+	healthSrv := &http.Server{Addr: healthAddr, Handler: mux}
+	go func() {
+		slog.Info("Health server started", "addr", healthAddr)
+		if err := healthSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Health server failed", logging.Err(err))
+		}
+	}()
+	health.SetReady(true)
+
+	slog.Info("Transaction projector started")
+	projectorErr := kafka.NewTransactionProjector(es).Run(ctx, broker)
+	health.SetReady(false)
+
+	if err := broker.Close(); err != nil {
+		slog.Error("Failed to close Kafka writers", logging.Err(err))
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	healthSrv.Shutdown(shutdownCtx)
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", logging.Err(err))
+	}
+
+	if projectorErr != nil && ctx.Err() == nil {
+		// Exit so the orchestrator restarts the projector and the
+		// uncommitted event is redelivered
+		logging.Fatal("Projector failed", logging.Err(projectorErr))
+	}
+	slog.Info("Projector stopped")
+}
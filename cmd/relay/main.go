@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"portfolio-rebalancer/internal/health"
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/outbox"
+	"portfolio-rebalancer/internal/storage"
+	"portfolio-rebalancer/internal/tracing"
+	"portfolio-rebalancer/internal/utils"
+	"syscall"
+	"time"
+)
+
+func main() {
+	logging.Init("rebalancer-relay")
+
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	requeue := fs.Bool("requeue-failed", false, "return the failed outbox entries to pending and exit")
+	fs.Parse(os.Args[1:])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Capture Ctrl+C / SIGTERM
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		slog.Info("Shutting down relay...")
+		cancel()
+	}()
+
+	shutdownTracing, err := tracing.Init(ctx, "rebalancer-relay")
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", logging.Err(err))
+	}
+
+	// Initialize the storage backend
+	store, err := storage.Open()
+	if err != nil {
+		logging.Fatal("Failed to initialize storage", "backend", storage.BackendKind(), logging.Err(err))
+	}
+	defer store.Close()
+
+	// Failed entries are relayed again, oldest first, by the running relay
+	if *requeue {
+		n, err := store.RequeueFailedOutboxEntries(ctx)
+		if err != nil {
+			logging.Fatal("Failed to requeue outbox entries", logging.Err(err))
+		}
+		slog.Info("Requeued failed outbox entries", "count", n)
+		return
+	}
+
+	// Envelopes keep the producer of the API that accepted them
+	broker, err := kafka.NewBroker()
+	if err != nil {
+		logging.Fatal("Kafka init failed", logging.Err(err))
+	}
+
+	// Serve liveness and readiness probes and metrics
+	checker := health.NewChecker(utils.EnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second))
+	checker.Add(storage.BackendKind(), store.CheckHealth)
+	if kafka.BrokerKind() == kafka.BrokerKafka {
+		checker.Add("kafka", kafka.CheckBroker)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", health.HandleHealthz)
+	mux.HandleFunc("/readyz", checker.HandleReadyz)
+	mux.Handle("/metrics", metrics.Handler())
+
+	healthAddr := os.Getenv("HEALTH_ADDR")
+	if healthAddr == "" {
+		healthAddr = ":8082"
+	}
+	healthSrv := &http.Server{Addr: healthAddr, Handler: mux}
+	go func() {
+		slog.Info("Health server started", "addr", healthAddr)
+		if err := healthSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Health server failed", logging.Err(err))
+		}
+	}()
+	health.SetReady(true)
+
+	relay := outbox.NewRelay(store, broker, kafka.RebalanceTopic(),
+		utils.EnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		utils.EnvInt("OUTBOX_BATCH_SIZE", 100),
+		utils.EnvInt("OUTBOX_MAX_ATTEMPTS", 0),
+	)
+	slog.Info("Outbox relay started")
+	relay.Run(ctx)
+	health.SetReady(false)
+
+	if err := broker.Close(); err != nil {
+		slog.Error("Failed to close Kafka writers", logging.Err(err))
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	healthSrv.Shutdown(shutdownCtx)
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", logging.Err(err))
+	}
+	slog.Info("Relay stopped")
+}
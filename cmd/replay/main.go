@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/services"
+	"portfolio-rebalancer/internal/storage"
+	"portfolio-rebalancer/internal/utils"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage:
+  replay [-offset O | -since T] [-until T] [-users U1,U2] [-force] [-mode shadow|reprocess] [-shadow-index I] [-publish]
+
+Reads the rebalance requests in the rebalance topic again, calculates their
+transactions and prints one JSON line for every request whose transactions
+differ from the ones saved by the consumer, followed by a summary.
+
+  -mode shadow     save the new transactions to the shadow index only (default);
+                   requests without a message ID are compared but not saved
+  -mode reprocess  process the requests again like the consumer, replacing their
+                   saved transactions
+  -publish         in reprocess mode, publish a RebalanceCompleted event for every
+                   reprocessed request, as the consumer does. Downstream services
+                   and the projector see the new transactions only with -publish.
+
+Requests whose allocation hash matches the last one or a recent one stored for
+the user are skipped like duplicates in the consumer, unless -force is given.
+
+KAFKA_BROKERS and KAFKA_TOPIC select the cluster and the rebalance topic, with the
+same KAFKA_TLS_* and KAFKA_SASL_* variables as the services. STORAGE_BACKEND and
+the ELASTICSEARCH_* or POSTGRES_* variables select the transactions store; the
+shadow index is always in the Elasticsearch cluster of ELASTICSEARCH_URL.
+`
+
+// Modes of the replay.
+const (
+	modeShadow    = "shadow"
+	modeReprocess = "reprocess"
+)
+
+// Statuses of a replayed request in the output.
+const (
+	statusUnchanged = "unchanged"
+	statusChanged   = "changed"
+	statusNew       = "new"       // nothing saved for the request before
+	statusUnmatched = "unmatched" // published without a message ID, so saved transactions cannot be found
+	statusSkipped   = "skipped"   // duplicate allocation hash
+)
+
+// result is the output line of a replayed request.
+type result struct {
+	UserID    string `json:"user_id"`
+	RequestID string `json:"request_id,omitempty"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	Time      string `json:"time"`
+	Status    string `json:"status"`
+	services.TransactionDiff
+}
+
+func main() {
+	logging.Init("rebalancer-replay")
+
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	offset := fs.Int64("offset", 0, "first offset to read in every partition")
+	since := fs.String("since", "", "read messages published at or after this RFC 3339 time")
+	until := fs.String("until", "", "stop at messages published after this RFC 3339 time")
+	users := fs.String("users", "", "comma-separated user IDs to replay (default all)")
+	force := fs.Bool("force", false, "replay requests with an unchanged allocation hash")
+	mode := fs.String("mode", modeShadow, "shadow or reprocess")
+	shadowIndex := fs.String("shadow-index", storage.TransactionsIndex+"_shadow", "index for the transactions in shadow mode")
+	publish := fs.Bool("publish", false, "publish RebalanceCompleted events in reprocess mode")
+	fs.Parse(os.Args[1:])
+
+	opts, err := replayOptions(*offset, *since, *until, *users)
+	if err == nil && *publish && *mode != modeReprocess {
+		err = errors.New("-publish requires -mode reprocess")
+	}
+	if err != nil || (*mode != modeShadow && *mode != modeReprocess) || *shadowIndex == storage.TransactionsIndex {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rp := &replayer{mode: *mode, force: *force, publish: *publish}
+	if err := rp.run(ctx, opts, *shadowIndex); err != nil {
+		logging.Fatal("Replay failed", "mode", *mode, logging.Err(err))
+	}
+}
+
+func replayOptions(offset int64, since, until, users string) (kafka.ReplayOptions, error) {
+	opts := kafka.ReplayOptions{FromOffset: offset}
+	var err error
+	if since != "" {
+		if offset != 0 {
+			return opts, errors.New("-offset and -since cannot be combined")
+		}
+		if opts.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return opts, fmt.Errorf("invalid -since: %w", err)
+		}
+	}
+	if until != "" {
+		if opts.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return opts, fmt.Errorf("invalid -until: %w", err)
+		}
+	}
+	if users != "" {
+		opts.Users = make(map[string]bool)
+		for _, u := range strings.Split(users, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				opts.Users[u] = true
+			}
+		}
+	}
+	return opts, nil
+}
+
+// replayer replays rebalance requests in one mode.
+type replayer struct {
+	mode     string
+	force    bool
+	publish  bool // reprocess mode only
+	store    storage.Store
+	shadow   *storage.Elastic         // shadow mode only
+	consumer *kafka.RebalanceConsumer // reprocess mode only
+}
+
+func (rp *replayer) run(ctx context.Context, opts kafka.ReplayOptions, shadowIndex string) error {
+	store, err := storage.Open()
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	defer store.Close()
+	rp.store = store
+
+	if rp.mode == modeReprocess {
+		cluster, err := kafka.NewCluster()
+		if err != nil {
+			return fmt.Errorf("kafka init failed: %w", err)
+		}
+		defer cluster.Close()
+		rp.consumer = kafka.NewRebalanceConsumer(cluster, store, store)
+	} else {
+		if err := kafka.ConfigureSerializers(); err != nil {
+			return fmt.Errorf("failed to configure serializers: %w", err)
+		}
+		// The shadow index is in Elasticsearch whatever the storage backend
+		es, err := storage.NewElastic(storage.LoadElasticConfig())
+		if err != nil {
+			return fmt.Errorf("failed to initialize Elasticsearch: %w", err)
+		}
+		rp.shadow = es.WithTransactionsIndex(shadowIndex)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	counts := make(map[string]int)
+	err = kafka.ReadRebalanceRequests(ctx, opts, func(r kafka.ReplayedRequest) error {
+		res, err := rp.replay(ctx, r)
+		if err != nil {
+			return fmt.Errorf("failed to replay message %d/%d: %w", r.Partition, r.Offset, err)
+		}
+		counts[res.Status]++
+		if res.Status == statusUnchanged || res.Status == statusSkipped {
+			return nil
+		}
+		return enc.Encode(res)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Replayed rebalance requests", "mode", rp.mode,
+		statusUnchanged, counts[statusUnchanged],
+		statusChanged, counts[statusChanged],
+		statusNew, counts[statusNew],
+		statusUnmatched, counts[statusUnmatched],
+		statusSkipped, counts[statusSkipped])
+	return nil
+}
+
+// replay calculates the transactions of r again, compares them with the saved
+// ones and saves them according to the mode.
+func (rp *replayer) replay(ctx context.Context, r kafka.ReplayedRequest) (result, error) {
+	req := r.Request
+	requestID := r.Envelope.MessageID
+	res := result{
+		UserID:    req.UserID,
+		RequestID: requestID,
+		Partition: r.Partition,
+		Offset:    r.Offset,
+		Time:      r.Time.UTC().Format(time.RFC3339),
+	}
+
+	if !rp.force {
+		duplicate, err := rp.isDuplicate(ctx, r)
+		if err != nil {
+			return res, err
+		}
+		if duplicate {
+			res.Status = statusSkipped
+			return res, nil
+		}
+	}
+
+	after := services.CalculateRebalance(req.UserID, req.NewAllocation, req.CurrentAllocation)
+	if requestID == "" {
+		res.Status = statusUnmatched
+		res.TransactionDiff = services.DiffTransactions(nil, after)
+	} else {
+		// Read before reprocessing replaces them
+		before, err := rp.store.GetRebalanceTransactions(ctx, requestID)
+		if err != nil {
+			return res, err
+		}
+		res.TransactionDiff = services.DiffTransactions(before, after)
+		switch {
+		case len(before) == 0 && len(after) > 0:
+			res.Status = statusNew
+		case res.Empty():
+			res.Status = statusUnchanged
+		default:
+			res.Status = statusChanged
+		}
+	}
+
+	if rp.mode == modeReprocess {
+		return res, rp.consumer.Reprocess(ctx, r, rp.publish)
+	}
+	if res.Status == statusUnmatched {
+		// Saved without a request ID, the transactions would get new IDs and be
+		// added again on every replay
+		return res, nil
+	}
+	return res, rp.shadow.SaveRebalanceTransactions(ctx, requestID, after)
+}
+
+// isDuplicate applies the consumer's idempotency check: a request is a duplicate
+// if its allocation hash matches the last one or a recent one stored for the user.
+func (rp *replayer) isDuplicate(ctx context.Context, r kafka.ReplayedRequest) (bool, error) {
+	p, err := rp.store.GetRebalanceRequest(ctx, r.Request.UserID)
+	if errors.Is(err, storage.ErrRequestNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return p.HasProcessed(utils.CanonicalHash(r.Request.NewAllocation)), nil
+}
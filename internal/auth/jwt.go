@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"portfolio-rebalancer/internal/logging"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Roles carried in the "roles" claim of an access token.
+const (
+	RoleUser     = "user"
+	RoleAdvisor  = "advisor"
+	RoleProvider = "provider"
+	RoleAdmin    = "admin"
+)
+
+var (
+	ErrMissingToken = errors.New("missing bearer token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+// Claims are the JWT claims used for authorization. The subject is the user ID
+// of the caller; advisors additionally list the users assigned to them.
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles         []string `json:"roles"`
+	AssignedUsers []string `json:"assigned_users,omitempty"`
+}
+
+// HasRole reports whether the claims include any of roles.
+func (c *Claims) HasRole(roles ...string) bool {
+	for _, have := range c.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanAccessUser reports whether the caller may read or manage userID's portfolio.
+// Admins can access every user, users only themselves and advisors their assigned users.
+func (c *Claims) CanAccessUser(userID string) bool {
+	if c.HasRole(RoleAdmin) {
+		return true
+	}
+	if c.HasRole(RoleUser) && c.Subject == userID {
+		return true
+	}
+	if c.HasRole(RoleAdvisor) {
+		for _, assigned := range c.AssignedUsers {
+			if assigned == userID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of ctx carrying claims.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims of the authenticated caller, if any.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok && claims != nil
+}
+
+// Authenticator validates bearer JWTs against a static key or a set of keys loaded from a JWKS file.
+type Authenticator struct {
+	keys   map[string]interface{} // kid -> verification key; "" is used for tokens without a kid
+	parser *jwt.Parser
+}
+
+// NewAuthenticator creates an authenticator for tokens signed with one of keys.
+// Keys are indexed by key ID; a key stored under "" accepts tokens without a kid.
+func NewAuthenticator(keys map[string]interface{}, issuer, audience string) (*Authenticator, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no JWT verification keys configured")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+
+	return &Authenticator{
+		keys:   keys,
+		parser: jwt.NewParser(opts...),
+	}, nil
+}
+
+// NewAuthenticatorFromEnv creates an authenticator from JWT_JWKS_FILE (a local JWKS document)
+// or JWT_SECRET (a static HMAC key). JWT_ISSUER and JWT_AUDIENCE are enforced when set.
+func NewAuthenticatorFromEnv() (*Authenticator, error) {
+	keys := make(map[string]interface{})
+
+	if path := os.Getenv("JWT_JWKS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+		}
+		if keys, err = ParseJWKS(data); err != nil {
+			return nil, err
+		}
+	} else if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		keys[""] = []byte(secret)
+	}
+
+	return NewAuthenticator(keys, os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"))
+}
+
+// Authenticate parses and validates a raw token.
+func (a *Authenticator) Authenticate(raw string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := a.parser.ParseWithClaims(raw, claims, a.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *Authenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := a.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	// Make sure the token algorithm matches the key type so an RSA public key
+	// can never be used as an HMAC secret.
+	switch key.(type) {
+	case []byte:
+		_, ok = token.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, fmt.Errorf("signing method %s does not match key %q", token.Method.Alg(), kid)
+	}
+
+	return key, nil
+}
+
+// Middleware authenticates the bearer token and stores its claims in the request context.
+func (a *Authenticator) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := bearerToken(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		claims, err := a.Authenticate(raw)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected bearer token", logging.Err(err))
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		next(w, r.WithContext(WithClaims(r.Context(), claims)))
+	}
+}
+
+// RequireRole rejects authenticated callers that have none of roles.
+func RequireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			if !claims.HasRole(roles...) {
+				writeError(w, http.StatusForbidden, "Forbidden")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS parses a JSON Web Key Set into verification keys indexed by kid.
+// RSA, EC (P-256/P-384/P-521) and symmetric ("oct") keys are supported.
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
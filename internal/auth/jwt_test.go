@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newClaims(subject string, roles ...string) *Claims {
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Roles: roles,
+	}
+}
+
+func TestAuthenticator_StaticKey(t *testing.T) {
+	secret := []byte("test-secret")
+	a, err := NewAuthenticator(map[string]interface{}{"": secret}, "", "")
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error = %v", err)
+	}
+
+	expired := newClaims("user1", RoleUser)
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+
+	noExpiry := newClaims("user1", RoleUser)
+	noExpiry.ExpiresAt = nil
+
+	tests := []struct {
+		name    string
+		token   *jwt.Token
+		key     interface{}
+		wantErr bool
+	}{
+		{
+			name:    "Valid token",
+			token:   jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("user1", RoleUser)),
+			key:     secret,
+			wantErr: false,
+		},
+		{
+			name:    "Wrong key",
+			token:   jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims("user1", RoleUser)),
+			key:     []byte("other-secret"),
+			wantErr: true,
+		},
+		{
+			name:    "Expired token",
+			token:   jwt.NewWithClaims(jwt.SigningMethodHS256, expired),
+			key:     secret,
+			wantErr: true,
+		},
+		{
+			name:    "Missing expiry",
+			token:   jwt.NewWithClaims(jwt.SigningMethodHS256, noExpiry),
+			key:     secret,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := tt.token.SignedString(tt.key)
+			if err != nil {
+				t.Fatalf("SignedString() error = %v", err)
+			}
+
+			claims, err := a.Authenticate(raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Subject != "user1" {
+				t.Errorf("expected subject user1, got %s", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_JWKS(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	jwks := fmt.Sprintf(`{"keys":[{"kid":"key-1","kty":"RSA","use":"sig","n":%q,"e":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(priv.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(priv.E)).Bytes()),
+	)
+
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatalf("ParseJWKS() error = %v", err)
+	}
+
+	a, err := NewAuthenticator(keys, "", "")
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error = %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, newClaims("provider1", RoleProvider))
+	token.Header["kid"] = "key-1"
+	raw, err := token.SignedString(priv)
+	if err != nil {
+		t.Fatalf("SignedString() error = %v", err)
+	}
+
+	claims, err := a.Authenticate(raw)
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if !claims.HasRole(RoleProvider) {
+		t.Errorf("expected provider role, got %v", claims.Roles)
+	}
+
+	token.Header["kid"] = "key-2"
+	raw, _ = token.SignedString(priv)
+	if _, err := a.Authenticate(raw); err == nil {
+		t.Error("expected error for unknown kid")
+	}
+}
+
+func TestClaims_CanAccessUser(t *testing.T) {
+	advisor := newClaims("advisor1", RoleAdvisor)
+	advisor.AssignedUsers = []string{"user1"}
+
+	tests := []struct {
+		name     string
+		claims   *Claims
+		userID   string
+		expected bool
+	}{
+		{"User accessing self", newClaims("user1", RoleUser), "user1", true},
+		{"User accessing other", newClaims("user1", RoleUser), "user2", false},
+		{"Advisor accessing assigned user", advisor, "user1", true},
+		{"Advisor accessing unassigned user", advisor, "user2", false},
+		{"Admin accessing any user", newClaims("admin1", RoleAdmin), "user2", true},
+		{"Provider accessing user", newClaims("user1", RoleProvider), "user1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.claims.CanAccessUser(tt.userID); got != tt.expected {
+				t.Errorf("CanAccessUser(%s) = %v, want %v", tt.userID, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Middleware(t *testing.T) {
+	secret := []byte("test-secret")
+	a, err := NewAuthenticator(map[string]interface{}{"": secret}, "", "")
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error = %v", err)
+	}
+
+	sign := func(c *Claims) string {
+		raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(secret)
+		if err != nil {
+			t.Fatalf("SignedString() error = %v", err)
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{"Provider token", "Bearer " + sign(newClaims("provider1", RoleProvider)), http.StatusOK},
+		{"User token", "Bearer " + sign(newClaims("user1", RoleUser)), http.StatusForbidden},
+		{"Missing token", "", http.StatusUnauthorized},
+		{"Malformed token", "Bearer not-a-jwt", http.StatusUnauthorized},
+	}
+
+	handler := a.Middleware(RequireRole(RoleProvider)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/rebalance", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/models"
+)
+
+// Headers a provider must send with every signed callback.
+const (
+	HeaderProviderID = "X-Provider-ID"
+	HeaderTimestamp  = "X-Timestamp"
+	HeaderSignature  = "X-Signature"
+)
+
+// MaxActiveSecrets is the number of secrets a provider may have active at once,
+// which allows a new secret to be rolled out before the old one is revoked.
+const MaxActiveSecrets = 2
+
+const (
+	defaultReplayWindow = 5 * time.Minute
+	maxSignedBodyBytes  = 1 << 20 // 1MB
+)
+
+var (
+	ErrMissingSignature = errors.New("missing signature headers")
+	ErrUnknownProvider  = errors.New("unknown provider")
+	ErrInvalidTimestamp = errors.New("invalid signature timestamp")
+	ErrStaleTimestamp   = errors.New("signature timestamp outside replay window")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrReplayedRequest  = errors.New("signature already used")
+)
+
+// SignatureVerifier checks HMAC-SHA256 signatures sent by third-party providers.
+// The signature is computed over "<timestamp>.<raw body>" with one of the
+// provider's shared secrets and sent hex encoded in the X-Signature header.
+type SignatureVerifier struct {
+	mu      sync.Mutex
+	secrets map[string][]string  // provider ID -> active secrets
+	seen    map[string]time.Time // signature -> request timestamp, pruned after the replay window
+	window  time.Duration
+	now     func() time.Time
+}
+
+// NewSignatureVerifier creates a verifier accepting timestamps within window of the current time.
+// A zero window uses the default of 5 minutes.
+func NewSignatureVerifier(secrets map[string][]string, window time.Duration) (*SignatureVerifier, error) {
+	if window <= 0 {
+		window = defaultReplayWindow
+	}
+
+	v := &SignatureVerifier{
+		seen:   make(map[string]time.Time),
+		window: window,
+		now:    time.Now,
+	}
+	if err := v.SetSecrets(secrets); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// SetSecrets replaces the provider secrets, e.g. after a rotation. Each provider
+// may have at most MaxActiveSecrets secrets active at the same time.
+func (v *SignatureVerifier) SetSecrets(secrets map[string][]string) error {
+	copied := make(map[string][]string, len(secrets))
+	for provider, keys := range secrets {
+		if provider == "" {
+			return errors.New("provider ID cannot be empty")
+		}
+		if len(keys) == 0 || len(keys) > MaxActiveSecrets {
+			return fmt.Errorf("provider %s must have between 1 and %d active secrets", provider, MaxActiveSecrets)
+		}
+		for _, k := range keys {
+			if k == "" {
+				return fmt.Errorf("provider %s has an empty secret", provider)
+			}
+		}
+		copied[provider] = append([]string(nil), keys...)
+	}
+
+	v.mu.Lock()
+	v.secrets = copied
+	v.mu.Unlock()
+	return nil
+}
+
+// Verify validates the signature headers against body.
+func (v *SignatureVerifier) Verify(providerID, timestamp, signature string, body []byte) error {
+	if providerID == "" || timestamp == "" || signature == "" {
+		return ErrMissingSignature
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys, ok := v.secrets[providerID]
+	if !ok {
+		return ErrUnknownProvider
+	}
+
+	now := v.now()
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-v.window)) || sent.After(now.Add(v.window)) {
+		return ErrStaleTimestamp
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal(got, computeSignature(key, timestamp, body)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	// A signature is unique to its timestamp and body, so seeing it twice
+	// within the window means the request was replayed.
+	v.pruneSeen(now)
+	seenKey := providerID + ":" + hex.EncodeToString(got)
+	if _, dup := v.seen[seenKey]; dup {
+		return ErrReplayedRequest
+	}
+	v.seen[seenKey] = sent
+
+	return nil
+}
+
+// pruneSeen drops remembered signatures whose timestamp has left the replay window.
+// The caller must hold v.mu.
+func (v *SignatureVerifier) pruneSeen(now time.Time) {
+	cutoff := now.Add(-v.window)
+	for k, ts := range v.seen {
+		if ts.Before(cutoff) {
+			delete(v.seen, k)
+		}
+	}
+}
+
+// Middleware rejects requests without a valid provider signature before next reads the body.
+func (v *SignatureVerifier) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+		if err != nil || len(body) > maxSignedBodyBytes {
+			writeError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body.Close()
+
+		providerID := r.Header.Get(HeaderProviderID)
+		err = v.Verify(providerID, r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature), body)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected signed request", "provider_id", providerID, logging.Err(err))
+			writeError(w, http.StatusUnauthorized, "Invalid request signature")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
+
+// Sign returns the hex encoded signature a provider sends for body at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	return hex.EncodeToString(computeSignature(secret, timestamp, body))
+}
+
+func computeSignature(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// LoadProviderSecrets reads provider secrets from the JSON file named by
+// PROVIDER_SECRETS_FILE ({"provider": ["current", "previous"]}), falling back to
+// PROVIDER_SECRETS in the form "provider1:current|previous,provider2:current".
+func LoadProviderSecrets() (map[string][]string, error) {
+	if path := os.Getenv("PROVIDER_SECRETS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read provider secrets file: %w", err)
+		}
+		var secrets map[string][]string
+		if err := json.Unmarshal(data, &secrets); err != nil {
+			return nil, fmt.Errorf("failed to parse provider secrets file: %w", err)
+		}
+		return secrets, nil
+	}
+
+	return ParseProviderSecrets(os.Getenv("PROVIDER_SECRETS"))
+}
+
+// ParseProviderSecrets parses the PROVIDER_SECRETS format "provider1:current|previous,provider2:current".
+func ParseProviderSecrets(raw string) (map[string][]string, error) {
+	secrets := make(map[string][]string)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		provider, keys, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid provider secret entry %q", entry)
+		}
+		secrets[provider] = strings.Split(keys, "|")
+	}
+	return secrets, nil
+}
+
+// ReplayWindow returns SIGNATURE_REPLAY_WINDOW parsed as a duration, or zero if unset or invalid.
+func ReplayWindow() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("SIGNATURE_REPLAY_WINDOW"))
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.APIResponse{
+		Success: false,
+		Message: message,
+	})
+}
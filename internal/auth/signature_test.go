@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestVerifier(t *testing.T, now time.Time) *SignatureVerifier {
+	t.Helper()
+	v, err := NewSignatureVerifier(map[string][]string{
+		"provider1": {"new-secret", "old-secret"},
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("NewSignatureVerifier() error = %v", err)
+	}
+	v.now = func() time.Time { return now }
+	return v
+}
+
+func TestSignatureVerifier_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"user_id":"1","new_allocation":{"stocks":70,"bonds":30}}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	tests := []struct {
+		name      string
+		provider  string
+		timestamp string
+		signature string
+		expected  error
+	}{
+		{
+			name:      "Valid signature with current secret",
+			provider:  "provider1",
+			timestamp: ts,
+			signature: Sign("new-secret", ts, body),
+			expected:  nil,
+		},
+		{
+			name:      "Valid signature with previous secret",
+			provider:  "provider1",
+			timestamp: ts,
+			signature: "sha256=" + Sign("old-secret", ts, body),
+			expected:  nil,
+		},
+		{
+			name:      "Missing signature",
+			provider:  "provider1",
+			timestamp: ts,
+			signature: "",
+			expected:  ErrMissingSignature,
+		},
+		{
+			name:      "Unknown provider",
+			provider:  "provider2",
+			timestamp: ts,
+			signature: Sign("new-secret", ts, body),
+			expected:  ErrUnknownProvider,
+		},
+		{
+			name:      "Wrong secret",
+			provider:  "provider1",
+			timestamp: ts,
+			signature: Sign("revoked-secret", ts, body),
+			expected:  ErrInvalidSignature,
+		},
+		{
+			name:      "Stale timestamp",
+			provider:  "provider1",
+			timestamp: strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10),
+			signature: Sign("new-secret", strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10), body),
+			expected:  ErrStaleTimestamp,
+		},
+		{
+			name:      "Invalid timestamp",
+			provider:  "provider1",
+			timestamp: "yesterday",
+			signature: Sign("new-secret", "yesterday", body),
+			expected:  ErrInvalidTimestamp,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifier(t, now)
+			err := v.Verify(tt.provider, tt.timestamp, tt.signature, body)
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifier_Replay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := newTestVerifier(t, now)
+
+	body := []byte(`{"user_id":"1"}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	sig := Sign("new-secret", ts, body)
+
+	if err := v.Verify("provider1", ts, sig, body); err != nil {
+		t.Fatalf("first Verify() error = %v", err)
+	}
+	if err := v.Verify("provider1", ts, sig, body); !errors.Is(err, ErrReplayedRequest) {
+		t.Errorf("second Verify() error = %v, want %v", err, ErrReplayedRequest)
+	}
+}
+
+func TestSignatureVerifier_SetSecrets(t *testing.T) {
+	v := newTestVerifier(t, time.Now())
+
+	err := v.SetSecrets(map[string][]string{"provider1": {"a", "b", "c"}})
+	if err == nil {
+		t.Error("expected error for more than two active secrets")
+	}
+
+	if err := v.SetSecrets(map[string][]string{"provider1": {"rotated"}}); err != nil {
+		t.Fatalf("SetSecrets() error = %v", err)
+	}
+
+	ts := strconv.FormatInt(v.now().Unix(), 10)
+	if err := v.Verify("provider1", ts, Sign("old-secret", ts, nil), nil); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected revoked secret to be rejected, got %v", err)
+	}
+}
+
+func TestSignatureVerifier_Middleware(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"user_id":"1"}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	tests := []struct {
+		name           string
+		signature      string
+		expectedStatus int
+	}{
+		{
+			name:           "Valid signature",
+			signature:      Sign("new-secret", ts, body),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Invalid signature",
+			signature:      Sign("wrong", ts, body),
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifier(t, now)
+
+			var gotBody []byte
+			handler := v.Middleware(func(w http.ResponseWriter, r *http.Request) {
+				gotBody = make([]byte, len(body))
+				r.Body.Read(gotBody)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/rebalance", bytes.NewReader(body))
+			req.Header.Set(HeaderProviderID, "provider1")
+			req.Header.Set(HeaderTimestamp, ts)
+			req.Header.Set(HeaderSignature, tt.signature)
+			w := httptest.NewRecorder()
+
+			handler(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedStatus == http.StatusOK && !bytes.Equal(gotBody, body) {
+				t.Errorf("Expected body %s to reach handler, got %s", body, gotBody)
+			}
+		})
+	}
+}
+
+func TestParseProviderSecrets(t *testing.T) {
+	secrets, err := ParseProviderSecrets("acme:current|previous, other:only")
+	if err != nil {
+		t.Fatalf("ParseProviderSecrets() error = %v", err)
+	}
+	if len(secrets["acme"]) != 2 || secrets["acme"][1] != "previous" {
+		t.Errorf("unexpected secrets for acme: %v", secrets["acme"])
+	}
+	if len(secrets["other"]) != 1 {
+		t.Errorf("unexpected secrets for other: %v", secrets["other"])
+	}
+
+	if _, err := ParseProviderSecrets("missing-colon"); err == nil {
+		t.Error("expected error for entry without provider separator")
+	}
+}
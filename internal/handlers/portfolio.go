@@ -1,50 +1,102 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"net/http"
+	"portfolio-rebalancer/internal/auth"
 	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
 	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/router"
 	"portfolio-rebalancer/internal/storage"
 	"portfolio-rebalancer/internal/utils"
 )
 
-var (
-	// savePortfolio is a function variable that points to storage.SavePortfolio.
-	// It is used to allow mocking in unit tests.
-	savePortfolio = storage.SavePortfolio
+// EventQueue stores events to be published to Kafka, e.g. an outbox.Queue.
+type EventQueue interface {
+	Enqueue(ctx context.Context, key, eventType string, version int, payload interface{}) error
+}
 
-	// getPortfolio is a function variable that points to storage.GetPortfolio.
-	// It is used to allow mocking in unit tests.
-	getPortfolio = storage.GetPortfolio
+// PortfolioHandler serves the portfolio and rebalance endpoints.
+type PortfolioHandler struct {
+	portfolios storage.PortfolioRepository
+	events     EventQueue
+}
 
-	// publishMessage is a function variable that points to kafka.PublishMessage.
-	// It is used to allow mocking in unit tests.
-	publishMessage = kafka.PublishMessage
-)
+// NewPortfolioHandler returns a handler that stores portfolios in portfolios
+// and queues rebalance events in events.
+func NewPortfolioHandler(portfolios storage.PortfolioRepository, events EventQueue) *PortfolioHandler {
+	return &PortfolioHandler{portfolios: portfolios, events: events}
+}
 
-// HandlePortfolio handles new portfolio creation requests (feel free to update the request parameter/model)
-// Sample Request (POST /portfolio):
-//
-//	{
-//	    "user_id": "1",
-//	    "allocation": {"stocks": 60, "bonds": 30, "gold": 10}
-//	}
-func HandlePortfolio(w http.ResponseWriter, r *http.Request) {
+// HandleGetPortfolio returns the portfolio of the user given by the user_id path or query parameter
+// Sample Request (GET /v1/portfolio/1 or GET /v1/portfolio?user_id=1)
+func (h *PortfolioHandler) HandleGetPortfolio(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Only allow POST
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	userID := router.Param(r, "user_id")
+	if userID == "" {
+		userID = r.URL.Query().Get("user_id")
+	}
+	if userID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.APIResponse{
+			Success: false,
+			Message: "user_id is required",
+		})
+		return
+	}
+
+	// Users may only read their own portfolio, advisors their assigned users
+	if !canAccessUser(r, userID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(models.APIResponse{
+			Success: false,
+			Message: "Forbidden",
+		})
+		return
+	}
+
+	p, err := h.portfolios.GetPortfolio(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, storage.ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(models.APIResponse{
+				Success: false,
+				Message: "User not found",
+			})
+			return
+		}
+
+		slog.ErrorContext(r.Context(), "Failed to get portfolio", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(models.APIResponse{
 			Success: false,
-			Message: "Method not allowed",
+			Message: "Internal server error",
 		})
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.APIResponse{
+		Success: true,
+		Data:    p,
+	})
+}
+
+// HandleCreatePortfolio handles new portfolio creation requests (feel free to update the request parameter/model)
+// Sample Request (POST /v1/portfolio):
+//
+//	{
+//	    "user_id": "1",
+//	    "allocation": {"stocks": 60, "bonds": 30, "gold": 10}
+//	}
+func (h *PortfolioHandler) HandleCreatePortfolio(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
 	// Decode request body
 	var p models.Portfolio
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
@@ -75,9 +127,19 @@ func HandlePortfolio(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Save to Elasticsearch
-	if err := savePortfolio(r.Context(), &p); err != nil {
-		log.Printf("Failed to save portfolio: %v", err)
+	// Users may only manage their own portfolio, advisors their assigned users
+	if !canAccessUser(r, p.UserID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(models.APIResponse{
+			Success: false,
+			Message: "Forbidden",
+		})
+		return
+	}
+
+	// Save to the portfolio repository
+	if err := h.portfolios.SavePortfolio(r.Context(), &p); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save portfolio", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(models.APIResponse{
 			Success: false,
@@ -96,25 +158,15 @@ func HandlePortfolio(w http.ResponseWriter, r *http.Request) {
 }
 
 // HandleRebalance handles portfolio rebalance requests from 3rd party provider (feel free to update the request parameter/model)
-// Sample Request (POST /rebalance):
+// Sample Request (POST /v1/rebalance):
 //
 //	{
 //	    "user_id": "1",
 //	    "new_allocation": {"stocks": 70, "bonds": 20, "gold": 10}
 //	}
-func HandleRebalance(w http.ResponseWriter, r *http.Request) {
+func (h *PortfolioHandler) HandleRebalance(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Only allow POST
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(models.APIResponse{
-			Success: false,
-			Message: "Method not allowed",
-		})
-		return
-	}
-
 	// Decode request body
 	var req models.UpdatedPortfolio
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -145,8 +197,8 @@ func HandleRebalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get current allocation from Elasticsearch
-	p, err := getPortfolio(r.Context(), req.UserID)
+	// Get current allocation from the portfolio repository
+	p, err := h.portfolios.GetPortfolio(r.Context(), req.UserID)
 	if err != nil {
 		if errors.Is(err, storage.ErrUserNotFound) {
 			w.WriteHeader(http.StatusNotFound)
@@ -157,7 +209,7 @@ func HandleRebalance(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		log.Printf("Failed to get current portfolio: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to get current portfolio", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(models.APIResponse{
 			Success: false,
@@ -166,7 +218,7 @@ func HandleRebalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Println("HandleRebalance==", req)
+	slog.InfoContext(r.Context(), "Rebalance requested")
 
 	// Check canonical hash
 	newHash := utils.CanonicalHash(req.NewAllocation)
@@ -180,27 +232,15 @@ func HandleRebalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Marshal request to JSON for Kafka
 	rbk := models.RebalancePortfolioKafka{
 		UserID:            req.UserID,
 		NewAllocation:     req.NewAllocation,
 		CurrentAllocation: p.Allocation,
 	}
 
-	payload, err := json.Marshal(rbk)
-	if err != nil {
-		log.Printf("Failed to marshal request: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(models.APIResponse{
-			Success: false,
-			Message: "Internal server error",
-		})
-		return
-	}
-
-	// Publish to Kafka
-	if err := publishMessage(r.Context(), payload); err != nil {
-		log.Printf("Failed to publish message to Kafka: %v", err)
+	// Store the event in the outbox; the relay publishes it to Kafka
+	if err := h.events.Enqueue(r.Context(), req.UserID, kafka.EventRebalanceRequested, kafka.RebalanceRequestedVersion, rbk); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to store rebalance event in outbox", logging.Err(err))
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(models.APIResponse{
 			Success: false,
@@ -217,3 +257,9 @@ func HandleRebalance(w http.ResponseWriter, r *http.Request) {
 		Message: "Rebalance request accepted",
 	})
 }
+
+// canAccessUser reports whether the authenticated caller may access userID's portfolio.
+func canAccessUser(r *http.Request, userID string) bool {
+	claims, ok := auth.ClaimsFromContext(r.Context())
+	return ok && claims.CanAccessUser(userID)
+}
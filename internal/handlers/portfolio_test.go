@@ -9,19 +9,45 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"portfolio-rebalancer/internal/auth"
+	"portfolio-rebalancer/internal/kafka"
 	"portfolio-rebalancer/internal/models"
 	"portfolio-rebalancer/internal/storage"
 )
 
-func TestHandlePortfolio(t *testing.T) {
-	// Backup original function and restore after test
-	origSave := savePortfolio
-	defer func() { savePortfolio = origSave }()
+func claimsFor(userID string, roles ...string) *auth.Claims {
+	c := &auth.Claims{Roles: roles}
+	c.Subject = userID
+	return c
+}
+
+// mockPortfolios implements storage.PortfolioRepository with the given functions.
+type mockPortfolios struct {
+	save func(ctx context.Context, p *models.Portfolio) error
+	get  func(ctx context.Context, userID string) (*models.Portfolio, error)
+}
+
+func (m mockPortfolios) SavePortfolio(ctx context.Context, p *models.Portfolio) error {
+	return m.save(ctx, p)
+}
+
+func (m mockPortfolios) GetPortfolio(ctx context.Context, userID string) (*models.Portfolio, error) {
+	return m.get(ctx, userID)
+}
+
+// enqueueFunc implements EventQueue with a function.
+type enqueueFunc func(ctx context.Context, key, eventType string, version int, payload interface{}) error
+
+func (f enqueueFunc) Enqueue(ctx context.Context, key, eventType string, version int, payload interface{}) error {
+	return f(ctx, key, eventType, version, payload)
+}
 
+func TestHandleCreatePortfolio(t *testing.T) {
 	tests := []struct {
 		name           string
 		method         string
 		body           interface{}
+		claims         *auth.Claims
 		mockSave       func(ctx context.Context, p *models.Portfolio) error
 		expectedStatus int
 	}{
@@ -38,13 +64,27 @@ func TestHandlePortfolio(t *testing.T) {
 			expectedStatus: http.StatusCreated,
 		},
 		{
-			name:   "Invalid Method",
-			method: http.MethodGet,
-			body:   nil,
+			name:   "Advisor for assigned user",
+			method: http.MethodPost,
+			body: models.Portfolio{
+				UserID:     "user1",
+				Allocation: map[string]float64{"stocks": 60, "bonds": 40},
+			},
+			claims: &auth.Claims{Roles: []string{auth.RoleAdvisor}, AssignedUsers: []string{"user1"}},
 			mockSave: func(ctx context.Context, p *models.Portfolio) error {
 				return nil
 			},
-			expectedStatus: http.StatusMethodNotAllowed,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "Forbidden - Other User",
+			method: http.MethodPost,
+			body: models.Portfolio{
+				UserID:     "user2",
+				Allocation: map[string]float64{"stocks": 60, "bonds": 40},
+			},
+			mockSave:       nil,
+			expectedStatus: http.StatusForbidden,
 		},
 		{
 			name:           "Invalid Body",
@@ -89,8 +129,7 @@ func TestHandlePortfolio(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Set mock
-			savePortfolio = tt.mockSave
+			h := NewPortfolioHandler(mockPortfolios{save: tt.mockSave}, nil)
 
 			var reqBody []byte
 			var err error
@@ -103,10 +142,16 @@ func TestHandlePortfolio(t *testing.T) {
 				}
 			}
 
+			claims := tt.claims
+			if claims == nil {
+				claims = claimsFor("user1", auth.RoleUser)
+			}
+
 			req := httptest.NewRequest(tt.method, "/portfolio", bytes.NewReader(reqBody))
+			req = req.WithContext(auth.WithClaims(req.Context(), claims))
 			w := httptest.NewRecorder()
 
-			HandlePortfolio(w, req)
+			h.HandleCreatePortfolio(w, req)
 
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
@@ -115,21 +160,99 @@ func TestHandlePortfolio(t *testing.T) {
 	}
 }
 
-func TestHandleRebalance(t *testing.T) {
-	// Backup original functions
-	origGet := getPortfolio
-	origPublish := publishMessage
-	defer func() {
-		getPortfolio = origGet
-		publishMessage = origPublish
-	}()
+func TestHandleGetPortfolio(t *testing.T) {
+	tests := []struct {
+		name            string
+		userID          string
+		claims          *auth.Claims
+		mockGet         func(ctx context.Context, userID string) (*models.Portfolio, error)
+		expectedStatus  int
+		expectedMessage string
+	}{
+		{
+			name:   "Own portfolio",
+			userID: "user1",
+			claims: claimsFor("user1", auth.RoleUser),
+			mockGet: func(ctx context.Context, userID string) (*models.Portfolio, error) {
+				return &models.Portfolio{UserID: userID, Allocation: map[string]float64{"stocks": 100}}, nil
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Other user's portfolio",
+			userID:         "user2",
+			claims:         claimsFor("user1", auth.RoleUser),
+			mockGet:        nil,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Advisor for unassigned user",
+			userID:         "user2",
+			claims:         &auth.Claims{Roles: []string{auth.RoleAdvisor}, AssignedUsers: []string{"user1"}},
+			mockGet:        nil,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:   "Admin",
+			userID: "user2",
+			claims: claimsFor("admin1", auth.RoleAdmin),
+			mockGet: func(ctx context.Context, userID string) (*models.Portfolio, error) {
+				return &models.Portfolio{UserID: userID, Allocation: map[string]float64{"stocks": 100}}, nil
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:   "User Not Found",
+			userID: "user1",
+			claims: claimsFor("user1", auth.RoleUser),
+			mockGet: func(ctx context.Context, userID string) (*models.Portfolio, error) {
+				return nil, storage.ErrUserNotFound
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:            "Missing UserID",
+			userID:          "",
+			claims:          claimsFor("user1", auth.RoleUser),
+			mockGet:         nil,
+			expectedStatus:  http.StatusBadRequest,
+			expectedMessage: "user_id is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewPortfolioHandler(mockPortfolios{get: tt.mockGet}, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/portfolio?user_id="+tt.userID, nil)
+			req = req.WithContext(auth.WithClaims(req.Context(), tt.claims))
+			w := httptest.NewRecorder()
 
+			h.HandleGetPortfolio(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if tt.expectedMessage != "" {
+				var resp models.APIResponse
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Fatalf("failed to decode response: %v", err)
+				}
+				if resp.Message != tt.expectedMessage {
+					t.Errorf("Expected message %q, got %q", tt.expectedMessage, resp.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleRebalance(t *testing.T) {
 	tests := []struct {
 		name           string
 		method         string
 		body           interface{}
 		mockGet        func(ctx context.Context, userID string) (*models.Portfolio, error)
-		mockPublish    func(ctx context.Context, payload []byte) error
+		mockEnqueue    func(ctx context.Context, key, eventType string, version int, payload interface{}) error
 		expectedStatus int
 	}{
 		{
@@ -145,7 +268,13 @@ func TestHandleRebalance(t *testing.T) {
 					Allocation: map[string]float64{"stocks": 60, "bonds": 40},
 				}, nil
 			},
-			mockPublish: func(ctx context.Context, payload []byte) error {
+			mockEnqueue: func(ctx context.Context, key, eventType string, version int, payload interface{}) error {
+				if key != "user1" {
+					t.Errorf("expected message key user1, got %q", key)
+				}
+				if eventType != kafka.EventRebalanceRequested {
+					t.Errorf("expected event type %s, got %s", kafka.EventRebalanceRequested, eventType)
+				}
 				return nil
 			},
 			expectedStatus: http.StatusCreated,
@@ -160,7 +289,7 @@ func TestHandleRebalance(t *testing.T) {
 			mockGet: func(ctx context.Context, userID string) (*models.Portfolio, error) {
 				return nil, storage.ErrUserNotFound
 			},
-			mockPublish:    nil,
+			mockEnqueue:    nil,
 			expectedStatus: http.StatusNotFound,
 		},
 		{
@@ -176,11 +305,11 @@ func TestHandleRebalance(t *testing.T) {
 					Allocation: map[string]float64{"stocks": 60, "bonds": 40},
 				}, nil
 			},
-			mockPublish:    nil,
+			mockEnqueue:    nil,
 			expectedStatus: http.StatusBadRequest,
 		},
 		{
-			name:   "Kafka Publish Error",
+			name:   "Outbox Error",
 			method: http.MethodPost,
 			body: models.UpdatedPortfolio{
 				UserID:        "user1",
@@ -192,8 +321,8 @@ func TestHandleRebalance(t *testing.T) {
 					Allocation: map[string]float64{"stocks": 60, "bonds": 40},
 				}, nil
 			},
-			mockPublish: func(ctx context.Context, payload []byte) error {
-				return errors.New("kafka error")
+			mockEnqueue: func(ctx context.Context, key, eventType string, version int, payload interface{}) error {
+				return errors.New("outbox error")
 			},
 			expectedStatus: http.StatusInternalServerError,
 		},
@@ -201,8 +330,7 @@ func TestHandleRebalance(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			getPortfolio = tt.mockGet
-			publishMessage = tt.mockPublish
+			h := NewPortfolioHandler(mockPortfolios{get: tt.mockGet}, enqueueFunc(tt.mockEnqueue))
 
 			var reqBody []byte
 			var err error
@@ -218,7 +346,7 @@ func TestHandleRebalance(t *testing.T) {
 			req := httptest.NewRequest(tt.method, "/rebalance", bytes.NewReader(reqBody))
 			w := httptest.NewRecorder()
 
-			HandleRebalance(w, req)
+			h.HandleRebalance(w, req)
 
 			if w.Code != tt.expectedStatus {
 				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
@@ -0,0 +1,156 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+// Dependency states reported by the readiness endpoint.
+const (
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// ready is 1 while the process should receive traffic.
+var ready int32
+
+// SetReady marks the process as ready or not ready to receive traffic.
+// It is flipped to false at the start of a graceful shutdown so the
+// orchestrator stops routing new requests before the server drains.
+func SetReady(r bool) {
+	var v int32
+	if r {
+		v = 1
+	}
+	atomic.StoreInt32(&ready, v)
+}
+
+// IsReady reports whether the process is ready to receive traffic.
+func IsReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// CheckFunc returns an error if a dependency is unavailable.
+type CheckFunc func(ctx context.Context) error
+
+// DependencyStatus is the result of a single dependency check.
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the readiness result returned by /readyz.
+type Report struct {
+	Status       string             `json:"status"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+type namedCheck struct {
+	name  string
+	check CheckFunc
+}
+
+// Checker runs dependency checks for the readiness endpoint.
+type Checker struct {
+	checks  []namedCheck
+	timeout time.Duration
+}
+
+// NewChecker creates a checker giving every dependency check up to timeout to complete.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a dependency check reported under name.
+func (c *Checker) Add(name string, check CheckFunc) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Run executes all checks concurrently. The report is up only if every check passed.
+func (c *Checker) Run(ctx context.Context) Report {
+	results := make([]DependencyStatus, len(c.checks))
+
+	var wg sync.WaitGroup
+	for i, nc := range c.checks {
+		wg.Add(1)
+		go func(i int, nc namedCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := nc.check(checkCtx)
+			results[i] = DependencyStatus{
+				Name:      nc.name,
+				Status:    StatusUp,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				results[i].Status = StatusDown
+				results[i].Error = err.Error()
+			}
+		}(i, nc)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, Dependencies: results}
+	for _, r := range results {
+		if r.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// HandleHealthz reports that the process is alive. It never checks dependencies
+// so a failing dependency does not get the process restarted.
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.APIResponse{
+		Success: true,
+		Message: "OK",
+	})
+}
+
+// HandleReadyz responds with 200 and the per-dependency report while the process
+// is ready and all dependencies are up, and 503 otherwise.
+func (c *Checker) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !IsReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(models.APIResponse{
+			Success: false,
+			Message: "Not ready",
+		})
+		return
+	}
+
+	report := c.Run(r.Context())
+	if report.Status != StatusUp {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(models.APIResponse{
+			Success: false,
+			Data:    report,
+			Message: "Dependency unavailable",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.APIResponse{
+		Success: true,
+		Data:    report,
+		Message: "Ready",
+	})
+}
@@ -0,0 +1,108 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+func TestChecker_HandleReadyz(t *testing.T) {
+	up := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		name           string
+		ready          bool
+		checks         map[string]CheckFunc
+		expectedStatus int
+		expectedDown   []string
+	}{
+		{
+			name:           "All dependencies up",
+			ready:          true,
+			checks:         map[string]CheckFunc{"elasticsearch": up, "kafka": up},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Dependency down",
+			ready:          true,
+			checks:         map[string]CheckFunc{"elasticsearch": up, "kafka": down},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedDown:   []string{"kafka"},
+		},
+		{
+			name:           "Dependency timed out",
+			ready:          true,
+			checks:         map[string]CheckFunc{"elasticsearch": slow},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedDown:   []string{"elasticsearch"},
+		},
+		{
+			name:           "Shutting down",
+			ready:          false,
+			checks:         map[string]CheckFunc{"elasticsearch": up},
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetReady(tt.ready)
+			defer SetReady(false)
+
+			c := NewChecker(20 * time.Millisecond)
+			for name, check := range tt.checks {
+				c.Add(name, check)
+			}
+
+			w := httptest.NewRecorder()
+			c.HandleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+
+			var resp struct {
+				models.APIResponse
+				Data Report `json:"data"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			var down []string
+			for _, d := range resp.Data.Dependencies {
+				if d.Status == StatusDown {
+					down = append(down, d.Name)
+					if d.Error == "" {
+						t.Errorf("expected error for dependency %s", d.Name)
+					}
+				}
+			}
+			if len(down) != len(tt.expectedDown) || (len(down) > 0 && down[0] != tt.expectedDown[0]) {
+				t.Errorf("Expected down dependencies %v, got %v", tt.expectedDown, down)
+			}
+		})
+	}
+}
+
+func TestHandleHealthz(t *testing.T) {
+	SetReady(false)
+
+	w := httptest.NewRecorder()
+	HandleHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,262 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/utils"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Broker implementations selected by BROKER.
+const (
+	BrokerKafka  = "kafka"
+	BrokerMemory = "memory"
+)
+
+// DefaultTopic is the rebalance topic used when KAFKA_TOPIC is not set.
+const DefaultTopic = "rebalance"
+
+// Handler processes a message delivered by a Subscriber. The context carries the
+// correlation ID and trace context of the producer.
+type Handler func(ctx context.Context, msg kafka.Message) error
+
+// Publisher publishes events to a topic. Events with the same key are delivered
+// in the order they were published.
+type Publisher interface {
+	Publish(ctx context.Context, topic, key string, env Envelope) error
+}
+
+// Subscriber passes the messages of a topic to a handler. Subscribe blocks until
+// ctx is canceled, or returns an error if the subscription failed.
+type Subscriber interface {
+	Subscribe(ctx context.Context, topic string, handler Handler) error
+}
+
+// Broker is a Publisher and Subscriber that must be closed after use.
+type Broker interface {
+	Publisher
+	Subscriber
+	Close() error
+}
+
+// NewBroker returns the broker selected by BROKER: "kafka" (the default) for the
+// Kafka cluster configured by the KAFKA_* variables, or "memory" for an
+// in-process broker that needs no Kafka.
+func NewBroker() (Broker, error) {
+	switch kind := BrokerKind(); kind {
+	case BrokerKafka:
+		return NewCluster()
+	case BrokerMemory:
+		return NewMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("unsupported BROKER %q: expected %s or %s", kind, BrokerKafka, BrokerMemory)
+	}
+}
+
+// BrokerKind returns BROKER, or "kafka" if it is not set.
+func BrokerKind() string {
+	if kind := os.Getenv("BROKER"); kind != "" {
+		return kind
+	}
+	return BrokerKafka
+}
+
+// RebalanceTopic returns KAFKA_TOPIC, or DefaultTopic if it is not set.
+func RebalanceTopic() string {
+	if t := os.Getenv("KAFKA_TOPIC"); t != "" {
+		return t
+	}
+	return DefaultTopic
+}
+
+// Cluster is the Broker backed by the Kafka cluster.
+type Cluster struct {
+	cfg *Config
+
+	mu      sync.Mutex
+	writers map[string]*kafka.Writer // by topic, created on first publish
+}
+
+// NewCluster configures the serializers and waits for the cluster configured by
+// the KAFKA_* variables to serve metadata.
+func NewCluster() (*Cluster, error) {
+	cfg, err := connConfig()
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("KAFKA_BROKERS must be set")
+	}
+	if err := ConfigureSerializers(); err != nil {
+		return nil, err
+	}
+	if err := waitForBroker(cfg, 10, 2*time.Second); err != nil {
+		return nil, err
+	}
+	return &Cluster{cfg: cfg, writers: make(map[string]*kafka.Writer)}, nil
+}
+
+// Publish writes env to topic, partitioned by key. The topic is created on first
+// use if it does not exist.
+func (c *Cluster) Publish(ctx context.Context, topic, key string, env Envelope) error {
+	w, err := c.writer(topic)
+	if err != nil {
+		return err
+	}
+	return publish(ctx, w, key, env)
+}
+
+func (c *Cluster) writer(topic string) (*kafka.Writer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if w, ok := c.writers[topic]; ok {
+		return w, nil
+	}
+
+	partitions := utils.EnvInt("KAFKA_PARTITIONS", 1)
+	replication := utils.EnvInt("KAFKA_REPLICATION_FACTOR", 1)
+	if err := ensureTopicExists(c.cfg, topic, partitions, replication); err != nil {
+		return nil, fmt.Errorf("failed to ensure topic %s exists: %w", topic, err)
+	}
+
+	w := c.cfg.newWriter(topic)
+	c.writers[topic] = w
+	return w, nil
+}
+
+// Close flushes pending messages and closes the writers.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for topic, w := range c.writers {
+		errs = append(errs, w.Close())
+		delete(c.writers, topic)
+	}
+	return errors.Join(errs...)
+}
+
+// Subscribe reads messages from topic and passes them to handler.
+// It blocks until ctx is canceled and the messages being handled are finished.
+//
+// The reader joins the consumer group of topic (see subscription), so partitions
+// are balanced across all running consumers. A new group starts at the oldest
+// message.
+//
+// Messages for which handler returns an error are written to the next retry topic
+// (see KAFKA_RETRY_DELAYS) and handled again once the delay of that tier has passed.
+// Permanent errors and messages that failed in every tier are written to the
+// dead-letter topic. The retry topics are consumed concurrently with the main topic.
+//
+// Offsets are committed only after handler returns nil or the message has been
+// written to its retry or dead-letter topic. A message is therefore processed at
+// least once; a consumer that stops before committing gets it redelivered. An error
+// is returned if a failed message cannot be written anywhere, leaving its offset
+// uncommitted.
+func (c *Cluster) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	cfg := c.cfg
+
+	groupID, dlq := subscription(topic)
+
+	tiers, err := retryTiers(topic)
+	if err != nil {
+		return err
+	}
+	failures := newFailureRouter(cfg, dlq, tiers)
+	defer failures.close()
+
+	partitions := utils.EnvInt("KAFKA_PARTITIONS", 1)
+	replication := utils.EnvInt("KAFKA_REPLICATION_FACTOR", 1)
+	for _, t := range failures.topics() {
+		if err := ensureTopicExists(cfg, t, partitions, replication); err != nil {
+			return fmt.Errorf("failed to ensure topic %s exists: %w", t, err)
+		}
+	}
+
+	// Every reader processes up to maxInFlight messages on its own workers
+	workers := utils.EnvInt("KAFKA_WORKERS", DefaultWorkers)
+	maxInFlight := utils.EnvInt("KAFKA_MAX_IN_FLIGHT", DefaultMaxInFlight)
+
+	lag := newLagTracker()
+	consumerMu.Lock()
+	consumer = lag
+	consumerMu.Unlock()
+	defer func() {
+		consumerMu.Lock()
+		consumer = nil
+		consumerMu.Unlock()
+	}()
+
+	// Stop all readers as soon as one of them fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(tiers)+1)
+	run := func(topic, groupID string, lag *lagTracker, delayed bool) {
+		r := cfg.newReader(kafka.ReaderConfig{
+			Topic:       topic,
+			GroupID:     groupID,
+			StartOffset: kafka.FirstOffset,
+			MinBytes:    10e3, // 10KB
+			MaxBytes:    10e6, // 10MB
+		})
+		defer r.Close()
+
+		slog.Info("Kafka consumer started", logging.KeyTopic, topic, "group_id", groupID)
+		err := consumeTopic(ctx, r, lag, delayed, workers, maxInFlight, handler, failures)
+		if err != nil {
+			cancel()
+		}
+		errs <- err
+	}
+
+	go run(topic, groupID, lag, false)
+	for _, t := range tiers {
+		// Every tier has its own group so its partitions are balanced independently
+		go run(t.topic, groupID+strings.TrimPrefix(t.topic, topic), newLagTracker(), true)
+	}
+
+	var firstErr error
+	for i := 0; i < len(tiers)+1; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// subscription returns the consumer group reading topic and the dead-letter
+// topic of the messages it fails to process. The output topic is read by the
+// projector, whose group (PROJECTOR_GROUP_ID, default DefaultProjectorGroupID)
+// and dead-letter topic (PROJECTOR_DLQ_TOPIC, default "<topic>.dlq") are its
+// own, so its retry groups and dead letters are never mixed with the
+// consumer's. Other topics use KAFKA_GROUP_ID and KAFKA_DLQ_TOPIC.
+func subscription(topic string) (groupID, dlq string) {
+	if topic == outputTopic(RebalanceTopic()) {
+		groupID, dlq = os.Getenv("PROJECTOR_GROUP_ID"), os.Getenv("PROJECTOR_DLQ_TOPIC")
+		if groupID == "" {
+			groupID = DefaultProjectorGroupID
+		}
+		if dlq == "" {
+			dlq = topic + ".dlq"
+		}
+		return groupID, dlq
+	}
+
+	groupID = os.Getenv("KAFKA_GROUP_ID")
+	if groupID == "" {
+		groupID = DefaultGroupID
+	}
+	return groupID, deadLetterTopic(topic)
+}
@@ -0,0 +1,228 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// SASL mechanisms accepted in KAFKA_SASL_MECHANISM.
+const (
+	SASLPlain       = "PLAIN"
+	SASLScramSHA256 = "SCRAM-SHA-256"
+	SASLScramSHA512 = "SCRAM-SHA-512"
+)
+
+// Config is the connection configuration shared by the writers, readers and
+// admin connections.
+type Config struct {
+	Brokers []string       // bootstrap brokers, host:port
+	TLS     *tls.Config    // nil for plaintext
+	SASL    sasl.Mechanism // nil without authentication
+}
+
+// LoadConfig reads the connection configuration from the environment:
+//
+//	KAFKA_BROKERS                  comma-separated bootstrap brokers (KAFKA_BROKER is accepted for a single broker)
+//	KAFKA_TLS_ENABLED              "true" to connect with TLS
+//	KAFKA_TLS_CA_FILE              PEM CA bundle to verify the brokers, instead of the system roots
+//	KAFKA_TLS_CERT_FILE            PEM client certificate, with KAFKA_TLS_KEY_FILE, for mutual TLS
+//	KAFKA_TLS_INSECURE_SKIP_VERIFY "true" to skip broker certificate verification (testing only)
+//	KAFKA_SASL_MECHANISM           PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512
+//	KAFKA_SASL_USERNAME            SASL user name
+//	KAFKA_SASL_PASSWORD            SASL password
+//
+// It returns an error describing the first invalid setting. A config without
+// brokers is valid; callers treat it as Kafka being disabled.
+func LoadConfig() (*Config, error) {
+	cfg := &Config{}
+
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		brokers = os.Getenv("KAFKA_BROKER")
+	}
+	for _, b := range strings.Split(brokers, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(b); err != nil || port == "" {
+			return nil, fmt.Errorf("invalid Kafka broker address %q: expected host:port", b)
+		}
+		cfg.Brokers = append(cfg.Brokers, b)
+	}
+
+	var err error
+	if cfg.TLS, err = loadTLSConfig(); err != nil {
+		return nil, err
+	}
+	if cfg.SASL, err = loadSASLMechanism(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadTLSConfig() (*tls.Config, error) {
+	enabled, err := envBool("KAFKA_TLS_ENABLED")
+	if err != nil {
+		return nil, err
+	}
+	insecure, err := envBool("KAFKA_TLS_INSECURE_SKIP_VERIFY")
+	if err != nil {
+		return nil, err
+	}
+	caFile := os.Getenv("KAFKA_TLS_CA_FILE")
+	certFile := os.Getenv("KAFKA_TLS_CERT_FILE")
+	keyFile := os.Getenv("KAFKA_TLS_KEY_FILE")
+
+	if !enabled {
+		if caFile != "" || certFile != "" || keyFile != "" || insecure {
+			return nil, errors.New("KAFKA_TLS_* settings require KAFKA_TLS_ENABLED=true")
+		}
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KAFKA_TLS_CA_FILE: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("KAFKA_TLS_CA_FILE %s contains no PEM certificates", caFile)
+		}
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Kafka client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadSASLMechanism() (sasl.Mechanism, error) {
+	mechanism := strings.ToUpper(strings.TrimSpace(os.Getenv("KAFKA_SASL_MECHANISM")))
+	username := os.Getenv("KAFKA_SASL_USERNAME")
+	password := os.Getenv("KAFKA_SASL_PASSWORD")
+
+	if mechanism == "" {
+		if username != "" || password != "" {
+			return nil, errors.New("KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD require KAFKA_SASL_MECHANISM")
+		}
+		return nil, nil
+	}
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("KAFKA_SASL_MECHANISM %s requires KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD", mechanism)
+	}
+
+	switch mechanism {
+	case SASLPlain:
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case SASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, username, password)
+	case SASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("unsupported KAFKA_SASL_MECHANISM %q: expected %s, %s or %s", mechanism, SASLPlain, SASLScramSHA256, SASLScramSHA512)
+	}
+}
+
+func envBool(key string) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: expected true or false", key, v)
+	}
+	return b, nil
+}
+
+var (
+	configOnce sync.Once
+	config     *Config
+	configErr  error
+)
+
+// connConfig returns the configuration loaded from the environment on first use.
+func connConfig() (*Config, error) {
+	configOnce.Do(func() {
+		config, configErr = LoadConfig()
+	})
+	return config, configErr
+}
+
+// dialer returns a dialer for admin connections and readers.
+func (c *Config) dialer() *kafka.Dialer {
+	return &kafka.Dialer{
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		TLS:           c.TLS,
+		SASLMechanism: c.SASL,
+	}
+}
+
+// newWriter returns a writer for topic that partitions messages by key. Writes
+// return once every in-sync replica stored the message, as callers commit
+// offsets or mark outbox entries sent right after them.
+func (c *Config) newWriter(topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(c.Brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{}, // messages with the same key always go to the same partition
+		RequiredAcks: kafka.RequireAll,
+		Transport: &kafka.Transport{
+			TLS:  c.TLS,
+			SASL: c.SASL,
+		},
+	}
+}
+
+// newReader returns a reader for rc connected to the configured brokers.
+func (c *Config) newReader(rc kafka.ReaderConfig) *kafka.Reader {
+	rc.Brokers = c.Brokers
+	rc.Dialer = c.dialer()
+	return kafka.NewReader(rc)
+}
+
+// dial connects to the first reachable bootstrap broker.
+func (c *Config) dial(ctx context.Context) (*kafka.Conn, error) {
+	if len(c.Brokers) == 0 {
+		return nil, errors.New("no Kafka brokers configured")
+	}
+
+	d := c.dialer()
+	var err error
+	for _, b := range c.Brokers {
+		var conn *kafka.Conn
+		if conn, err = d.DialContext(ctx, "tcp", b); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to connect to Kafka broker: %w", err)
+}
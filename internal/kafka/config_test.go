@@ -0,0 +1,135 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestCA(t, caFile)
+	badFile := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(badFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantBrokers []string
+		wantTLS     bool
+		wantSASL    string
+		wantErr     bool
+	}{
+		{"Unset", nil, nil, false, "", false},
+		{"Single broker", map[string]string{"KAFKA_BROKER": "kafka:9092"}, []string{"kafka:9092"}, false, "", false},
+		{"Broker list", map[string]string{"KAFKA_BROKERS": "k1:9093, k2:9093,k3:9093", "KAFKA_BROKER": "ignored:9092"}, []string{"k1:9093", "k2:9093", "k3:9093"}, false, "", false},
+		{"Broker without port", map[string]string{"KAFKA_BROKERS": "k1:9093,k2"}, nil, false, "", true},
+		{"TLS with CA", map[string]string{"KAFKA_BROKERS": "k1:9093", "KAFKA_TLS_ENABLED": "true", "KAFKA_TLS_CA_FILE": caFile}, []string{"k1:9093"}, true, "", false},
+		{"TLS with invalid CA", map[string]string{"KAFKA_TLS_ENABLED": "true", "KAFKA_TLS_CA_FILE": badFile}, nil, false, "", true},
+		{"TLS with missing CA", map[string]string{"KAFKA_TLS_ENABLED": "true", "KAFKA_TLS_CA_FILE": filepath.Join(dir, "missing.pem")}, nil, false, "", true},
+		{"CA without TLS", map[string]string{"KAFKA_TLS_CA_FILE": caFile}, nil, false, "", true},
+		{"Cert without key", map[string]string{"KAFKA_TLS_ENABLED": "true", "KAFKA_TLS_CERT_FILE": caFile}, nil, false, "", true},
+		{"Invalid TLS flag", map[string]string{"KAFKA_TLS_ENABLED": "yes please"}, nil, false, "", true},
+		{"SASL PLAIN", map[string]string{"KAFKA_SASL_MECHANISM": "plain", "KAFKA_SASL_USERNAME": "u", "KAFKA_SASL_PASSWORD": "p"}, nil, false, SASLPlain, false},
+		{"SASL SCRAM-SHA-256", map[string]string{"KAFKA_SASL_MECHANISM": "SCRAM-SHA-256", "KAFKA_SASL_USERNAME": "u", "KAFKA_SASL_PASSWORD": "p"}, nil, false, SASLScramSHA256, false},
+		{"SASL SCRAM-SHA-512", map[string]string{"KAFKA_SASL_MECHANISM": "SCRAM-SHA-512", "KAFKA_SASL_USERNAME": "u", "KAFKA_SASL_PASSWORD": "p"}, nil, false, SASLScramSHA512, false},
+		{"SASL without password", map[string]string{"KAFKA_SASL_MECHANISM": "PLAIN", "KAFKA_SASL_USERNAME": "u"}, nil, false, "", true},
+		{"SASL unknown mechanism", map[string]string{"KAFKA_SASL_MECHANISM": "GSSAPI", "KAFKA_SASL_USERNAME": "u", "KAFKA_SASL_PASSWORD": "p"}, nil, false, "", true},
+		{"Credentials without mechanism", map[string]string{"KAFKA_SASL_USERNAME": "u", "KAFKA_SASL_PASSWORD": "p"}, nil, false, "", true},
+	}
+
+	keys := []string{
+		"KAFKA_BROKERS", "KAFKA_BROKER",
+		"KAFKA_TLS_ENABLED", "KAFKA_TLS_CA_FILE", "KAFKA_TLS_CERT_FILE", "KAFKA_TLS_KEY_FILE", "KAFKA_TLS_INSECURE_SKIP_VERIFY",
+		"KAFKA_SASL_MECHANISM", "KAFKA_SASL_USERNAME", "KAFKA_SASL_PASSWORD",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range keys {
+				t.Setenv(k, tt.env[k])
+			}
+
+			cfg, err := LoadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(cfg.Brokers, tt.wantBrokers) {
+				t.Errorf("expected brokers %v, got %v", tt.wantBrokers, cfg.Brokers)
+			}
+			if (cfg.TLS != nil) != tt.wantTLS {
+				t.Errorf("expected TLS %v, got %v", tt.wantTLS, cfg.TLS != nil)
+			}
+			if tt.wantTLS && cfg.TLS.RootCAs == nil {
+				t.Error("expected the CA file to be used as root CAs")
+			}
+			gotSASL := ""
+			if cfg.SASL != nil {
+				gotSASL = cfg.SASL.Name()
+			}
+			if gotSASL != tt.wantSASL {
+				t.Errorf("expected SASL mechanism %q, got %q", tt.wantSASL, gotSASL)
+			}
+		})
+	}
+}
+
+func TestConfig_NewWriter(t *testing.T) {
+	c := &Config{Brokers: []string{"kafka-1:9092", "kafka-2:9092"}}
+	w := c.newWriter("rebalance.dlq")
+
+	if w.Topic != "rebalance.dlq" {
+		t.Errorf("expected topic rebalance.dlq, got %s", w.Topic)
+	}
+	// The offset of a dead-lettered or retried message is committed right after
+	// the write, so the write must be acknowledged by every in-sync replica
+	if w.RequiredAcks != kafka.RequireAll {
+		t.Errorf("expected RequiredAcks = RequireAll, got %v", w.RequiredAcks)
+	}
+	if _, ok := w.Balancer.(*kafka.Hash); !ok {
+		t.Errorf("expected messages to be partitioned by key, got %T", w.Balancer)
+	}
+	if w.Addr.String() != "kafka-1:9092,kafka-2:9092" {
+		t.Errorf("expected all brokers, got %s", w.Addr)
+	}
+}
+
+func writeTestCA(t *testing.T, path string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
 	"portfolio-rebalancer/internal/models"
 	"portfolio-rebalancer/internal/services"
 	"portfolio-rebalancer/internal/storage"
@@ -14,86 +18,265 @@ import (
 	"github.com/segmentio/kafka-go"
 )
 
-func StartRebalanceConsumer(ctx context.Context) {
-	err := ConsumeMessage(ctx, func(msg kafka.Message) {
-		log.Printf("Received message: %s\n", string(msg.Value))
+// outputTopic returns KAFKA_OUTPUT_TOPIC, or "<topic>.completed" if it is not set.
+func outputTopic(topic string) string {
+	if t := os.Getenv("KAFKA_OUTPUT_TOPIC"); t != "" {
+		return t
+	}
+	return topic + ".completed"
+}
+
+// RebalanceConsumer handles rebalance requests and publishes their results.
+type RebalanceConsumer struct {
+	pub          Publisher
+	output       string // topic of the RebalanceCompleted events
+	requests     storage.RebalanceRequestRepository
+	transactions storage.TransactionRepository
+	historySize  int // allocation hashes kept per user for the idempotency check
+}
+
+// NewRebalanceConsumer returns a consumer that checks requests against the
+// recent requests of the user in requests, saves their results to transactions
+// and publishes them with pub. REBALANCE_HASH_HISTORY sets how many allocation
+// hashes are kept per user (default 10).
+func NewRebalanceConsumer(pub Publisher, requests storage.RebalanceRequestRepository, transactions storage.TransactionRepository) *RebalanceConsumer {
+	return &RebalanceConsumer{
+		pub:          pub,
+		output:       outputTopic(RebalanceTopic()),
+		requests:     requests,
+		transactions: transactions,
+		historySize:  max(utils.EnvInt("REBALANCE_HASH_HISTORY", 10), 1),
+	}
+}
+
+// Run processes the rebalance requests delivered by sub until ctx is canceled.
+// It returns an error if the consumer stopped because a message could not be
+// processed or dead-lettered.
+func (c *RebalanceConsumer) Run(ctx context.Context, sub Subscriber) error {
+	return sub.Subscribe(ctx, RebalanceTopic(), c.handleRebalance)
+}
+
+// publishCompleted publishes the transactions saved for the request in env to
+// the output topic, keyed by user ID so events for a user stay in order.
+func (c *RebalanceConsumer) publishCompleted(ctx context.Context, request Envelope, userID string, transactions []models.RebalanceTransaction) error {
+	env, err := NewEnvelope(EventRebalanceCompleted, RebalanceCompletedVersion, models.RebalanceCompleted{
+		UserID:       userID,
+		RequestID:    request.MessageID,
+		Transactions: transactions,
+	})
+	if err != nil {
+		return err
+	}
+	return c.pub.Publish(ctx, c.output, userID, env)
+}
+
+// handleRebalance calculates and saves the transactions for a rebalance request.
+// Invalid messages return a permanent error and are dead-lettered right away;
+// other errors are retried through the retry topics.
+func (c *RebalanceConsumer) handleRebalance(ctx context.Context, msg kafka.Message) error {
+	slog.InfoContext(ctx, "Received message", logging.Payload(msg.Value))
 
-		if !isValidJSON(msg.Value) {
-			log.Printf("Invalid JSON message, skipping: %s\n", string(msg.Value))
-			return
+	start := time.Now()
+	result := metrics.ConsumeFailed
+	defer func() {
+		metrics.KafkaMessagesConsumed.WithLabelValues(msg.Topic, result).Inc()
+		metrics.RebalanceProcessingDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	env, portfolio, err := decodeRebalanceRequest(ctx, msg)
+	if err != nil {
+		if IsPermanent(err) {
+			result = metrics.ConsumeInvalid
 		}
+		return err
+	}
+
+	result, err = c.process(ctx, env, portfolio, processOptions{})
+	return err
+}
+
+// decodeRebalanceRequest decodes the rebalance request in msg and upcasts it to
+// the current version. Errors for messages that can never be processed are permanent.
+func decodeRebalanceRequest(ctx context.Context, msg kafka.Message) (Envelope, models.RebalancePortfolioKafka, error) {
+	var portfolio models.RebalancePortfolioKafka
 
-		var portfolio models.RebalancePortfolioKafka
-		if err := json.Unmarshal(msg.Value, &portfolio); err != nil {
-			log.Printf("Failed to unmarshal message: %v\n", err)
-			return
+	env, err := DecodeMessage(ctx, msg)
+	if err != nil {
+		if errors.Is(err, ErrSerializerUnavailable) {
+			return env, portfolio, err
 		}
+		return env, portfolio, Permanent(err)
+	}
+	if env.EventType == "" {
+		// Published before the envelope was introduced
+		env.EventType = EventRebalanceRequested
+	}
+	if env.EventType != EventRebalanceRequested {
+		return env, portfolio, Permanent(fmt.Errorf("unexpected event type %q", env.EventType))
+	}
+	if env, err = Upcast(env, RebalanceRequestedVersion); err != nil {
+		// A newer version may become readable once this consumer is upgraded, so
+		// it goes through the retry topics instead of straight to the dead-letter topic
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			err = Permanent(err)
+		}
+		return env, portfolio, err
+	}
 
-		allocHash := utils.CanonicalHash(portfolio.NewAllocation)
+	if err := json.Unmarshal(env.Payload, &portfolio); err != nil {
+		return env, portfolio, Permanent(fmt.Errorf("failed to unmarshal message: %w", err))
+	}
+	return env, portfolio, nil
+}
 
-		//get existing request or create new one
-		p, err := storage.GetRebalanceRequest(ctx, portfolio.UserID)
+// processOptions change how a request is processed when it is replayed.
+type processOptions struct {
+	force   bool // skip the allocation hash check
+	replace bool // replace the transactions saved for the request before
+	silent  bool // do not publish a RebalanceCompleted event
+}
+
+// process calculates, saves and publishes the transactions for a decoded
+// rebalance request. It returns the consume result for the metrics.
+func (c *RebalanceConsumer) process(ctx context.Context, env Envelope, portfolio models.RebalancePortfolioKafka, opts processOptions) (string, error) {
+	ctx = logging.With(ctx, logging.KeyUserID, portfolio.UserID, logging.KeyMessageID, env.MessageID)
+	allocHash := utils.CanonicalHash(portfolio.NewAllocation)
+
+	var transactions []models.RebalanceTransaction
+	for attempt := 1; ; attempt++ {
+		recorded := false
+		// due to open ended implementation of RebalanceTransaction,
+		// RebalanceRequest only check idempotency based on allocation hash
+		p, err := c.requests.GetRebalanceRequest(ctx, portfolio.UserID)
+		if errors.Is(err, storage.ErrRequestNotFound) {
+			p, err = nil, nil
+		}
 		if err != nil {
-			// Insert new request if not found
-			if errors.Is(err, storage.ErrRequestNotFound) {
-				rr := &models.RebalanceRequest{
-					UserID:         portfolio.UserID,
-					AllocationHash: allocHash,
-				}
-				if err = storage.SaveRebalanceRequest(ctx, rr); err != nil {
-					log.Printf("Failed to save rebalance request: %v", err)
-					return
-				}
-
-				p = rr
-			} else {
-				log.Printf("Failed to get current rebalance request: %v", err)
-				return
+			return metrics.ConsumeFailed, fmt.Errorf("failed to get current rebalance request: %w", err)
+		}
+		if p != nil && !opts.force && p.HasProcessed(allocHash) {
+			if env.MessageID == "" || p.RequestID != env.MessageID {
+				slog.InfoContext(ctx, "No allocation changes detected")
+				metrics.RebalanceDuplicatesSkipped.Inc()
+				return metrics.ConsumeDuplicate, nil
 			}
-		} else {
-			// due to open ended implementation of RebalanceTransaction,
-			// RebalanceRequest only check idempotency based on allocation hash
-			if p.AllocationHash == allocHash {
-				log.Printf("No allocation changes detected for user: %s\n", portfolio.UserID)
-				return
+			// The last request recorded is this message, delivered again. Saving
+			// its transactions or publishing its event may have failed after it
+			// was recorded.
+			recorded = true
+		}
+
+		if attempt == 1 {
+			slog.InfoContext(ctx, "Processing rebalance")
+			transactions = services.CalculateRebalance(
+				portfolio.UserID,
+				portfolio.NewAllocation,
+				portfolio.CurrentAllocation,
+			)
+		}
+
+		if recorded {
+			slog.InfoContext(ctx, "Rebalance request already recorded, saving its transactions again")
+			err = c.saveWithRetries(ctx, len(transactions), func() error {
+				return c.transactions.SaveRebalanceTransactions(ctx, env.MessageID, transactions)
+			})
+			if err != nil {
+				return metrics.ConsumeFailed, err
 			}
+			break
 		}
 
-		log.Printf("Processing rebalance for user: %s\n", portfolio.UserID)
-
-		transactions := services.CalculateRebalance(
-			portfolio.UserID,
-			portfolio.NewAllocation,
-			portfolio.CurrentAllocation,
-		)
-		if len(transactions) > 0 {
-			log.Printf("Saving %d transactions for user: %s\n", len(transactions), portfolio.UserID)
-			// Retry mechanism with exponential backoff
-			maxRetries := 5
-			backoff := 1 * time.Second
-			for i := 0; i < maxRetries; i++ {
-				if err := storage.SaveRebalanceTransactions(ctx, transactions); err != nil {
-					log.Printf("Failed to save rebalance transactions (attempt %d/%d): %v\n", i+1, maxRetries, err)
-					if i == maxRetries-1 {
-						log.Printf("CRITICAL: Failed to save transactions for user %s after %d attempts. Data may be lost.\n", portfolio.UserID, maxRetries)
-					} else {
-						time.Sleep(backoff)
-						backoff *= 2
-					}
-				} else {
-					break
-				}
+		// The request is recorded together with its transactions. If it is
+		// recorded but its transactions are not, it is completed above when
+		// it is delivered again. The record is only saved if it was not
+		// changed since it was read.
+		rr := c.nextRequest(p, portfolio.UserID, allocHash, env.MessageID)
+		save := c.requests.SaveRebalanceRequest
+		if opts.replace {
+			save = c.requests.ReplaceRebalanceRequest
+		}
+		err = c.saveWithRetries(ctx, len(transactions), func() error {
+			return save(ctx, rr, transactions)
+		})
+		if errors.Is(err, storage.ErrRequestConflict) && attempt < maxConflictAttempts {
+			slog.WarnContext(ctx, "Rebalance request changed concurrently, checking again", "attempt", attempt)
+			metrics.RebalanceRequestConflicts.Inc()
+			continue
+		}
+		if err != nil {
+			return metrics.ConsumeFailed, err
+		}
+		break
+	}
+
+	if len(transactions) == 0 {
+		slog.InfoContext(ctx, "No transactions to publish")
+		return metrics.ConsumeProcessed, nil
+	}
+	if opts.silent {
+		return metrics.ConsumeProcessed, nil
+	}
+
+	// The message goes through the retry topics if the event cannot be
+	// published, and the event is published when it is delivered again. Events
+	// may be published more than once for a request.
+	if err := c.publishCompleted(ctx, env, portfolio.UserID, transactions); err != nil {
+		return metrics.ConsumeFailed, fmt.Errorf("failed to publish %s event: %w", EventRebalanceCompleted, err)
+	}
+	return metrics.ConsumeProcessed, nil
+}
+
+// maxConflictAttempts is how many times a request is checked and saved again
+// when its record was changed concurrently, before it goes through the retry
+// topics.
+const maxConflictAttempts = 3
+
+// nextRequest returns the record of the request with allocHash, replacing prev
+// (nil if none is stored). The hash is moved to the end of the history, which
+// keeps the last historySize hashes.
+func (c *RebalanceConsumer) nextRequest(prev *models.RebalanceRequest, userID, allocHash, requestID string) *models.RebalanceRequest {
+	rr := &models.RebalanceRequest{UserID: userID, AllocationHash: allocHash, RequestID: requestID}
+	if prev != nil {
+		rr.Revision = prev.Revision
+		history := prev.History
+		// Records saved before the history was kept only have the last hash
+		if len(history) == 0 && prev.AllocationHash != "" {
+			history = []string{prev.AllocationHash}
+		}
+		for _, h := range history {
+			if h != allocHash {
+				rr.History = append(rr.History, h)
 			}
-		} else {
-			log.Printf("No transactions to save for user: %s\n", portfolio.UserID)
 		}
-	})
-	if err != nil {
-		log.Printf("Failed to start consumer: %v\n", err)
 	}
+	rr.History = append(rr.History, allocHash)
+	if n := len(rr.History); n > c.historySize {
+		rr.History = rr.History[n-c.historySize:]
+	}
+	return rr
 }
 
-func isValidJSON(data []byte) bool {
-	var js json.RawMessage
-	return json.Unmarshal(data, &js) == nil
+// saveWithRetries calls save, which saves count transactions, with retries. A
+// conflict is returned at once, as retrying cannot resolve it.
+func (c *RebalanceConsumer) saveWithRetries(ctx context.Context, count int, save func() error) error {
+	slog.InfoContext(ctx, "Saving transactions", "count", count)
+	// Retry mechanism with exponential backoff
+	maxRetries := 5
+	backoff := 1 * time.Second
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if i > 0 {
+			metrics.TransactionSaveRetries.Inc()
+		}
+		err = save()
+		if err == nil || errors.Is(err, storage.ErrRequestConflict) {
+			return err
+		}
+		slog.WarnContext(ctx, "Failed to save rebalance transactions", "attempt", i+1, "max_attempts", maxRetries, logging.Err(err))
+		if i < maxRetries-1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return fmt.Errorf("failed to save transactions after %d attempts: %w", maxRetries, err)
 }
@@ -0,0 +1,403 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/storage"
+)
+
+// memoryStore implements the request and transaction repositories in memory.
+type memoryStore struct {
+	mu           sync.Mutex
+	requests     map[string]models.RebalanceRequest       // with the revision as the number of saves
+	transactions map[string][]models.RebalanceTransaction // by request ID
+	saved        chan string                              // request IDs, as their transactions are saved
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		requests:     make(map[string]models.RebalanceRequest),
+		transactions: make(map[string][]models.RebalanceTransaction),
+		saved:        make(chan string, 10),
+	}
+}
+
+func (s *memoryStore) SaveRebalanceRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction) error {
+	return s.saveRequest(ctx, r, txs, false)
+}
+
+func (s *memoryStore) ReplaceRebalanceRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction) error {
+	return s.saveRequest(ctx, r, txs, true)
+}
+
+func (s *memoryStore) saveRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction, replace bool) error {
+	s.mu.Lock()
+	stored := s.requests[r.UserID]
+	if r.Revision != stored.Revision {
+		s.mu.Unlock()
+		return storage.ErrRequestConflict
+	}
+	saved := *r
+	n, _ := strconv.Atoi(stored.Revision) // 0 if not stored
+	saved.Revision = strconv.Itoa(n + 1)
+	s.requests[r.UserID] = saved
+	if replace {
+		delete(s.transactions, r.RequestID)
+	}
+	s.mu.Unlock()
+	return s.SaveRebalanceTransactions(ctx, r.RequestID, txs)
+}
+
+func (s *memoryStore) GetRebalanceRequest(ctx context.Context, userID string) (*models.RebalanceRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[userID]
+	if !ok {
+		return nil, storage.ErrRequestNotFound
+	}
+	return &r, nil
+}
+
+// SaveRebalanceTransactions overwrites the transactions saved for requestID,
+// like the stores that key them by request and asset.
+func (s *memoryStore) SaveRebalanceTransactions(ctx context.Context, requestID string, txs []models.RebalanceTransaction) error {
+	s.mu.Lock()
+	if requestID == "" {
+		s.transactions[requestID] = append(s.transactions[requestID], txs...)
+	} else {
+		s.transactions[requestID] = txs
+	}
+	s.mu.Unlock()
+	s.saved <- requestID
+	return nil
+}
+
+func (s *memoryStore) GetRebalanceTransactions(ctx context.Context, requestID string) ([]models.RebalanceTransaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.transactions[requestID], nil
+}
+
+func (s *memoryStore) DeleteRebalanceTransactions(ctx context.Context, requestID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.transactions, requestID)
+	return nil
+}
+
+func waitSaved(t *testing.T, s *memoryStore) string {
+	t.Helper()
+	select {
+	case id := <-s.saved:
+		return id
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for transactions to be saved")
+		return ""
+	}
+}
+
+func TestRebalanceConsumer_ProjectsCompletedEvents(t *testing.T) {
+	broker := NewMemoryBroker()
+	store, projection := newMemoryStore(), newMemoryStore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewRebalanceConsumer(broker, store, store).Run(ctx, broker)
+	go NewTransactionProjector(projection).Run(ctx, broker)
+
+	env, err := NewEnvelope(EventRebalanceRequested, RebalanceRequestedVersion, goldenRebalance)
+	if err != nil {
+		t.Fatalf("NewEnvelope() error = %v", err)
+	}
+	publish := func() {
+		if err := broker.Publish(context.Background(), RebalanceTopic(), goldenRebalance.UserID, env); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+	publish()
+
+	if id := waitSaved(t, store); id != env.MessageID {
+		t.Errorf("expected transactions of request %s, got %s", env.MessageID, id)
+	}
+	r, err := store.GetRebalanceRequest(ctx, goldenRebalance.UserID)
+	if err != nil {
+		t.Fatalf("GetRebalanceRequest() error = %v", err)
+	}
+	if r.RequestID != env.MessageID {
+		t.Errorf("expected request %s recorded, got %s", env.MessageID, r.RequestID)
+	}
+
+	if id := waitSaved(t, projection); id != env.MessageID {
+		t.Errorf("expected projected request %s, got %s", env.MessageID, id)
+	}
+	saved, _ := store.GetRebalanceTransactions(ctx, env.MessageID)
+	projected, _ := projection.GetRebalanceTransactions(ctx, env.MessageID)
+	if len(saved) != 2 || len(projected) != len(saved) {
+		t.Errorf("expected 2 transactions saved and projected, got %d and %d", len(saved), len(projected))
+	}
+
+	// A request with the same allocation is skipped by its allocation hash
+	env.MessageID = "msg-2"
+	publish()
+	select {
+	case id := <-store.saved:
+		t.Errorf("expected duplicate to be skipped, got transactions saved for %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRebalanceConsumer_NextRequest(t *testing.T) {
+	c := &RebalanceConsumer{historySize: 3}
+
+	tests := []struct {
+		name     string
+		prev     *models.RebalanceRequest
+		expected []string
+	}{
+		{
+			name:     "first request",
+			prev:     nil,
+			expected: []string{"new"},
+		},
+		{
+			name:     "record without history",
+			prev:     &models.RebalanceRequest{AllocationHash: "a", Revision: "1"},
+			expected: []string{"a", "new"},
+		},
+		{
+			name:     "bounded",
+			prev:     &models.RebalanceRequest{AllocationHash: "c", History: []string{"a", "b", "c"}, Revision: "3"},
+			expected: []string{"b", "c", "new"},
+		},
+		{
+			name:     "processed again",
+			prev:     &models.RebalanceRequest{AllocationHash: "b", History: []string{"new", "b"}, Revision: "2"},
+			expected: []string{"b", "new"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := c.nextRequest(tt.prev, "user1", "new", "msg-1")
+			if rr.AllocationHash != "new" || rr.RequestID != "msg-1" {
+				t.Errorf("expected hash new of msg-1, got %+v", rr)
+			}
+			if !reflect.DeepEqual(rr.History, tt.expected) {
+				t.Errorf("expected history %v, got %v", tt.expected, rr.History)
+			}
+			if tt.prev != nil && rr.Revision != tt.prev.Revision {
+				t.Errorf("expected revision %s of the previous record, got %s", tt.prev.Revision, rr.Revision)
+			}
+		})
+	}
+}
+
+func TestRebalanceConsumer_SkipsRecentAllocations(t *testing.T) {
+	store := newMemoryStore()
+	c := NewRebalanceConsumer(NewMemoryBroker(), store, store)
+	ctx := context.Background()
+
+	previous := models.RebalancePortfolioKafka{
+		UserID:            goldenRebalance.UserID,
+		NewAllocation:     goldenRebalance.CurrentAllocation,
+		CurrentAllocation: goldenRebalance.NewAllocation,
+	}
+
+	// A new allocation followed by the previous one, delivered again late
+	steps := []struct {
+		portfolio models.RebalancePortfolioKafka
+		expected  string
+	}{
+		{previous, metrics.ConsumeProcessed},
+		{goldenRebalance, metrics.ConsumeProcessed},
+		{previous, metrics.ConsumeDuplicate},
+		{goldenRebalance, metrics.ConsumeDuplicate},
+	}
+	for i, step := range steps {
+		env := Envelope{MessageID: strconv.Itoa(i)}
+		result, err := c.process(ctx, env, step.portfolio, processOptions{})
+		if err != nil {
+			t.Fatalf("step %d: process() error = %v", i, err)
+		}
+		if result != step.expected {
+			t.Errorf("step %d: expected %s, got %s", i, step.expected, result)
+		}
+	}
+}
+
+// conflictingStore changes the record of the user once, between the
+// consumer reading and saving it.
+type conflictingStore struct {
+	*memoryStore
+	once sync.Once
+}
+
+func (s *conflictingStore) SaveRebalanceRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction) error {
+	s.once.Do(func() {
+		other := &models.RebalanceRequest{UserID: r.UserID, AllocationHash: "other", Revision: r.Revision}
+		s.memoryStore.SaveRebalanceRequest(ctx, other, nil)
+	})
+	return s.memoryStore.SaveRebalanceRequest(ctx, r, txs)
+}
+
+func TestRebalanceConsumer_RetriesConflicts(t *testing.T) {
+	store := &conflictingStore{memoryStore: newMemoryStore()}
+	c := NewRebalanceConsumer(NewMemoryBroker(), store, store)
+	ctx := context.Background()
+
+	result, err := c.process(ctx, Envelope{MessageID: "msg-1"}, goldenRebalance, processOptions{})
+	if err != nil {
+		t.Fatalf("process() error = %v", err)
+	}
+	if result != metrics.ConsumeProcessed {
+		t.Errorf("expected %s, got %s", metrics.ConsumeProcessed, result)
+	}
+
+	r, _ := store.GetRebalanceRequest(ctx, goldenRebalance.UserID)
+	if r.RequestID != "msg-1" || !reflect.DeepEqual(r.History, []string{"other", r.AllocationHash}) {
+		t.Errorf("expected msg-1 saved after the concurrent update, got %+v", r)
+	}
+}
+
+// stolenStore records a request of another allocation for the user on every
+// save, so the consumer never saves its own.
+type stolenStore struct {
+	*memoryStore
+}
+
+func (s *stolenStore) ReplaceRebalanceRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction) error {
+	other := &models.RebalanceRequest{UserID: r.UserID, AllocationHash: "other-" + r.Revision, Revision: r.Revision}
+	s.memoryStore.SaveRebalanceRequest(ctx, other, nil)
+	return s.memoryStore.ReplaceRebalanceRequest(ctx, r, txs)
+}
+
+func TestRebalanceConsumer_ReprocessKeepsTransactionsOnConflict(t *testing.T) {
+	store := &stolenStore{memoryStore: newMemoryStore()}
+	c := NewRebalanceConsumer(NewMemoryBroker(), store, store)
+	ctx := context.Background()
+
+	previous := []models.RebalanceTransaction{{UserID: goldenRebalance.UserID, Action: "BUY", Asset: "gold", RebalancePercent: 5}}
+	if err := store.SaveRebalanceTransactions(ctx, "msg-1", previous); err != nil {
+		t.Fatalf("SaveRebalanceTransactions() error = %v", err)
+	}
+	<-store.saved
+
+	r := ReplayedRequest{Envelope: Envelope{MessageID: "msg-1"}, Request: goldenRebalance}
+	if err := c.Reprocess(ctx, r, true); !errors.Is(err, storage.ErrRequestConflict) {
+		t.Fatalf("expected ErrRequestConflict, got %v", err)
+	}
+
+	saved, _ := store.GetRebalanceTransactions(ctx, "msg-1")
+	if !reflect.DeepEqual(saved, previous) {
+		t.Errorf("expected the previous transactions kept, got %v", saved)
+	}
+}
+
+// countingPublisher counts the events published, after failing the first
+// fail ones.
+type countingPublisher struct {
+	mu        sync.Mutex
+	fail      int
+	published int
+}
+
+func (p *countingPublisher) Publish(ctx context.Context, topic, key string, env Envelope) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail > 0 {
+		p.fail--
+		return errors.New("broker unavailable")
+	}
+	p.published++
+	return nil
+}
+
+func TestRebalanceConsumer_ReprocessPublishes(t *testing.T) {
+	for _, publish := range []bool{false, true} {
+		pub, store := &countingPublisher{}, newMemoryStore()
+		c := NewRebalanceConsumer(pub, store, store)
+
+		r := ReplayedRequest{Envelope: Envelope{MessageID: "msg-1"}, Request: goldenRebalance}
+		if err := c.Reprocess(context.Background(), r, publish); err != nil {
+			t.Fatalf("Reprocess(publish = %v) error = %v", publish, err)
+		}
+		if saved, _ := store.GetRebalanceTransactions(context.Background(), "msg-1"); len(saved) != 2 {
+			t.Errorf("expected 2 transactions saved with publish = %v, got %v", publish, saved)
+		}
+		expected := 0
+		if publish {
+			expected = 1
+		}
+		if pub.published != expected {
+			t.Errorf("expected %d events published with publish = %v, got %d", expected, publish, pub.published)
+		}
+	}
+}
+
+// failingStore records the first request it saves but fails to save its
+// transactions, like the Elasticsearch store if the bulk request fails.
+type failingStore struct {
+	*memoryStore
+	failed bool
+}
+
+func (s *failingStore) SaveRebalanceRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction) error {
+	if !s.failed {
+		s.failed = true
+		s.memoryStore.SaveRebalanceRequest(ctx, r, nil)
+		return errors.New("bulk request failed")
+	}
+	return s.memoryStore.SaveRebalanceRequest(ctx, r, txs)
+}
+
+func TestRebalanceConsumer_CompletesRecordedRequests(t *testing.T) {
+	store := &failingStore{memoryStore: newMemoryStore()}
+	c := NewRebalanceConsumer(NewMemoryBroker(), store, store)
+	ctx := context.Background()
+
+	// The retried save conflicts with the record of the failed one, which is
+	// then completed instead of skipped as a duplicate
+	result, err := c.process(ctx, Envelope{MessageID: "msg-1"}, goldenRebalance, processOptions{})
+	if err != nil {
+		t.Fatalf("process() error = %v", err)
+	}
+	if result != metrics.ConsumeProcessed {
+		t.Errorf("expected %s, got %s", metrics.ConsumeProcessed, result)
+	}
+	if saved, _ := store.GetRebalanceTransactions(ctx, "msg-1"); len(saved) != 2 {
+		t.Errorf("expected 2 transactions saved, got %v", saved)
+	}
+}
+
+func TestRebalanceConsumer_PublishesRecordedRequests(t *testing.T) {
+	pub, store := &countingPublisher{fail: 1}, newMemoryStore()
+	c := NewRebalanceConsumer(pub, store, store)
+	ctx := context.Background()
+	env := Envelope{MessageID: "msg-1"}
+
+	if _, err := c.process(ctx, env, goldenRebalance, processOptions{}); err == nil {
+		t.Fatal("expected the failed publish to be returned")
+	}
+	// Delivered again through the retry topics
+	result, err := c.process(ctx, env, goldenRebalance, processOptions{})
+	if err != nil {
+		t.Fatalf("process() error = %v", err)
+	}
+	if result != metrics.ConsumeProcessed || pub.published != 1 {
+		t.Errorf("expected the event published on redelivery, got %s with %d published", result, pub.published)
+	}
+
+	// Another request with the same allocation is still skipped
+	result, _ = c.process(ctx, Envelope{MessageID: "msg-2"}, goldenRebalance, processOptions{})
+	if result != metrics.ConsumeDuplicate || pub.published != 1 {
+		t.Errorf("expected a duplicate, got %s with %d published", result, pub.published)
+	}
+}
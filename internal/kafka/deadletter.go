@@ -0,0 +1,249 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// deadLetterTopic returns KAFKA_DLQ_TOPIC, or "<topic>.dlq" if it is not set.
+func deadLetterTopic(topic string) string {
+	if t := os.Getenv("KAFKA_DLQ_TOPIC"); t != "" {
+		return t
+	}
+	return topic + ".dlq"
+}
+
+// failureRouter sends messages that failed processing to the next retry topic,
+// or to the dead-letter topic once the retries are exhausted.
+type failureRouter struct {
+	tiers   []retryTier
+	dlq     string
+	writers map[string]*kafka.Writer // by topic, for the retry and dead-letter topics
+}
+
+func newFailureRouter(cfg *Config, dlq string, tiers []retryTier) *failureRouter {
+	f := &failureRouter{
+		tiers:   tiers,
+		dlq:     dlq,
+		writers: make(map[string]*kafka.Writer),
+	}
+	for _, topic := range f.topics() {
+		f.writers[topic] = cfg.newWriter(topic)
+	}
+	return f
+}
+
+// topics returns the retry topics followed by the dead-letter topic.
+func (f *failureRouter) topics() []string {
+	topics := make([]string, 0, len(f.tiers)+1)
+	for _, t := range f.tiers {
+		topics = append(topics, t.topic)
+	}
+	return append(topics, f.dlq)
+}
+
+func (f *failureRouter) close() {
+	for _, w := range f.writers {
+		w.Close()
+	}
+}
+
+// destination returns the topic for a message whose attempt-th processing attempt
+// failed with err, and when it may be retried. Permanent errors and messages that
+// went through every retry tier go to the dead-letter topic with a zero retry time.
+func (f *failureRouter) destination(attempt int, err error, now time.Time) (string, time.Time) {
+	if IsPermanent(err) || attempt > len(f.tiers) {
+		return f.dlq, time.Time{}
+	}
+	tier := f.tiers[attempt-1]
+	return tier.topic, now.Add(tier.delay)
+}
+
+// route writes msg to its retry or dead-letter topic, retrying with exponential
+// backoff until it succeeds or ctx is canceled. The source offset must only be
+// committed once this returns nil.
+func (f *failureRouter) route(ctx, msgCtx context.Context, msg kafka.Message, reason error) error {
+	attempt := attempts(msg) + 1
+	now := time.Now()
+	topic, retryAt := f.destination(attempt, reason, now)
+	out := failureMessage(msg, reason, attempt, now, retryAt)
+	w := f.writers[topic]
+
+	backoff := 1 * time.Second
+	for i := 1; ; i++ {
+		err := writeMessage(msgCtx, w, out)
+		if err == nil {
+			if topic == f.dlq {
+				slog.WarnContext(msgCtx, "Message sent to dead-letter topic", "destination", topic, "attempt", attempt)
+			} else {
+				slog.InfoContext(msgCtx, "Message scheduled for retry", "destination", topic, "attempt", attempt, "retry_at", retryAt)
+			}
+			return nil
+		}
+		slog.ErrorContext(msgCtx, "Failed to write failed message", "destination", topic, "write_attempt", i, logging.Err(err))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to write message to %s: %w", topic, err)
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// DeadLetter is a message read from the dead-letter topic.
+type DeadLetter struct {
+	Partition         int    `json:"partition"`
+	Offset            int64  `json:"offset"`
+	Key               string `json:"key"`
+	Reason            string `json:"reason"`
+	Attempts          int    `json:"attempts"`
+	OriginalTopic     string `json:"original_topic"`
+	OriginalPartition int    `json:"original_partition"`
+	OriginalOffset    int64  `json:"original_offset"`
+	FailedAt          string `json:"failed_at"`
+	Payload           string `json:"payload"`
+
+	msg kafka.Message
+}
+
+func newDeadLetter(msg kafka.Message) DeadLetter {
+	h := headerCarrier{&msg.Headers}
+	partition, _ := strconv.Atoi(h.Get(HeaderOriginalPartition))
+	offset, _ := strconv.ParseInt(h.Get(HeaderOriginalOffset), 10, 64)
+
+	return DeadLetter{
+		Partition:         msg.Partition,
+		Offset:            msg.Offset,
+		Key:               string(msg.Key),
+		Reason:            h.Get(HeaderErrorReason),
+		Attempts:          attempts(msg),
+		OriginalTopic:     h.Get(HeaderOriginalTopic),
+		OriginalPartition: partition,
+		OriginalOffset:    offset,
+		FailedAt:          h.Get(HeaderFailedAt),
+		Payload:           string(msg.Value),
+		msg:               msg,
+	}
+}
+
+// ReadDeadLetters passes every message currently in the dead-letter topic to fn,
+// partition by partition in offset order. It stops at the first error returned by fn.
+// Reading does not commit offsets, so messages stay available for inspection.
+func ReadDeadLetters(ctx context.Context, fn func(DeadLetter) error) error {
+	cfg, err := connConfig()
+	if err != nil {
+		return err
+	}
+	topic := os.Getenv("KAFKA_TOPIC")
+
+	if len(cfg.Brokers) == 0 || topic == "" {
+		return fmt.Errorf("KAFKA_BROKERS and KAFKA_TOPIC must be set")
+	}
+	dlq := deadLetterTopic(topic)
+
+	conn, err := cfg.dial(ctx)
+	if err != nil {
+		return err
+	}
+	partitions, err := conn.ReadPartitions(dlq)
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read partitions of %s: %w", dlq, err)
+	}
+
+	for _, p := range partitions {
+		err := readPartition(ctx, cfg, p, fromFirst, func(msg kafka.Message) error {
+			return fn(newDeadLetter(msg))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startOffset returns the offset to read a partition from, given a connection
+// to its leader and the partition's first and last offsets.
+type startOffset func(conn *kafka.Conn, first, last int64) (int64, error)
+
+// fromFirst starts at the oldest message still in the partition.
+func fromFirst(_ *kafka.Conn, first, _ int64) (int64, error) {
+	return first, nil
+}
+
+// readPartition passes the messages of partition p from the offset returned by
+// start up to the last message at the time of the call to fn, in offset order.
+// fn returns errPartitionDone to stop early.
+func readPartition(ctx context.Context, cfg *Config, p kafka.Partition, start startOffset, fn func(kafka.Message) error) error {
+	topic, partition := p.Topic, p.ID
+
+	// Connects to the leader named in the partition metadata
+	conn, err := cfg.dialer().DialPartition(ctx, "tcp", "", p)
+	if err != nil {
+		return fmt.Errorf("failed to connect to partition leader: %w", err)
+	}
+	first, last, err := conn.ReadOffsets()
+	if err == nil {
+		first, err = start(conn, first, last)
+	}
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read offsets of partition %d: %w", partition, err)
+	}
+	if first >= last {
+		return nil
+	}
+
+	r := cfg.newReader(kafka.ReaderConfig{
+		Topic:     topic,
+		Partition: partition,
+		MaxBytes:  10e6, // 10MB
+	})
+	defer r.Close()
+	if err := r.SetOffset(first); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := r.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read partition %d: %w", partition, err)
+		}
+		if err := fn(msg); err != nil {
+			if errors.Is(err, errPartitionDone) {
+				return nil
+			}
+			return err
+		}
+		if msg.Offset >= last-1 {
+			return nil
+		}
+	}
+}
+
+// ReplayDeadLetter publishes a dead-lettered message to the rebalance topic again
+// with pub, with its original key, envelope and correlation ID. The failure
+// headers are not copied, so the message starts over with a full set of
+// retries. Messages whose envelope cannot be decoded are not replayed.
+func ReplayDeadLetter(ctx context.Context, pub Publisher, dl DeadLetter) error {
+	env, err := DecodeMessage(ctx, dl.msg)
+	if err != nil {
+		return fmt.Errorf("failed to decode message: %w", err)
+	}
+	if id := (headerCarrier{&dl.msg.Headers}).Get(HeaderCorrelationID); id != "" {
+		ctx = logging.WithCorrelationID(ctx, id)
+	}
+	return pub.Publish(ctx, RebalanceTopic(), dl.Key, env)
+}
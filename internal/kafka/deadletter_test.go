@@ -0,0 +1,146 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestFailureRouter_Destination(t *testing.T) {
+	tiers, _ := parseRetryTiers("rebalance", "1m,10m")
+	f := &failureRouter{tiers: tiers, dlq: "rebalance.dlq"}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		attempt   int
+		err       error
+		wantTopic string
+		wantDelay time.Duration
+	}{
+		{"First failure", 1, errors.New("timeout"), "rebalance.retry.1m", time.Minute},
+		{"Second failure", 2, errors.New("timeout"), "rebalance.retry.10m", 10 * time.Minute},
+		{"Retries exhausted", 3, errors.New("timeout"), "rebalance.dlq", 0},
+		{"Permanent error", 1, Permanent(errors.New("invalid JSON")), "rebalance.dlq", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topic, retryAt := f.destination(tt.attempt, tt.err, now)
+			if topic != tt.wantTopic {
+				t.Errorf("expected topic %s, got %s", tt.wantTopic, topic)
+			}
+			if tt.wantDelay == 0 && !retryAt.IsZero() {
+				t.Errorf("expected no retry time, got %v", retryAt)
+			}
+			if tt.wantDelay != 0 && !retryAt.Equal(now.Add(tt.wantDelay)) {
+				t.Errorf("expected retry at %v, got %v", now.Add(tt.wantDelay), retryAt)
+			}
+		})
+	}
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	src := kafka.Message{Topic: "rebalance", Partition: 1, Offset: 42, Key: []byte("user1"), Value: []byte("not json")}
+	msg := failureMessage(src, errors.New("invalid JSON message"), 3, time.Now(), time.Time{})
+	msg.Partition, msg.Offset = 0, 5
+
+	dl := newDeadLetter(msg)
+
+	if dl.Partition != 0 || dl.Offset != 5 {
+		t.Errorf("expected position 0/5, got %d/%d", dl.Partition, dl.Offset)
+	}
+	if dl.OriginalTopic != "rebalance" || dl.OriginalPartition != 1 || dl.OriginalOffset != 42 {
+		t.Errorf("unexpected original position %s/%d/%d", dl.OriginalTopic, dl.OriginalPartition, dl.OriginalOffset)
+	}
+	if dl.Key != "user1" || dl.Payload != "not json" || dl.Attempts != 3 || dl.Reason != "invalid JSON message" {
+		t.Errorf("unexpected dead letter %+v", dl)
+	}
+}
+
+// recordingPublisher records the last event published and the correlation ID
+// it was published with.
+type recordingPublisher struct {
+	topic, key, correlationID string
+	env                       Envelope
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, topic, key string, env Envelope) error {
+	p.topic, p.key, p.env = topic, key, env
+	p.correlationID = logging.CorrelationID(ctx)
+	return nil
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	t.Setenv("KAFKA_TOPIC", "rebalance")
+	env, err := NewEnvelope(EventRebalanceRequested, RebalanceRequestedVersion, map[string]string{"user_id": "user1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := kafka.Message{Topic: "rebalance", Key: []byte("user1"), Value: value}
+	headerCarrier{&src.Headers}.Set(HeaderCorrelationID, "corr-1")
+	dl := newDeadLetter(failureMessage(src, errors.New("timeout"), 3, time.Now(), time.Time{}))
+
+	pub := &recordingPublisher{}
+	if err := ReplayDeadLetter(context.Background(), pub, dl); err != nil {
+		t.Fatalf("ReplayDeadLetter() error = %v", err)
+	}
+	if pub.topic != "rebalance" || pub.key != "user1" || pub.env.MessageID != env.MessageID {
+		t.Errorf("unexpected replay of %s to %s/%s", pub.env.MessageID, pub.topic, pub.key)
+	}
+	if pub.correlationID != "corr-1" {
+		t.Errorf("expected correlation ID corr-1, got %q", pub.correlationID)
+	}
+
+	// A message that is not an envelope is not replayed
+	bad := newDeadLetter(failureMessage(kafka.Message{Key: []byte("user1"), Value: []byte("not json")}, errors.New("invalid JSON"), 1, time.Now(), time.Time{}))
+	if err := ReplayDeadLetter(context.Background(), pub, bad); err == nil {
+		t.Error("expected an error replaying an invalid message")
+	}
+}
+
+func TestDeadLetterTopic(t *testing.T) {
+	t.Setenv("KAFKA_DLQ_TOPIC", "")
+	if got := deadLetterTopic("rebalance"); got != "rebalance.dlq" {
+		t.Errorf("expected rebalance.dlq, got %q", got)
+	}
+
+	t.Setenv("KAFKA_DLQ_TOPIC", "custom.dlq")
+	if got := deadLetterTopic("rebalance"); got != "custom.dlq" {
+		t.Errorf("expected custom.dlq, got %q", got)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	t.Setenv("KAFKA_TOPIC", "rebalance")
+	t.Setenv("KAFKA_OUTPUT_TOPIC", "")
+	t.Setenv("KAFKA_GROUP_ID", "")
+	t.Setenv("KAFKA_DLQ_TOPIC", "rebalance.failed")
+	t.Setenv("PROJECTOR_GROUP_ID", "")
+	t.Setenv("PROJECTOR_DLQ_TOPIC", "")
+
+	tests := []struct {
+		topic     string
+		wantGroup string
+		wantDLQ   string
+	}{
+		{"rebalance", DefaultGroupID, "rebalance.failed"},
+		{"rebalance.completed", DefaultProjectorGroupID, "rebalance.completed.dlq"},
+	}
+	for _, tt := range tests {
+		groupID, dlq := subscription(tt.topic)
+		if groupID != tt.wantGroup || dlq != tt.wantDLQ {
+			t.Errorf("subscription(%q) = %s, %s, want %s, %s", tt.topic, groupID, dlq, tt.wantGroup, tt.wantDLQ)
+		}
+	}
+}
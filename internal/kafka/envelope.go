@@ -0,0 +1,134 @@
+package kafka
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Headers mirroring the envelope metadata, so tooling can route and filter
+// messages without decoding the value.
+const (
+	HeaderEventType     = "X-Event-Type"
+	HeaderSchemaVersion = "X-Schema-Version"
+	HeaderMessageID     = "X-Message-ID"
+	HeaderProducer      = "X-Producer"
+	HeaderProducedAt    = "X-Produced-At"
+)
+
+// ErrUnsupportedVersion is returned by Upcast for events newer than the version
+// the consumer understands, typically while a newer producer is being rolled out.
+var ErrUnsupportedVersion = errors.New("unsupported schema version")
+
+// Envelope wraps every event published to Kafka. The payload is the JSON
+// encoding of the event struct at SchemaVersion.
+type Envelope struct {
+	EventType     string          `json:"event_type"`
+	SchemaVersion int             `json:"schema_version"`
+	MessageID     string          `json:"message_id"`
+	ProducedAt    time.Time       `json:"produced_at"`
+	Producer      string          `json:"producer"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// producerName identifies this process in the envelopes it produces.
+var producerName = filepath.Base(os.Args[0])
+
+// SetProducer sets the producer name recorded in published envelopes.
+func SetProducer(name string) {
+	producerName = name
+}
+
+// NewEnvelope wraps payload as version of eventType with a new message ID.
+func NewEnvelope(eventType string, version int, payload interface{}) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("failed to marshal %s payload: %w", eventType, err)
+	}
+	return Envelope{
+		EventType:     eventType,
+		SchemaVersion: version,
+		MessageID:     newMessageID(),
+		ProducedAt:    time.Now().UTC(),
+		Producer:      producerName,
+		Payload:       data,
+	}, nil
+}
+
+// DecodeEnvelope decodes a message value. Values without an event type were
+// published before the envelope was introduced; they are returned as schema
+// version 0 with the whole value as payload and an empty event type.
+func DecodeEnvelope(value []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(value, &env); err != nil {
+		return Envelope{}, fmt.Errorf("failed to decode envelope: %w", err)
+	}
+	if env.EventType == "" {
+		return Envelope{Payload: value}, nil
+	}
+	if len(env.Payload) == 0 {
+		return Envelope{}, fmt.Errorf("envelope %s has no payload", env.MessageID)
+	}
+	return env, nil
+}
+
+// Upcaster migrates an event payload from one schema version to the next.
+type Upcaster func(payload json.RawMessage) (json.RawMessage, error)
+
+// eventVersion identifies a schema version of an event type.
+type eventVersion struct {
+	eventType string
+	version   int
+}
+
+var (
+	upcastersMu sync.RWMutex
+	upcasters   = make(map[eventVersion]Upcaster)
+)
+
+// RegisterUpcaster registers up to migrate eventType payloads from version
+// fromVersion to fromVersion+1. It is meant to be called from init.
+func RegisterUpcaster(eventType string, fromVersion int, up Upcaster) {
+	upcastersMu.Lock()
+	defer upcastersMu.Unlock()
+	upcasters[eventVersion{eventType, fromVersion}] = up
+}
+
+// Upcast migrates env to version by applying the registered upcasters one
+// version at a time. It returns ErrUnsupportedVersion if env is newer than version.
+func Upcast(env Envelope, version int) (Envelope, error) {
+	if env.SchemaVersion > version {
+		return env, fmt.Errorf("%s version %d: %w", env.EventType, env.SchemaVersion, ErrUnsupportedVersion)
+	}
+
+	upcastersMu.RLock()
+	defer upcastersMu.RUnlock()
+
+	for env.SchemaVersion < version {
+		up, ok := upcasters[eventVersion{env.EventType, env.SchemaVersion}]
+		if !ok {
+			return env, fmt.Errorf("no upcaster for %s version %d", env.EventType, env.SchemaVersion)
+		}
+		payload, err := up(env.Payload)
+		if err != nil {
+			return env, fmt.Errorf("failed to upcast %s from version %d: %w", env.EventType, env.SchemaVersion, err)
+		}
+		env.Payload = payload
+		env.SchemaVersion++
+	}
+	return env, nil
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
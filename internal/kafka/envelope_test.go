@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+// The golden files in testdata pin the wire format of rebalance events. A change
+// that breaks these tests breaks messages already in the topic and consumers that
+// are still running the previous version: add a new schema version and an
+// upcaster instead of editing an existing file.
+
+var goldenRebalance = models.RebalancePortfolioKafka{
+	UserID:            "user1",
+	NewAllocation:     map[string]float64{"stocks": 70, "bonds": 30},
+	CurrentAllocation: map[string]float64{"stocks": 60, "bonds": 40},
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		t.Fatalf("invalid golden file %s: %v", name, err)
+	}
+	return buf.Bytes()
+}
+
+func TestEnvelope_WireFormat(t *testing.T) {
+	payload, err := json.Marshal(goldenRebalance)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	env := Envelope{
+		EventType:     EventRebalanceRequested,
+		SchemaVersion: RebalanceRequestedVersion,
+		MessageID:     "5f0c6e1a9b2d4c8e8f7a6b5c4d3e2f10",
+		ProducedAt:    time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+		Producer:      "rebalancer-api",
+		Payload:       payload,
+	}
+
+	msg, err := encodeMessage(context.Background(), "rebalance", "user1", env)
+	if err != nil {
+		t.Fatalf("encodeMessage() error = %v", err)
+	}
+
+	want := readGolden(t, "rebalance_requested_v1.json")
+	if !bytes.Equal(msg.Value, want) {
+		t.Errorf("wire format changed\ngot:  %s\nwant: %s", msg.Value, want)
+	}
+	if string(msg.Key) != "user1" {
+		t.Errorf("expected key user1, got %q", msg.Key)
+	}
+
+	h := headerCarrier{&msg.Headers}
+	for key, want := range map[string]string{
+		HeaderEventType:     EventRebalanceRequested,
+		HeaderSchemaVersion: "1",
+		HeaderMessageID:     "5f0c6e1a9b2d4c8e8f7a6b5c4d3e2f10",
+		HeaderProducer:      "rebalancer-api",
+		HeaderProducedAt:    "2024-03-01T12:00:00Z",
+		HeaderContentType:   ContentTypeJSON,
+	} {
+		if got := h.Get(key); got != want {
+			t.Errorf("header %s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestEnvelope_DecodeVersions(t *testing.T) {
+	tests := []struct {
+		file        string
+		wantVersion int
+	}{
+		{"rebalance_requested_v0.json", 0},
+		{"rebalance_requested_v1.json", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			env, err := DecodeEnvelope(readGolden(t, tt.file))
+			if err != nil {
+				t.Fatalf("DecodeEnvelope() error = %v", err)
+			}
+			if env.SchemaVersion != tt.wantVersion {
+				t.Errorf("expected version %d, got %d", tt.wantVersion, env.SchemaVersion)
+			}
+			if env.EventType == "" {
+				env.EventType = EventRebalanceRequested
+			}
+
+			env, err = Upcast(env, RebalanceRequestedVersion)
+			if err != nil {
+				t.Fatalf("Upcast() error = %v", err)
+			}
+
+			var got models.RebalancePortfolioKafka
+			if err := json.Unmarshal(env.Payload, &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, goldenRebalance) {
+				t.Errorf("expected %+v, got %+v", goldenRebalance, got)
+			}
+		})
+	}
+}
+
+func TestUpcast(t *testing.T) {
+	RegisterUpcaster("test.event", 1, func(p json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(`{"v":2}`), nil
+	})
+	RegisterUpcaster("test.event", 2, func(p json.RawMessage) (json.RawMessage, error) {
+		return json.RawMessage(`{"v":3}`), nil
+	})
+
+	env, err := Upcast(Envelope{EventType: "test.event", SchemaVersion: 1, Payload: json.RawMessage(`{"v":1}`)}, 3)
+	if err != nil {
+		t.Fatalf("Upcast() error = %v", err)
+	}
+	if env.SchemaVersion != 3 || string(env.Payload) != `{"v":3}` {
+		t.Errorf("expected version 3 payload, got version %d %s", env.SchemaVersion, env.Payload)
+	}
+
+	if _, err := Upcast(Envelope{EventType: "test.event", SchemaVersion: 4}, 3); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, err := Upcast(Envelope{EventType: "test.event", SchemaVersion: 0}, 3); err == nil {
+		t.Error("expected error for missing upcaster")
+	}
+}
+
+func TestDecodeEnvelope_Invalid(t *testing.T) {
+	for _, value := range []string{`not json`, `{"event_type":"rebalance.requested","schema_version":1}`} {
+		if _, err := DecodeEnvelope([]byte(value)); err == nil {
+			t.Errorf("expected error for %s", value)
+		}
+	}
+}
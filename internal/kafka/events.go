@@ -0,0 +1,206 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"portfolio-rebalancer/internal/models"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Event types and the schema version this build produces and consumes.
+const (
+	EventRebalanceRequested   = "rebalance.requested" // rebalance topic, payload: models.RebalancePortfolioKafka
+	RebalanceRequestedVersion = 1
+
+	EventRebalanceCompleted   = "rebalance.completed" // output topic, payload: models.RebalanceCompleted
+	RebalanceCompletedVersion = 1
+)
+
+func init() {
+	// Version 0 is the bare RebalancePortfolioKafka JSON published before the
+	// envelope was introduced. Its payload matches version 1.
+	RegisterUpcaster(EventRebalanceRequested, 0, func(payload json.RawMessage) (json.RawMessage, error) {
+		return payload, nil
+	})
+}
+
+// eventSchema is the schema of an event version for the binary serializers.
+// Published schemas must not change; add a new version instead.
+type eventSchema struct {
+	avro           string
+	proto          string
+	protoMarshal   func(payload json.RawMessage) ([]byte, error)
+	protoUnmarshal func(data []byte) (json.RawMessage, error)
+}
+
+var eventSchemas = map[eventVersion]eventSchema{
+	{EventRebalanceRequested, 1}: {
+		avro: `{"type":"record","name":"RebalanceRequested","namespace":"rebalancer.v1","fields":[` +
+			`{"name":"user_id","type":"string"},` +
+			`{"name":"new_allocation","type":{"type":"map","values":"double"}},` +
+			`{"name":"current_allocation","type":{"type":"map","values":"double"}}]}`,
+		proto: `syntax = "proto3";
+package rebalancer.v1;
+
+message RebalanceRequested {
+  string user_id = 1;
+  map<string, double> new_allocation = 2;
+  map<string, double> current_allocation = 3;
+}
+`,
+		protoMarshal:   marshalRebalanceRequested,
+		protoUnmarshal: unmarshalRebalanceRequested,
+	},
+	{EventRebalanceCompleted, 1}: {
+		avro: `{"type":"record","name":"RebalanceCompleted","namespace":"rebalancer.v1","fields":[` +
+			`{"name":"user_id","type":"string"},` +
+			`{"name":"request_id","type":"string"},` +
+			`{"name":"transactions","type":{"type":"array","items":{"type":"record","name":"RebalanceTransaction","fields":[` +
+			`{"name":"user_id","type":"string"},` +
+			`{"name":"action","type":"string"},` +
+			`{"name":"asset","type":"string"},` +
+			`{"name":"rebalance_percent","type":"double"}]}}}]}`,
+		proto: `syntax = "proto3";
+package rebalancer.v1;
+
+message RebalanceCompleted {
+  string user_id = 1;
+  string request_id = 2;
+  repeated RebalanceTransaction transactions = 3;
+}
+
+message RebalanceTransaction {
+  string user_id = 1;
+  string action = 2;
+  string asset = 3;
+  double rebalance_percent = 4;
+}
+`,
+		protoMarshal:   marshalRebalanceCompleted,
+		protoUnmarshal: unmarshalRebalanceCompleted,
+	},
+}
+
+// lookupEventSchema returns the binary schema of the version of env.
+func lookupEventSchema(env Envelope) (eventSchema, error) {
+	es, ok := eventSchemas[eventVersion{env.EventType, env.SchemaVersion}]
+	if !ok {
+		return eventSchema{}, fmt.Errorf("no binary schema for %s version %d", env.EventType, env.SchemaVersion)
+	}
+	return es, nil
+}
+
+func marshalRebalanceRequested(payload json.RawMessage) ([]byte, error) {
+	var p models.RebalancePortfolioKafka
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = appendStringField(b, 1, p.UserID)
+	b = appendDoubleMapField(b, 2, p.NewAllocation)
+	b = appendDoubleMapField(b, 3, p.CurrentAllocation)
+	return b, nil
+}
+
+func unmarshalRebalanceRequested(data []byte) (json.RawMessage, error) {
+	fields, err := consumeFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := models.RebalancePortfolioKafka{
+		NewAllocation:     make(map[string]float64),
+		CurrentAllocation: make(map[string]float64),
+	}
+	for _, f := range fields {
+		if f.typ != protowire.BytesType {
+			continue
+		}
+		switch f.num {
+		case 1:
+			p.UserID = string(f.bytes)
+		case 2:
+			err = consumeDoubleMapEntry(p.NewAllocation, f.bytes)
+		case 3:
+			err = consumeDoubleMapEntry(p.CurrentAllocation, f.bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(p)
+}
+
+func marshalRebalanceCompleted(payload json.RawMessage) ([]byte, error) {
+	var p models.RebalanceCompleted
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	b = appendStringField(b, 1, p.UserID)
+	b = appendStringField(b, 2, p.RequestID)
+	for _, tx := range p.Transactions {
+		var m []byte
+		m = appendStringField(m, 1, tx.UserID)
+		m = appendStringField(m, 2, tx.Action)
+		m = appendStringField(m, 3, tx.Asset)
+		m = appendDoubleField(m, 4, tx.RebalancePercent)
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	return b, nil
+}
+
+func unmarshalRebalanceCompleted(data []byte) (json.RawMessage, error) {
+	fields, err := consumeFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	p := models.RebalanceCompleted{Transactions: []models.RebalanceTransaction{}}
+	for _, f := range fields {
+		if f.typ != protowire.BytesType {
+			continue
+		}
+		switch f.num {
+		case 1:
+			p.UserID = string(f.bytes)
+		case 2:
+			p.RequestID = string(f.bytes)
+		case 3:
+			tx, err := unmarshalRebalanceTransaction(f.bytes)
+			if err != nil {
+				return nil, err
+			}
+			p.Transactions = append(p.Transactions, tx)
+		}
+	}
+	return json.Marshal(p)
+}
+
+func unmarshalRebalanceTransaction(data []byte) (models.RebalanceTransaction, error) {
+	fields, err := consumeFields(data)
+	if err != nil {
+		return models.RebalanceTransaction{}, err
+	}
+
+	var tx models.RebalanceTransaction
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			tx.UserID = string(f.bytes)
+		case f.num == 2 && f.typ == protowire.BytesType:
+			tx.Action = string(f.bytes)
+		case f.num == 3 && f.typ == protowire.BytesType:
+			tx.Asset = string(f.bytes)
+		case f.num == 4 && f.typ == protowire.Fixed64Type:
+			tx.RebalancePercent = math.Float64frombits(f.bits)
+		}
+	}
+	return tx, nil
+}
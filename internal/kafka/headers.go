@@ -0,0 +1,67 @@
+package kafka
+
+import (
+	"github.com/segmentio/kafka-go"
+)
+
+// HeaderCorrelationID carries the correlation ID of the originating HTTP request
+// so that consumer logs can be tied back to it.
+const HeaderCorrelationID = "X-Correlation-ID"
+
+// HeaderControl marks a message as a control message, such as a connectivity
+// probe, that carries no rebalance event. Consumers skip these messages.
+const HeaderControl = "X-Control"
+
+// isControlMessage reports whether msg is a control message. Literal "ping"
+// messages without a key were written by older versions to probe the broker
+// and are treated as control messages too.
+func isControlMessage(msg kafka.Message) bool {
+	if (headerCarrier{&msg.Headers}).Get(HeaderControl) != "" {
+		return true
+	}
+	return len(msg.Key) == 0 && string(msg.Value) == "ping"
+}
+
+// headerCarrier adapts Kafka message headers to a propagation.TextMapCarrier
+// so that trace context can be carried from producer to consumer.
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c headerCarrier) Get(key string) string {
+	for _, h := range *c.headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key, value string) {
+	for i, h := range *c.headers {
+		if h.Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.headers))
+	for _, h := range *c.headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// Del removes all headers with key.
+func (c headerCarrier) Del(key string) {
+	kept := (*c.headers)[:0]
+	for _, h := range *c.headers {
+		if h.Key != key {
+			kept = append(kept, h)
+		}
+	}
+	*c.headers = kept
+}
@@ -0,0 +1,62 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"portfolio-rebalancer/internal/tracing"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHeaderCarrier_TracePropagation(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	msg := kafka.Message{Headers: []kafka.Header{{Key: "traceparent", Value: []byte("stale")}}}
+	tracing.Inject(ctx, headerCarrier{&msg.Headers})
+
+	if len(msg.Headers) != 1 {
+		t.Fatalf("expected existing traceparent header to be replaced, got %v", msg.Headers)
+	}
+	if got := string(msg.Headers[0].Value); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("unexpected traceparent %q", got)
+	}
+
+	extracted := trace.SpanContextFromContext(tracing.Extract(context.Background(), headerCarrier{&msg.Headers}))
+	if extracted.TraceID() != traceID || extracted.SpanID() != spanID {
+		t.Errorf("expected extracted span context %v, got %v", sc, extracted)
+	}
+}
+
+func TestIsControlMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      kafka.Message
+		expected bool
+	}{
+		{"Control header", kafka.Message{Value: []byte("{}"), Headers: []kafka.Header{{Key: HeaderControl, Value: []byte("probe")}}}, true},
+		{"Legacy ping", kafka.Message{Value: []byte("ping")}, true},
+		{"Keyed ping payload", kafka.Message{Key: []byte("user1"), Value: []byte("ping")}, false},
+		{"Rebalance event", kafka.Message{Key: []byte("user1"), Value: []byte(`{"user_id":"user1"}`)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isControlMessage(tt.msg); got != tt.expected {
+				t.Errorf("isControlMessage() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// lagTracker keeps the lag of every partition assigned to this consumer.
+//
+// Readers in a consumer group cannot report their lag themselves, so it is
+// derived from the high watermark returned with every fetched message.
+type lagTracker struct {
+	mu         sync.Mutex
+	partitions map[int]int64
+}
+
+func newLagTracker() *lagTracker {
+	return &lagTracker{partitions: make(map[int]int64)}
+}
+
+// observe records the lag of the partition msg was read from.
+func (t *lagTracker) observe(msg kafka.Message) {
+	lag := msg.HighWaterMark - msg.Offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+
+	t.mu.Lock()
+	t.partitions[msg.Partition] = lag
+	t.mu.Unlock()
+}
+
+// total returns the summed lag of all partitions seen so far.
+func (t *lagTracker) total() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sum int64
+	for _, lag := range t.partitions {
+		sum += lag
+	}
+	return sum
+}
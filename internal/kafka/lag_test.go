@@ -0,0 +1,23 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestLagTracker(t *testing.T) {
+	lag := newLagTracker()
+
+	lag.observe(kafka.Message{Partition: 0, Offset: 4, HighWaterMark: 10})
+	lag.observe(kafka.Message{Partition: 1, Offset: 0, HighWaterMark: 3})
+	if got := lag.total(); got != 7 {
+		t.Errorf("total() = %d, want 7", got)
+	}
+
+	// A newer message replaces the lag of its partition
+	lag.observe(kafka.Message{Partition: 0, Offset: 9, HighWaterMark: 10})
+	if got := lag.total(); got != 2 {
+		t.Errorf("total() = %d, want 2", got)
+	}
+}
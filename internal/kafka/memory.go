@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/tracing"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// MemoryBroker is an in-process Broker for local development and tests. Every
+// topic is a single partition kept in memory. Each subscriber reads a topic
+// from the beginning and handles its messages one at a time; messages whose
+// handler fails are logged and dropped, as there are no retry or dead-letter
+// topics. Nothing is persisted.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	topics map[string]*memoryTopic
+}
+
+type memoryTopic struct {
+	messages []kafka.Message
+	appended chan struct{} // closed and replaced on every publish
+}
+
+// NewMemoryBroker returns an empty in-memory broker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{topics: make(map[string]*memoryTopic)}
+}
+
+// topic returns the topic named name, creating it if needed. b.mu must be held.
+func (b *MemoryBroker) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{appended: make(chan struct{})}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// Publish appends env to topic with the same headers a Kafka message would carry.
+func (b *MemoryBroker) Publish(ctx context.Context, topic, key string, env Envelope) error {
+	msg, err := newMessage(ctx, topic, key, env)
+	if err != nil {
+		metrics.KafkaMessagesPublished.WithLabelValues(topic, metrics.ResultError).Inc()
+		return err
+	}
+	tracing.Inject(ctx, headerCarrier{&msg.Headers})
+	msg.Topic = topic
+	msg.Time = time.Now()
+
+	b.mu.Lock()
+	t := b.topic(topic)
+	msg.Offset = int64(len(t.messages))
+	t.messages = append(t.messages, msg)
+	close(t.appended)
+	t.appended = make(chan struct{})
+	b.mu.Unlock()
+
+	metrics.KafkaMessagesPublished.WithLabelValues(topic, metrics.ResultSuccess).Inc()
+	return nil
+}
+
+// Subscribe passes every message of topic, including those published before it
+// was called, to handler until ctx is canceled.
+func (b *MemoryBroker) Subscribe(ctx context.Context, topic string, handler Handler) error {
+	slog.Info("In-memory consumer started", logging.KeyTopic, topic)
+
+	var offset int
+	for {
+		b.mu.Lock()
+		t := b.topic(topic)
+		if offset < len(t.messages) {
+			msg := t.messages[offset]
+			msg.HighWaterMark = int64(len(t.messages))
+			b.mu.Unlock()
+
+			offset++
+			handleMemoryMessage(msg, handler)
+			continue
+		}
+		appended := t.appended
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Context canceled, stopping consumer", logging.KeyTopic, topic)
+			return nil
+		case <-appended:
+		}
+	}
+}
+
+func handleMemoryMessage(msg kafka.Message, handler Handler) {
+	msgCtx, span := messageContext(msg)
+	defer span.End()
+
+	if err := handler(msgCtx, msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(msgCtx, "Failed to process message; dropping it", logging.Err(err))
+	}
+}
+
+// Close is a no-op; messages are kept until the broker is garbage collected.
+func (b *MemoryBroker) Close() error {
+	return nil
+}
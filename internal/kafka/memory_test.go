@@ -0,0 +1,94 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMemoryBroker_PublishSubscribe(t *testing.T) {
+	b := NewMemoryBroker()
+	ctx := logging.WithCorrelationID(context.Background(), "corr-1")
+
+	publish := func(user string) Envelope {
+		env, err := NewEnvelope(EventRebalanceRequested, RebalanceRequestedVersion, goldenRebalance)
+		if err != nil {
+			t.Fatalf("NewEnvelope() error = %v", err)
+		}
+		if err := b.Publish(ctx, "rebalance", user, env); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+		return env
+	}
+
+	// Published before and after subscribing
+	want := []Envelope{publish("user1"), publish("user2")}
+
+	type delivery struct {
+		msg           kafka.Message
+		correlationID string
+	}
+	got := make(chan delivery, 3)
+	subCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Subscribe(subCtx, "rebalance", func(ctx context.Context, msg kafka.Message) error {
+			got <- delivery{msg, logging.CorrelationID(ctx)}
+			return nil
+		})
+	}()
+	want = append(want, publish("user1"))
+
+	for i, env := range want {
+		select {
+		case d := <-got:
+			if d.msg.Offset != int64(i) {
+				t.Errorf("expected offset %d, got %d", i, d.msg.Offset)
+			}
+			if d.correlationID != "corr-1" {
+				t.Errorf("expected correlation ID corr-1, got %q", d.correlationID)
+			}
+			decoded, err := DecodeMessage(context.Background(), d.msg)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v", err)
+			}
+			if decoded.MessageID != env.MessageID {
+				t.Errorf("message %d: expected ID %s, got %s", i, env.MessageID, decoded.MessageID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Subscribe() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe did not return after cancel")
+	}
+}
+
+func TestMemoryBroker_TopicsAreSeparate(t *testing.T) {
+	b := NewMemoryBroker()
+	env, _ := NewEnvelope(EventRebalanceCompleted, RebalanceCompletedVersion, map[string]string{})
+	if err := b.Publish(context.Background(), "rebalance.completed", "user1", env); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := b.Subscribe(ctx, "rebalance", func(ctx context.Context, msg kafka.Message) error {
+		t.Errorf("unexpected message on rebalance topic: %s", msg.Topic)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Subscribe() error = %v", err)
+	}
+}
@@ -2,109 +2,270 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/tracing"
+
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var writer *kafka.Writer
+// DefaultGroupID is the consumer group used when KAFKA_GROUP_ID is not set.
+const DefaultGroupID = "rebalance-consumer"
 
-// InitKafka initializes kafka connection
-func InitKafka() error {
-	kafkaBroker := os.Getenv("KAFKA_BROKER")
-	topic := os.Getenv("KAFKA_TOPIC")
+// DefaultProjectorGroupID is the consumer group of the projector used when
+// PROJECTOR_GROUP_ID is not set.
+const DefaultProjectorGroupID = "rebalance-projector"
 
-	if kafkaBroker == "" || topic == "" {
-		return nil // skip if env not set
+var (
+	consumerMu sync.Mutex
+	consumer   *lagTracker // lag of the running consumer, nil while it is stopped
+)
+
+// waitForBroker reads the cluster metadata until it succeeds, giving up after
+// the given number of attempts.
+func waitForBroker(cfg *Config, attempts int, interval time.Duration) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = readMetadata(ctx, cfg)
+		cancel()
+		if err == nil {
+			slog.Info("Kafka is ready")
+			return nil
+		}
+		slog.Info("Waiting for Kafka to be ready...", logging.Err(err))
+		time.Sleep(interval)
 	}
+	return fmt.Errorf("kafka not ready after %d attempts: %w", attempts, err)
+}
 
-	if err := ensureTopicExists(kafkaBroker, topic, 1, 1); err != nil {
-		return fmt.Errorf("failed to ensure topic exists: %w", err)
+// publish encodes env with the serializer of the topic of w and writes it with
+// the correlation ID and trace context of ctx.
+func publish(ctx context.Context, w *kafka.Writer, key string, env Envelope) error {
+	msg, err := newMessage(ctx, w.Topic, key, env)
+	if err != nil {
+		return err
 	}
+	return writeMessage(ctx, w, msg)
+}
 
-	writer = &kafka.Writer{
-		Addr:     kafka.TCP(kafkaBroker),
-		Topic:    topic,
-		Balancer: &kafka.LeastBytes{},
+// newMessage encodes env for topic and adds the correlation ID of ctx.
+func newMessage(ctx context.Context, topic, key string, env Envelope) (kafka.Message, error) {
+	msg, err := encodeMessage(ctx, topic, key, env)
+	if err != nil {
+		return kafka.Message{}, err
 	}
 
-	// Retry logic to check Kafka availability
-	for i := 0; i < 10; i++ {
-		err := writer.WriteMessages(context.Background(), kafka.Message{
-			Value: []byte("ping"),
-		})
-		if err == nil {
-			log.Println("Kafka is ready")
-			return nil
+	// Propagate the correlation ID to the consumer
+	if id := logging.CorrelationID(ctx); id != "" {
+		headerCarrier{&msg.Headers}.Set(HeaderCorrelationID, id)
+	}
+	return msg, nil
+}
+
+// writeMessage writes msg to the topic of w inside a producer span whose trace
+// context is propagated in the message headers.
+func writeMessage(ctx context.Context, w *kafka.Writer, msg kafka.Message) error {
+	ctx, span := tracing.Tracer().Start(ctx, w.Topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystem("kafka"),
+			semconv.MessagingDestinationName(w.Topic),
+		),
+	)
+	defer span.End()
+
+	tracing.Inject(ctx, headerCarrier{&msg.Headers})
+
+	err := w.WriteMessages(ctx, msg)
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	metrics.KafkaMessagesPublished.WithLabelValues(w.Topic, result).Inc()
+	return err
+}
+
+// consumeTopic fetches messages from r until ctx is canceled and processes them
+// on a worker pool, routing failed messages through failures. Messages for the
+// same user are processed in order, and offsets are committed in fetch order once
+// processed or routed. It returns an error, leaving the message uncommitted, if
+// a failed message cannot be routed. For a retry topic (delayed) every message is
+// held until its retry time; messages in a tier share the same delay, so holding
+// one never delays an earlier one.
+func consumeTopic(ctx context.Context, r *kafka.Reader, lag *lagTracker, delayed bool, workers, maxInFlight int, handler Handler, failures *failureRouter) error {
+	topic := r.Config().Topic
+
+	// Cancelled by the pool when a message fails, to stop fetching
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	commits := newCommitTracker(func(msg kafka.Message) error {
+		// Commit with a fresh context so the offset is stored even during shutdown
+		return r.CommitMessages(context.Background(), msg)
+	})
+	pool := newWorkerPool(workers, maxInFlight, func(msg kafka.Message) error {
+		return processMessage(ctx, msg, handler, failures)
+	}, commits, cancel)
+
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Info("Context canceled, stopping consumer", logging.KeyTopic, topic)
+				break
+			}
+			slog.Error("Kafka fetch error", logging.KeyTopic, topic, logging.Err(err))
+			continue
+		}
+		lag.observe(msg)
+		metrics.KafkaConsumerLag.WithLabelValues(topic).Set(float64(lag.total()))
+
+		if isControlMessage(msg) {
+			slog.Debug("Skipping control message", logging.KeyTopic, topic, logging.KeyPartition, msg.Partition, logging.KeyOffset, msg.Offset)
+			metrics.KafkaMessagesConsumed.WithLabelValues(topic, metrics.ConsumeControl).Inc()
+			pool.skip(msg)
+			continue
+		}
+
+		if delayed {
+			select {
+			case <-ctx.Done():
+				// Not committed, so the message is fetched again after a restart
+				slog.Info("Context canceled, stopping consumer", logging.KeyTopic, topic)
+			case <-time.After(time.Until(retryDue(msg))):
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		if err := pool.submit(ctx, msg); err != nil {
+			break
 		}
-		log.Println("Waiting for Kafka to be ready...")
-		time.Sleep(2 * time.Second)
 	}
 
+	// Let the dispatched messages finish before the reader is closed
+	return pool.close()
+}
+
+// processMessage runs handler for msg inside a consumer span and routes it to a
+// retry or dead-letter topic if it fails. It returns an error only if routing failed.
+func processMessage(ctx context.Context, msg kafka.Message, handler Handler, failures *failureRouter) error {
+	msgCtx, span := messageContext(msg)
+	defer span.End()
+
+	if err := handler(msgCtx, msg); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(msgCtx, "Failed to process message", "attempt", attempts(msg)+1, logging.Err(err))
+
+		return failures.route(ctx, msgCtx, msg, err)
+	}
 	return nil
 }
 
-func PublishMessage(ctx context.Context, payload []byte) error {
-	if writer == nil {
-		log.Println("Kafka writer is nil; skipping message publish")
-		return fmt.Errorf("kafka writer not initialized")
+// messageContext returns the handler context for msg, continuing the producer's
+// trace in a new consumer span. It is not derived from the consumer context, so
+// a message that is already being processed is finished during shutdown.
+func messageContext(msg kafka.Message) (context.Context, trace.Span) {
+	msgCtx := tracing.Extract(context.Background(), headerCarrier{&msg.Headers})
+	if id := (headerCarrier{&msg.Headers}).Get(HeaderCorrelationID); id != "" {
+		msgCtx = logging.WithCorrelationID(msgCtx, id)
 	}
+	msgCtx = logging.With(msgCtx,
+		logging.KeyTopic, msg.Topic,
+		logging.KeyPartition, msg.Partition,
+		logging.KeyOffset, msg.Offset,
+		logging.KeyJobID, fmt.Sprintf("%s-%d-%d", msg.Topic, msg.Partition, msg.Offset),
+	)
+	msgCtx, span := tracing.Tracer().Start(msgCtx, msg.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystem("kafka"),
+			semconv.MessagingDestinationName(msg.Topic),
+			semconv.MessagingKafkaDestinationPartition(msg.Partition),
+			semconv.MessagingKafkaMessageOffset(int(msg.Offset)),
+		),
+	)
+	return msgCtx, span
+}
 
-	msg := kafka.Message{
-		Value: payload,
+// CheckBroker returns an error if the Kafka broker cannot be reached or the
+// metadata of the rebalance topic cannot be read.
+func CheckBroker(ctx context.Context) error {
+	cfg, err := connConfig()
+	if err != nil {
+		return err
 	}
+	topic := os.Getenv("KAFKA_TOPIC")
 
-	return writer.WriteMessages(ctx, msg)
+	if len(cfg.Brokers) == 0 || topic == "" {
+		return nil // skip if env not set
+	}
+	return readMetadata(ctx, cfg, topic)
 }
 
-func ConsumeMessage(ctx context.Context, handler func(kafka.Message)) error {
-	kafkaBroker := os.Getenv("KAFKA_BROKER")
-	topic := os.Getenv("KAFKA_TOPIC")
+// readMetadata connects to a bootstrap broker and reads the partitions of topics,
+// or of all topics if none are given. Nothing is written, so it is safe to use as a probe.
+func readMetadata(ctx context.Context, cfg *Config, topics ...string) error {
+	conn, err := cfg.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	if kafkaBroker == "" || topic == "" {
-		log.Println("Kafka consumer config not set; skipping consumer start.")
-		return nil
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
 
-	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   []string{kafkaBroker},
-		Topic:     topic,
-		Partition: 0,
-		MinBytes:  10e3, // 10KB
-		MaxBytes:  10e6, // 10MB
-	})
+	if _, err := conn.ReadPartitions(topics...); err != nil {
+		return fmt.Errorf("failed to read topic metadata: %w", err)
+	}
+	return nil
+}
 
-	reader.SetOffset(kafka.FirstOffset)
-
-	go func() {
-		defer reader.Close()
-		for {
-			msg, err := reader.ReadMessage(ctx)
-			if err != nil {
-				if ctx.Err() != nil {
-					log.Println("Context canceled, stopping consumer")
-					return
-				}
-				log.Printf("Kafka read error: %v\n", err)
-				continue
-			}
+// CheckConsumerLag returns a check that fails when the consumer is more than
+// maxLag messages behind the end of its assigned partitions, as of the last
+// message it fetched.
+func CheckConsumerLag(maxLag int64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		consumerMu.Lock()
+		t := consumer
+		consumerMu.Unlock()
 
-			handler(msg)
+		if t == nil {
+			return errors.New("consumer not running")
 		}
-	}()
 
-	log.Println("Kafka consumer started")
-	return nil
+		if lag := t.total(); lag > maxLag {
+			return fmt.Errorf("consumer lag %d exceeds threshold %d", lag, maxLag)
+		}
+		return nil
+	}
 }
 
-func ensureTopicExists(broker, topic string, partitions, replication int) error {
+func ensureTopicExists(cfg *Config, topic string, partitions, replication int) error {
+	ctx := context.Background()
+
 	// Connect to any broker first
-	conn, err := kafka.Dial("tcp", broker)
+	conn, err := cfg.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to connect to Kafka broker: %w", err)
+		return err
 	}
 	defer conn.Close()
 
@@ -114,7 +275,8 @@ func ensureTopicExists(broker, topic string, partitions, replication int) error
 		return fmt.Errorf("failed to get controller: %w", err)
 	}
 
-	controllerConn, err := kafka.Dial("tcp", fmt.Sprintf("%s:%d", controller.Host, controller.Port))
+	controllerAddr := net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port))
+	controllerConn, err := cfg.dialer().DialContext(ctx, "tcp", controllerAddr)
 	if err != nil {
 		return fmt.Errorf("failed to connect to controller: %w", err)
 	}
@@ -125,11 +287,19 @@ func ensureTopicExists(broker, topic string, partitions, replication int) error
 	if err != nil {
 		return fmt.Errorf("failed to read partitions: %w", err)
 	}
+	existing := 0
 	for _, t := range topics {
 		if t.Topic == topic {
-			log.Printf("Topic %s already exists", topic)
-			return nil
+			existing++
+		}
+	}
+	if existing > 0 {
+		if existing < partitions {
+			slog.Warn("Topic has fewer partitions than configured", logging.KeyTopic, topic, "partitions", existing, "configured", partitions)
+		} else {
+			slog.Info("Topic already exists", logging.KeyTopic, topic, "partitions", existing)
 		}
+		return nil
 	}
 
 	// Create topic if missing
@@ -144,6 +314,6 @@ func ensureTopicExists(broker, topic string, partitions, replication int) error
 		return fmt.Errorf("failed to create topic: %w", err)
 	}
 
-	log.Printf("Topic %s created successfully", topic)
+	slog.Info("Topic created successfully", logging.KeyTopic, topic, "partitions", partitions, "replication_factor", replication)
 	return nil
 }
@@ -0,0 +1,72 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/storage"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// TransactionProjector copies the transactions of RebalanceCompleted events to
+// a transaction repository, e.g. Elasticsearch for search and analytics while
+// PostgreSQL is the system of record.
+type TransactionProjector struct {
+	transactions storage.TransactionRepository
+}
+
+// NewTransactionProjector returns a projector writing to transactions.
+func NewTransactionProjector(transactions storage.TransactionRepository) *TransactionProjector {
+	return &TransactionProjector{transactions: transactions}
+}
+
+// Run projects the events on the output topic delivered by sub until ctx is
+// canceled. On a Cluster it reads with the projector's own consumer group and
+// dead-letter topic.
+func (p *TransactionProjector) Run(ctx context.Context, sub Subscriber) error {
+	return sub.Subscribe(ctx, outputTopic(RebalanceTopic()), p.handleCompleted)
+}
+
+// handleCompleted replaces the projected transactions of the request in the
+// event, so replaying or reprocessing a request leaves no stale transactions.
+func (p *TransactionProjector) handleCompleted(ctx context.Context, msg kafka.Message) error {
+	env, err := DecodeMessage(ctx, msg)
+	if err != nil {
+		if errors.Is(err, ErrSerializerUnavailable) {
+			return err
+		}
+		return Permanent(err)
+	}
+	if env.EventType != EventRebalanceCompleted {
+		return Permanent(fmt.Errorf("unexpected event type %q", env.EventType))
+	}
+	if env, err = Upcast(env, RebalanceCompletedVersion); err != nil {
+		if !errors.Is(err, ErrUnsupportedVersion) {
+			err = Permanent(err)
+		}
+		return err
+	}
+
+	var completed models.RebalanceCompleted
+	if err := json.Unmarshal(env.Payload, &completed); err != nil {
+		return Permanent(fmt.Errorf("failed to unmarshal message: %w", err))
+	}
+	ctx = logging.With(ctx, logging.KeyUserID, completed.UserID, logging.KeyMessageID, completed.RequestID)
+
+	if completed.RequestID != "" {
+		if err := p.transactions.DeleteRebalanceTransactions(ctx, completed.RequestID); err != nil {
+			return fmt.Errorf("failed to delete projected transactions: %w", err)
+		}
+	}
+	if err := p.transactions.SaveRebalanceTransactions(ctx, completed.RequestID, completed.Transactions); err != nil {
+		return fmt.Errorf("failed to project transactions: %w", err)
+	}
+	slog.DebugContext(ctx, "Projected rebalance transactions", "count", len(completed.Transactions))
+	return nil
+}
@@ -0,0 +1,113 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Helpers to hand-encode the Protobuf schemas in events.go with protowire, so
+// the events need no generated code. Fields with zero values are omitted as in
+// proto3.
+
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendDoubleField(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+// appendDoubleMapField encodes a map<string, double> field. Entries are sorted
+// by key so the encoding is deterministic.
+func appendDoubleMapField(b []byte, num protowire.Number, m map[string]float64) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry []byte
+		entry = appendStringField(entry, 1, k)
+		entry = appendDoubleField(entry, 2, m[k])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// protoField is a decoded field; value holds the raw bytes of length-delimited
+// fields and the bits of fixed64 fields.
+type protoField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	bytes []byte
+	bits  uint64
+}
+
+// consumeFields splits data into its fields. Fields of other wire types are
+// skipped so unknown fields added by newer schemas are ignored.
+func consumeFields(data []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(data)
+		case protowire.Fixed64Type:
+			f.bits, n = protowire.ConsumeFixed64(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// consumeDoubleMapEntry decodes an entry of a map<string, double> field into m.
+func consumeDoubleMapEntry(m map[string]float64, entry []byte) error {
+	fields, err := consumeFields(entry)
+	if err != nil {
+		return err
+	}
+
+	var key string
+	var value float64
+	for _, f := range fields {
+		switch {
+		case f.num == 1 && f.typ == protowire.BytesType:
+			key = string(f.bytes)
+		case f.num == 2 && f.typ == protowire.Fixed64Type:
+			value = math.Float64frombits(f.bits)
+		case f.num == 1 || f.num == 2:
+			return fmt.Errorf("map entry field %d has wire type %d", f.num, f.typ)
+		}
+	}
+	if math.IsNaN(value) {
+		return errors.New("map value is NaN")
+	}
+	m[key] = value
+	return nil
+}
@@ -0,0 +1,116 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/models"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ReplayOptions select the messages of the rebalance topic to replay.
+type ReplayOptions struct {
+	FromOffset int64           // first offset of every partition; ignored if Since is set
+	Since      time.Time       // first message time, if not zero
+	Until      time.Time       // last message time, if not zero
+	Users      map[string]bool // user IDs to replay; nil for every user
+}
+
+// ReplayedRequest is a rebalance request read back from the rebalance topic.
+type ReplayedRequest struct {
+	Partition int
+	Offset    int64
+	Time      time.Time
+	Envelope  Envelope
+	Request   models.RebalancePortfolioKafka
+}
+
+// errPartitionDone stops reading a partition without an error.
+var errPartitionDone = errors.New("partition done")
+
+// ReadRebalanceRequests passes the rebalance requests selected by opts to fn,
+// partition by partition in offset order, up to the last message at the time
+// of the call. Control messages and messages that cannot be decoded are logged
+// and skipped. It stops at the first error returned by fn. No offsets are committed.
+func ReadRebalanceRequests(ctx context.Context, opts ReplayOptions, fn func(ReplayedRequest) error) error {
+	cfg, err := connConfig()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Brokers) == 0 {
+		return fmt.Errorf("KAFKA_BROKERS must be set")
+	}
+	topic := RebalanceTopic()
+
+	conn, err := cfg.dial(ctx)
+	if err != nil {
+		return err
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read partitions of %s: %w", topic, err)
+	}
+
+	for _, p := range partitions {
+		err := readPartition(ctx, cfg, p, opts.startOffset, func(msg kafka.Message) error {
+			if !opts.Until.IsZero() && msg.Time.After(opts.Until) {
+				return errPartitionDone
+			}
+			if isControlMessage(msg) {
+				return nil
+			}
+
+			env, req, err := decodeRebalanceRequest(ctx, msg)
+			if err != nil {
+				slog.WarnContext(ctx, "Skipping message that cannot be decoded", logging.KeyPartition, msg.Partition, logging.KeyOffset, msg.Offset, logging.Err(err))
+				return nil
+			}
+			if opts.Users != nil && !opts.Users[req.UserID] {
+				return nil
+			}
+			return fn(ReplayedRequest{
+				Partition: msg.Partition,
+				Offset:    msg.Offset,
+				Time:      msg.Time,
+				Envelope:  env,
+				Request:   req,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startOffset returns the offset to replay a partition from: the first message
+// at or after Since, or FromOffset, within the offsets still in the partition.
+func (o ReplayOptions) startOffset(conn *kafka.Conn, first, last int64) (int64, error) {
+	offset := o.FromOffset
+	if !o.Since.IsZero() {
+		var err error
+		if offset, err = conn.ReadOffset(o.Since); err != nil {
+			return 0, err
+		}
+		if offset < 0 {
+			// No message at or after Since
+			offset = last
+		}
+	}
+	return min(max(offset, first), last), nil
+}
+
+// Reprocess processes a replayed request again, without the allocation hash
+// check, and publishes its results if publish is set. The transactions saved
+// for the request before are replaced; requests published before message IDs
+// were introduced cannot be matched to them, so theirs are kept.
+func (c *RebalanceConsumer) Reprocess(ctx context.Context, r ReplayedRequest, publish bool) error {
+	_, err := c.process(ctx, r.Envelope, r.Request, processOptions{force: true, replace: true, silent: !publish})
+	return err
+}
@@ -0,0 +1,28 @@
+package kafka
+
+import "testing"
+
+func TestReplayOptions_StartOffset(t *testing.T) {
+	tests := []struct {
+		name       string
+		fromOffset int64
+		want       int64
+	}{
+		{name: "From the beginning", fromOffset: 0, want: 10},
+		{name: "Within the partition", fromOffset: 15, want: 15},
+		{name: "Before the first offset", fromOffset: 5, want: 10},
+		{name: "After the last offset", fromOffset: 30, want: 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReplayOptions{FromOffset: tt.fromOffset}.startOffset(nil, 10, 20)
+			if err != nil {
+				t.Fatalf("startOffset() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("startOffset() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers added to messages that failed processing and were sent to a retry
+// or dead-letter topic.
+const (
+	HeaderErrorReason       = "X-Error-Reason"       // error returned by the last attempt
+	HeaderAttempt           = "X-Attempt"            // number of failed processing attempts
+	HeaderOriginalTopic     = "X-Original-Topic"     // topic the message was first published to
+	HeaderOriginalPartition = "X-Original-Partition" // partition the message was first published to
+	HeaderOriginalOffset    = "X-Original-Offset"    // offset the message was first published at
+	HeaderRetryAt           = "X-Retry-At"           // RFC 3339 time before which a retry is not processed
+	HeaderFailedAt          = "X-Failed-At"          // RFC 3339 time of the last failed attempt
+)
+
+// failureHeaders are the headers set by failureMessage. They are dropped when a
+// dead-lettered message is replayed to the main topic.
+var failureHeaders = []string{
+	HeaderErrorReason,
+	HeaderAttempt,
+	HeaderOriginalTopic,
+	HeaderOriginalPartition,
+	HeaderOriginalOffset,
+	HeaderRetryAt,
+	HeaderFailedAt,
+}
+
+// DefaultRetryDelays are the retry tiers used when KAFKA_RETRY_DELAYS is not set.
+const DefaultRetryDelays = "1m,10m"
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not retryable. A handler returns a permanent error for
+// messages that can never succeed, such as invalid payloads, so they are sent to
+// the dead-letter topic without going through the retry topics.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// retryTier is a retry topic whose messages are processed delay after they failed.
+type retryTier struct {
+	topic string
+	delay time.Duration
+}
+
+// retryTiers returns the retry topics of topic configured by KAFKA_RETRY_DELAYS,
+// a comma separated list of delays such as "1m,10m" that creates the topics
+// <topic>.retry.1m and <topic>.retry.10m. Set it to "none" to dead-letter
+// failed messages immediately.
+func retryTiers(topic string) ([]retryTier, error) {
+	spec := os.Getenv("KAFKA_RETRY_DELAYS")
+	if spec == "" {
+		spec = DefaultRetryDelays
+	}
+	return parseRetryTiers(topic, spec)
+}
+
+func parseRetryTiers(topic, spec string) ([]retryTier, error) {
+	if strings.TrimSpace(spec) == "none" {
+		return nil, nil
+	}
+
+	var tiers []retryTier
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid retry delay %q", s)
+		}
+		tiers = append(tiers, retryTier{topic: topic + ".retry." + s, delay: d})
+	}
+	return tiers, nil
+}
+
+// attempts returns the number of failed processing attempts recorded on msg.
+func attempts(msg kafka.Message) int {
+	n, _ := strconv.Atoi(headerCarrier{&msg.Headers}.Get(HeaderAttempt))
+	return n
+}
+
+// failureMessage returns a copy of msg recording the failed attempt, to be written
+// to a retry or dead-letter topic. The key, value and existing headers are kept,
+// and the original position is only set on the first failure so it always points
+// at the message as it was published. A zero retryAt omits the retry header.
+func failureMessage(msg kafka.Message, reason error, attempt int, failedAt, retryAt time.Time) kafka.Message {
+	out := kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: append([]kafka.Header(nil), msg.Headers...),
+	}
+
+	h := headerCarrier{&out.Headers}
+	if h.Get(HeaderOriginalTopic) == "" {
+		h.Set(HeaderOriginalTopic, msg.Topic)
+		h.Set(HeaderOriginalPartition, strconv.Itoa(msg.Partition))
+		h.Set(HeaderOriginalOffset, strconv.FormatInt(msg.Offset, 10))
+	}
+	h.Set(HeaderErrorReason, reason.Error())
+	h.Set(HeaderAttempt, strconv.Itoa(attempt))
+	h.Set(HeaderFailedAt, failedAt.UTC().Format(time.RFC3339Nano))
+	if retryAt.IsZero() {
+		h.Del(HeaderRetryAt)
+	} else {
+		h.Set(HeaderRetryAt, retryAt.UTC().Format(time.RFC3339Nano))
+	}
+	return out
+}
+
+// retryDue returns when a message read from a retry topic may be processed.
+// Messages without a valid header are processed immediately.
+func retryDue(msg kafka.Message) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, headerCarrier{&msg.Headers}.Get(HeaderRetryAt))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestParseRetryTiers(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       string
+		wantTopics []string
+		wantErr    bool
+	}{
+		{"Default tiers", DefaultRetryDelays, []string{"rebalance.retry.1m", "rebalance.retry.10m"}, false},
+		{"Whitespace", " 30s , 5m ", []string{"rebalance.retry.30s", "rebalance.retry.5m"}, false},
+		{"Disabled", "none", nil, false},
+		{"Invalid delay", "1m,soon", nil, true},
+		{"Negative delay", "-1m", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiers, err := parseRetryTiers("rebalance", tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRetryTiers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(tiers) != len(tt.wantTopics) {
+				t.Fatalf("expected %d tiers, got %d", len(tt.wantTopics), len(tiers))
+			}
+			for i, tier := range tiers {
+				if tier.topic != tt.wantTopics[i] {
+					t.Errorf("tier %d: expected topic %s, got %s", i, tt.wantTopics[i], tier.topic)
+				}
+			}
+		})
+	}
+}
+
+func TestFailureMessage(t *testing.T) {
+	failedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := kafka.Message{
+		Topic:     "rebalance",
+		Partition: 2,
+		Offset:    42,
+		Key:       []byte("user1"),
+		Value:     []byte(`{"user_id":"user1"}`),
+		Headers:   []kafka.Header{{Key: HeaderCorrelationID, Value: []byte("corr-1")}},
+	}
+
+	retry := failureMessage(msg, errors.New("timeout"), 1, failedAt, failedAt.Add(time.Minute))
+
+	if string(retry.Key) != "user1" || string(retry.Value) != string(msg.Value) {
+		t.Errorf("expected key and value to be kept, got %q %q", retry.Key, retry.Value)
+	}
+	if len(msg.Headers) != 1 {
+		t.Errorf("expected source message headers to be unchanged, got %d", len(msg.Headers))
+	}
+
+	h := headerCarrier{&retry.Headers}
+	for key, want := range map[string]string{
+		HeaderCorrelationID:     "corr-1",
+		HeaderErrorReason:       "timeout",
+		HeaderAttempt:           "1",
+		HeaderOriginalTopic:     "rebalance",
+		HeaderOriginalPartition: "2",
+		HeaderOriginalOffset:    "42",
+		HeaderFailedAt:          "2024-01-02T03:04:05Z",
+		HeaderRetryAt:           "2024-01-02T03:05:05Z",
+	} {
+		if got := h.Get(key); got != want {
+			t.Errorf("header %s = %q, want %q", key, got, want)
+		}
+	}
+	if got := retryDue(retry); !got.Equal(failedAt.Add(time.Minute)) {
+		t.Errorf("retryDue() = %v, want %v", got, failedAt.Add(time.Minute))
+	}
+
+	// A second failure read from the retry topic keeps the original position
+	retry.Topic, retry.Partition, retry.Offset = "rebalance.retry.1m", 0, 7
+	dead := failureMessage(retry, errors.New("still failing"), attempts(retry)+1, failedAt, time.Time{})
+
+	h = headerCarrier{&dead.Headers}
+	if got := h.Get(HeaderOriginalTopic) + "/" + h.Get(HeaderOriginalOffset); got != "rebalance/42" {
+		t.Errorf("expected original position rebalance/42, got %s", got)
+	}
+	if got := attempts(dead); got != 2 {
+		t.Errorf("expected 2 attempts, got %d", got)
+	}
+	if got := h.Get(HeaderErrorReason); got != "still failing" {
+		t.Errorf("expected latest reason, got %q", got)
+	}
+	if got := h.Get(HeaderRetryAt); got != "" {
+		t.Errorf("expected no retry time, got %q", got)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := fmt.Errorf("handler: %w", Permanent(errors.New("bad payload")))
+
+	if !IsPermanent(err) {
+		t.Error("expected wrapped permanent error to be permanent")
+	}
+	if IsPermanent(errors.New("timeout")) {
+		t.Error("expected plain error not to be permanent")
+	}
+	if Permanent(nil) != nil {
+		t.Error("expected Permanent(nil) to be nil")
+	}
+}
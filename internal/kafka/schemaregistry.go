@@ -0,0 +1,325 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schema types understood by the schema registry.
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+)
+
+// ErrIncompatibleSchema is returned by SchemaRegistry.Register when a schema is not
+// backward compatible with the latest schema registered under the subject.
+var ErrIncompatibleSchema = errors.New("schema is incompatible with the latest registered version")
+
+// Schema is a schema stored in the registry.
+type Schema struct {
+	Type   string `json:"schemaType,omitempty"`
+	Schema string `json:"schema"`
+}
+
+// SchemaRegistry stores the schemas that binary messages are encoded with.
+type SchemaRegistry interface {
+	// Register checks that schema is compatible with the latest version of subject,
+	// registers it and returns its ID. Registering an existing schema returns its ID.
+	Register(ctx context.Context, subject string, schema Schema) (int, error)
+	// Schema returns the schema with id.
+	Schema(ctx context.Context, id int) (Schema, error)
+}
+
+// NewSchemaRegistryFromEnv returns a client for the Confluent-compatible registry at
+// SCHEMA_REGISTRY_URL, with basic auth from SCHEMA_REGISTRY_USERNAME and
+// SCHEMA_REGISTRY_PASSWORD, or a file-backed registry at SCHEMA_REGISTRY_FILE.
+// It returns nil if neither is set.
+func NewSchemaRegistryFromEnv() (SchemaRegistry, error) {
+	if u := os.Getenv("SCHEMA_REGISTRY_URL"); u != "" {
+		return NewConfluentRegistry(u, os.Getenv("SCHEMA_REGISTRY_USERNAME"), os.Getenv("SCHEMA_REGISTRY_PASSWORD"))
+	}
+	if path := os.Getenv("SCHEMA_REGISTRY_FILE"); path != "" {
+		return NewFileRegistry(path)
+	}
+	return nil, nil
+}
+
+// ConfluentRegistry is a client for the Confluent Schema Registry REST API.
+type ConfluentRegistry struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+}
+
+// NewConfluentRegistry creates a client for the registry at baseURL.
+func NewConfluentRegistry(baseURL, username, password string) (*ConfluentRegistry, error) {
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid schema registry URL: %w", err)
+	}
+	return &ConfluentRegistry{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		username: username,
+		password: password,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// registryError is the error body returned by the registry.
+type registryError struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+// Error codes returned by the registry.
+const (
+	registrySubjectNotFound = 40401
+	registryVersionNotFound = 40402
+)
+
+func (r *ConfluentRegistry) do(ctx context.Context, method, path string, body, out interface{}) (int, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e registryError
+		json.NewDecoder(resp.Body).Decode(&e)
+		return e.ErrorCode, fmt.Errorf("schema registry returned %s: %s", resp.Status, e.Message)
+	}
+	return 0, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Register checks compatibility against the latest version of subject and registers schema.
+func (r *ConfluentRegistry) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	if schema.Type == SchemaTypeAvro {
+		schema.Type = "" // the registry's default; omitted for compatibility with older versions
+	}
+	path := "/subjects/" + url.PathEscape(subject) + "/versions"
+
+	var compat struct {
+		IsCompatible bool `json:"is_compatible"`
+	}
+	code, err := r.do(ctx, http.MethodPost, "/compatibility"+path+"/latest", schema, &compat)
+	switch {
+	case code == registrySubjectNotFound || code == registryVersionNotFound:
+		// First schema of the subject
+	case err != nil:
+		return 0, err
+	case !compat.IsCompatible:
+		return 0, fmt.Errorf("subject %s: %w", subject, ErrIncompatibleSchema)
+	}
+
+	var registered struct {
+		ID int `json:"id"`
+	}
+	if _, err := r.do(ctx, http.MethodPost, path, schema, &registered); err != nil {
+		return 0, err
+	}
+	return registered.ID, nil
+}
+
+// Schema returns the schema with id.
+func (r *ConfluentRegistry) Schema(ctx context.Context, id int) (Schema, error) {
+	var schema Schema
+	if _, err := r.do(ctx, http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &schema); err != nil {
+		return Schema{}, err
+	}
+	if schema.Type == "" {
+		schema.Type = SchemaTypeAvro
+	}
+	return schema, nil
+}
+
+// FileRegistry is a schema registry stored in a local JSON file, for development
+// and tests. Its compatibility check is a basic backward check: Avro records may
+// only add fields with a default, and the fields of a single-message Protobuf
+// schema may not change type.
+type FileRegistry struct {
+	mu   sync.Mutex
+	path string
+	data fileRegistryData
+}
+
+type fileRegistryData struct {
+	Subjects map[string][]registeredSchema `json:"subjects"`
+}
+
+type registeredSchema struct {
+	ID int `json:"id"`
+	Schema
+}
+
+// NewFileRegistry opens the registry stored at path, which is created on the
+// first registration if it does not exist.
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	r := &FileRegistry{path: path, data: fileRegistryData{Subjects: make(map[string][]registeredSchema)}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema registry file: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.data); err != nil {
+		return nil, fmt.Errorf("failed to parse schema registry file: %w", err)
+	}
+	if r.data.Subjects == nil {
+		r.data.Subjects = make(map[string][]registeredSchema)
+	}
+	return r, nil
+}
+
+// Register checks compatibility against the latest version of subject and registers schema.
+func (r *FileRegistry) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := r.data.Subjects[subject]
+	for _, v := range versions {
+		if v.Schema == schema {
+			return v.ID, nil
+		}
+	}
+	if len(versions) > 0 {
+		if err := checkCompatible(versions[len(versions)-1].Schema, schema); err != nil {
+			return 0, fmt.Errorf("subject %s: %w: %v", subject, ErrIncompatibleSchema, err)
+		}
+	}
+
+	id := r.nextID()
+	r.data.Subjects[subject] = append(versions, registeredSchema{ID: id, Schema: schema})
+
+	data, err := json.MarshalIndent(r.data, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(r.path, data, 0o644); err != nil {
+		return 0, fmt.Errorf("failed to write schema registry file: %w", err)
+	}
+	return id, nil
+}
+
+// Schema returns the schema with id.
+func (r *FileRegistry) Schema(ctx context.Context, id int) (Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, versions := range r.data.Subjects {
+		for _, v := range versions {
+			if v.ID == id {
+				return v.Schema, nil
+			}
+		}
+	}
+	return Schema{}, fmt.Errorf("schema %d not found", id)
+}
+
+func (r *FileRegistry) nextID() int {
+	max := 0
+	for _, versions := range r.data.Subjects {
+		for _, v := range versions {
+			if v.ID > max {
+				max = v.ID
+			}
+		}
+	}
+	return max + 1
+}
+
+// checkCompatible reports whether data written with prev can be read with next.
+func checkCompatible(prev, next Schema) error {
+	if prev.Type != next.Type {
+		return fmt.Errorf("schema type changed from %s to %s", prev.Type, next.Type)
+	}
+	switch next.Type {
+	case SchemaTypeAvro:
+		return checkAvroCompatible(prev.Schema, next.Schema)
+	case SchemaTypeProtobuf:
+		return checkProtobufCompatible(prev.Schema, next.Schema)
+	default:
+		return fmt.Errorf("unsupported schema type %q", next.Type)
+	}
+}
+
+type avroRecord struct {
+	Fields []struct {
+		Name    string          `json:"name"`
+		Type    json.RawMessage `json:"type"`
+		Default json.RawMessage `json:"default"`
+	} `json:"fields"`
+}
+
+func checkAvroCompatible(prev, next string) error {
+	var p, n avroRecord
+	if err := json.Unmarshal([]byte(prev), &p); err != nil {
+		return fmt.Errorf("invalid Avro schema: %w", err)
+	}
+	if err := json.Unmarshal([]byte(next), &n); err != nil {
+		return fmt.Errorf("invalid Avro schema: %w", err)
+	}
+
+	prevTypes := make(map[string]string, len(p.Fields))
+	for _, f := range p.Fields {
+		prevTypes[f.Name] = string(f.Type)
+	}
+	for _, f := range n.Fields {
+		typ, ok := prevTypes[f.Name]
+		if !ok && f.Default == nil {
+			return fmt.Errorf("field %q was added without a default", f.Name)
+		}
+		if ok && typ != string(f.Type) {
+			return fmt.Errorf("type of field %q changed", f.Name)
+		}
+	}
+	return nil
+}
+
+var protoFieldPattern = regexp.MustCompile(`(?m)^\s*(?:repeated\s+|optional\s+)?([\w.]+|map\s*<[^>]+>)\s+\w+\s*=\s*(\d+)\s*;`)
+
+func checkProtobufCompatible(prev, next string) error {
+	prevTypes := make(map[string]string)
+	for _, m := range protoFieldPattern.FindAllStringSubmatch(prev, -1) {
+		prevTypes[m[2]] = strings.Join(strings.Fields(m[1]), "")
+	}
+	for _, m := range protoFieldPattern.FindAllStringSubmatch(next, -1) {
+		if typ, ok := prevTypes[m[2]]; ok && typ != strings.Join(strings.Fields(m[1]), "") {
+			return fmt.Errorf("type of field %s changed", m[2])
+		}
+	}
+	return nil
+}
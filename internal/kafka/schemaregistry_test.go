@@ -0,0 +1,128 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	ctx := context.Background()
+
+	r, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("NewFileRegistry() error = %v", err)
+	}
+
+	v1 := Schema{Type: SchemaTypeAvro, Schema: `{"type":"record","name":"R","fields":[{"name":"a","type":"string"}]}`}
+	id, err := r.Register(ctx, "rebalance-value", v1)
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+	if again, _ := r.Register(ctx, "rebalance-value", v1); again != id {
+		t.Errorf("expected registering the same schema to return %d, got %d", id, again)
+	}
+
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr bool
+	}{
+		{"Field with default", `{"type":"record","name":"R","fields":[{"name":"a","type":"string"},{"name":"b","type":"int","default":0}]}`, false},
+		{"Field without default", `{"type":"record","name":"R","fields":[{"name":"a","type":"string"},{"name":"c","type":"int"}]}`, true},
+		{"Changed type", `{"type":"record","name":"R","fields":[{"name":"a","type":"int"}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := r.Register(ctx, "rebalance-value", Schema{Type: SchemaTypeAvro, Schema: tt.schema})
+			if tt.wantErr && !errors.Is(err, ErrIncompatibleSchema) {
+				t.Errorf("expected ErrIncompatibleSchema, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Register() error = %v", err)
+			}
+		})
+	}
+
+	// Schemas survive reopening the file
+	reopened, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatalf("NewFileRegistry() error = %v", err)
+	}
+	if got, err := reopened.Schema(ctx, id); err != nil || got != v1 {
+		t.Errorf("Schema(%d) = %+v, %v", id, got, err)
+	}
+}
+
+func TestCheckProtobufCompatible(t *testing.T) {
+	prev := "message R {\n  string user_id = 1;\n  map<string, double> alloc = 2;\n}"
+
+	if err := checkProtobufCompatible(prev, "message R {\n  string user_id = 1;\n  map<string,double> alloc = 2;\n  int64 at = 3;\n}"); err != nil {
+		t.Errorf("expected added field to be compatible, got %v", err)
+	}
+	if err := checkProtobufCompatible(prev, "message R {\n  int64 user_id = 1;\n}"); err == nil {
+		t.Error("expected changed field type to be incompatible")
+	}
+}
+
+func TestConfluentRegistry(t *testing.T) {
+	var registered []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "key" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/compatibility/subjects/new-value/versions/latest":
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(registryError{ErrorCode: registrySubjectNotFound, Message: "Subject not found"})
+		case r.Method == http.MethodPost && r.URL.Path == "/compatibility/subjects/old-value/versions/latest":
+			json.NewEncoder(w).Encode(map[string]bool{"is_compatible": false})
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/versions"):
+			var s Schema
+			json.NewDecoder(r.Body).Decode(&s)
+			registered = append(registered, s.Type)
+			json.NewEncoder(w).Encode(map[string]int{"id": 7})
+		case r.Method == http.MethodGet && r.URL.Path == "/schemas/ids/7":
+			json.NewEncoder(w).Encode(map[string]string{"schema": `"string"`})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(registryError{ErrorCode: 40403, Message: "Schema not found"})
+		}
+	}))
+	defer srv.Close()
+
+	r, err := NewConfluentRegistry(srv.URL+"/", "key", "secret")
+	if err != nil {
+		t.Fatalf("NewConfluentRegistry() error = %v", err)
+	}
+	ctx := context.Background()
+
+	id, err := r.Register(ctx, "new-value", Schema{Type: SchemaTypeProtobuf, Schema: "syntax = \"proto3\";"})
+	if err != nil || id != 7 {
+		t.Fatalf("Register() = %d, %v", id, err)
+	}
+	if len(registered) != 1 || registered[0] != SchemaTypeProtobuf {
+		t.Errorf("expected PROTOBUF schema to be registered, got %v", registered)
+	}
+
+	if _, err := r.Register(ctx, "old-value", Schema{Type: SchemaTypeAvro, Schema: `"int"`}); !errors.Is(err, ErrIncompatibleSchema) {
+		t.Errorf("expected ErrIncompatibleSchema, got %v", err)
+	}
+
+	schema, err := r.Schema(ctx, 7)
+	if err != nil || schema.Type != SchemaTypeAvro || schema.Schema != `"string"` {
+		t.Errorf("Schema(7) = %+v, %v", schema, err)
+	}
+	if _, err := r.Schema(ctx, 8); err == nil {
+		t.Error("expected error for unknown schema")
+	}
+}
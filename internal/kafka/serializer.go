@@ -0,0 +1,440 @@
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+)
+
+// HeaderContentType records the serializer a message value was encoded with.
+// Messages without it are JSON.
+const HeaderContentType = "Content-Type"
+
+// Serialization formats, selected per topic with KAFKA_SERIALIZERS.
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// Content types of the serialization formats.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeAvro     = "application/avro"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// ErrSerializerUnavailable is returned by DecodeMessage when the serializer or
+// schema of a message is not available, as opposed to a malformed message. It
+// may succeed once the configuration or the schema registry is fixed.
+var ErrSerializerUnavailable = errors.New("serializer unavailable")
+
+// Serializer encodes envelopes into message values.
+//
+// The JSON serializer writes the whole envelope as JSON. The binary serializers
+// write only the payload, in the Confluent wire format with the ID of its schema
+// in the registry, and carry the envelope metadata in the message headers.
+type Serializer interface {
+	// ContentType identifies the encoding in the Content-Type header.
+	ContentType() string
+	// Encode returns the message value for env published to topic.
+	Encode(ctx context.Context, topic string, env Envelope) ([]byte, error)
+	// Decode returns the envelope of msg, with the payload as JSON.
+	Decode(ctx context.Context, msg kafka.Message) (Envelope, error)
+}
+
+var (
+	serializersMu sync.RWMutex
+	topicFormats  map[string]string        // topic -> format; "*" is the default
+	serializers   = map[string]Serializer{ // content type -> serializer
+		ContentTypeJSON: JSONSerializer{},
+	}
+)
+
+// ConfigureSerializers selects the serializer of each topic from KAFKA_SERIALIZERS,
+// a comma separated list of topic=format pairs such as "rebalance=avro". The topic
+// "*" sets the default; topics that are not listed use JSON. The binary formats
+// require a schema registry (see NewSchemaRegistryFromEnv). Messages are decoded
+// by their Content-Type header, so a topic can be switched to another format
+// while it still contains messages in the previous one.
+func ConfigureSerializers() error {
+	formats, err := parseSerializers(os.Getenv("KAFKA_SERIALIZERS"))
+	if err != nil {
+		return err
+	}
+
+	registry, err := NewSchemaRegistryFromEnv()
+	if err != nil {
+		return err
+	}
+
+	configured := map[string]Serializer{ContentTypeJSON: JSONSerializer{}}
+	if registry != nil {
+		cache := newSchemaCache(registry)
+		configured[ContentTypeAvro] = &AvroSerializer{schemas: cache}
+		configured[ContentTypeProtobuf] = &ProtobufSerializer{schemas: cache}
+	}
+	for topic, format := range formats {
+		if format != FormatJSON && registry == nil {
+			return fmt.Errorf("serializer %s for topic %s requires SCHEMA_REGISTRY_URL or SCHEMA_REGISTRY_FILE", format, topic)
+		}
+	}
+
+	serializersMu.Lock()
+	defer serializersMu.Unlock()
+	topicFormats = formats
+	serializers = configured
+	return nil
+}
+
+func parseSerializers(spec string) (map[string]string, error) {
+	formats := make(map[string]string)
+	if strings.TrimSpace(spec) == "" {
+		return formats, nil
+	}
+
+	for _, pair := range strings.Split(spec, ",") {
+		topic, format, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		topic, format = strings.TrimSpace(topic), strings.TrimSpace(format)
+		if !ok || topic == "" {
+			return nil, fmt.Errorf("invalid serializer config %q, expected topic=format", pair)
+		}
+		switch format {
+		case FormatJSON, FormatAvro, FormatProtobuf:
+			formats[topic] = format
+		default:
+			return nil, fmt.Errorf("unknown serializer %q for topic %s", format, topic)
+		}
+	}
+	return formats, nil
+}
+
+// serializerFor returns the serializer configured for topic.
+func serializerFor(topic string) Serializer {
+	serializersMu.RLock()
+	defer serializersMu.RUnlock()
+
+	format, ok := topicFormats[topic]
+	if !ok {
+		format = topicFormats["*"]
+	}
+	switch format {
+	case FormatAvro:
+		return serializers[ContentTypeAvro]
+	case FormatProtobuf:
+		return serializers[ContentTypeProtobuf]
+	default:
+		return serializers[ContentTypeJSON]
+	}
+}
+
+// encodeMessage encodes env for topic with the serializer of the topic. The
+// envelope metadata and content type are set as headers for every format.
+func encodeMessage(ctx context.Context, topic, key string, env Envelope) (kafka.Message, error) {
+	s := serializerFor(topic)
+	value, err := s.Encode(ctx, topic, env)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	msg := kafka.Message{Key: []byte(key), Value: value}
+	h := headerCarrier{&msg.Headers}
+	h.Set(HeaderContentType, s.ContentType())
+	h.Set(HeaderEventType, env.EventType)
+	h.Set(HeaderSchemaVersion, strconv.Itoa(env.SchemaVersion))
+	h.Set(HeaderMessageID, env.MessageID)
+	h.Set(HeaderProducer, env.Producer)
+	h.Set(HeaderProducedAt, env.ProducedAt.UTC().Format(time.RFC3339Nano))
+	return msg, nil
+}
+
+// DecodeMessage returns the envelope of msg using the serializer named by its
+// Content-Type header. The payload of the returned envelope is always JSON.
+func DecodeMessage(ctx context.Context, msg kafka.Message) (Envelope, error) {
+	contentType := headerCarrier{&msg.Headers}.Get(HeaderContentType)
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	serializersMu.RLock()
+	s, ok := serializers[contentType]
+	serializersMu.RUnlock()
+	if !ok {
+		return Envelope{}, fmt.Errorf("no serializer configured for content type %q: %w", contentType, ErrSerializerUnavailable)
+	}
+	return s.Decode(ctx, msg)
+}
+
+// JSONSerializer writes the envelope as JSON.
+type JSONSerializer struct{}
+
+func (JSONSerializer) ContentType() string { return ContentTypeJSON }
+
+func (JSONSerializer) Encode(ctx context.Context, topic string, env Envelope) ([]byte, error) {
+	value, err := json.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal envelope: %w", err)
+	}
+	return value, nil
+}
+
+func (JSONSerializer) Decode(ctx context.Context, msg kafka.Message) (Envelope, error) {
+	return DecodeEnvelope(msg.Value)
+}
+
+// AvroSerializer writes the payload in Avro binary encoding.
+type AvroSerializer struct {
+	schemas *schemaCache
+}
+
+func (s *AvroSerializer) ContentType() string { return ContentTypeAvro }
+
+func (s *AvroSerializer) Encode(ctx context.Context, topic string, env Envelope) ([]byte, error) {
+	es, err := lookupEventSchema(env)
+	if err != nil {
+		return nil, err
+	}
+	schema := Schema{Type: SchemaTypeAvro, Schema: es.avro}
+	id, err := s.schemas.id(ctx, topic+"-value", schema)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := s.schemas.avroCodec(schema.Schema)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := codec.NativeFromTextual(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload does not match %s Avro schema: %w", env.EventType, err)
+	}
+	return codec.BinaryFromNative(frame(id, nil), native)
+}
+
+func (s *AvroSerializer) Decode(ctx context.Context, msg kafka.Message) (Envelope, error) {
+	env, err := envelopeFromHeaders(msg)
+	if err != nil {
+		return Envelope{}, err
+	}
+	id, data, err := unframe(msg.Value)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	// Decode with the schema the message was written with; upcasters migrate
+	// the payload to the current version afterwards.
+	schema, err := s.schemas.schema(ctx, id)
+	if err != nil {
+		return Envelope{}, err
+	}
+	codec, err := s.schemas.avroCodec(schema.Schema)
+	if err != nil {
+		return Envelope{}, err
+	}
+	native, _, err := codec.NativeFromBinary(data)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("failed to decode Avro payload: %w", err)
+	}
+	if env.Payload, err = codec.TextualFromNative(nil, native); err != nil {
+		return Envelope{}, err
+	}
+	return env, nil
+}
+
+// ProtobufSerializer writes the payload in Protobuf binary encoding.
+type ProtobufSerializer struct {
+	schemas *schemaCache
+}
+
+func (s *ProtobufSerializer) ContentType() string { return ContentTypeProtobuf }
+
+func (s *ProtobufSerializer) Encode(ctx context.Context, topic string, env Envelope) ([]byte, error) {
+	es, err := lookupEventSchema(env)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.schemas.id(ctx, topic+"-value", Schema{Type: SchemaTypeProtobuf, Schema: es.proto})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := es.protoMarshal(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s payload: %w", env.EventType, err)
+	}
+	// The message index [0] selects the first message of the schema
+	return append(frame(id, []byte{0}), data...), nil
+}
+
+func (s *ProtobufSerializer) Decode(ctx context.Context, msg kafka.Message) (Envelope, error) {
+	env, err := envelopeFromHeaders(msg)
+	if err != nil {
+		return Envelope{}, err
+	}
+	id, data, err := unframe(msg.Value)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if _, err := s.schemas.schema(ctx, id); err != nil {
+		return Envelope{}, err
+	}
+	if data, err = skipMessageIndexes(data); err != nil {
+		return Envelope{}, err
+	}
+
+	// Protobuf messages are not self-describing, so the payload is decoded with
+	// the local definition of the version named in the headers.
+	es, err := lookupEventSchema(env)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if env.Payload, err = es.protoUnmarshal(data); err != nil {
+		return Envelope{}, fmt.Errorf("failed to decode Protobuf payload: %w", err)
+	}
+	return env, nil
+}
+
+// envelopeFromHeaders returns the envelope metadata carried in the headers of a
+// binary message.
+func envelopeFromHeaders(msg kafka.Message) (Envelope, error) {
+	h := headerCarrier{&msg.Headers}
+	version, err := strconv.Atoi(h.Get(HeaderSchemaVersion))
+	if err != nil {
+		return Envelope{}, fmt.Errorf("invalid %s header: %w", HeaderSchemaVersion, err)
+	}
+	env := Envelope{
+		EventType:     h.Get(HeaderEventType),
+		SchemaVersion: version,
+		MessageID:     h.Get(HeaderMessageID),
+		Producer:      h.Get(HeaderProducer),
+	}
+	if env.EventType == "" {
+		return Envelope{}, fmt.Errorf("missing %s header", HeaderEventType)
+	}
+	if t := h.Get(HeaderProducedAt); t != "" {
+		if env.ProducedAt, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			return Envelope{}, fmt.Errorf("invalid %s header: %w", HeaderProducedAt, err)
+		}
+	}
+	return env, nil
+}
+
+// frame returns the Confluent wire format prefix: a zero magic byte, the schema
+// ID as a big-endian uint32 and, for Protobuf, the message indexes.
+func frame(id int, indexes []byte) []byte {
+	b := make([]byte, 5, 5+len(indexes))
+	binary.BigEndian.PutUint32(b[1:], uint32(id))
+	return append(b, indexes...)
+}
+
+func unframe(value []byte) (int, []byte, error) {
+	if len(value) < 5 || value[0] != 0 {
+		return 0, nil, errors.New("value is not in the schema registry wire format")
+	}
+	return int(binary.BigEndian.Uint32(value[1:5])), value[5:], nil
+}
+
+// skipMessageIndexes removes the Protobuf message indexes: a zigzag varint count
+// followed by that many indexes, with a count of 0 meaning [0].
+func skipMessageIndexes(data []byte) ([]byte, error) {
+	count, n := binary.Varint(data)
+	if n <= 0 || count < 0 {
+		return nil, errors.New("invalid Protobuf message indexes")
+	}
+	data = data[n:]
+	for i := int64(0); i < count; i++ {
+		if _, n = binary.Varint(data); n <= 0 {
+			return nil, errors.New("invalid Protobuf message indexes")
+		}
+		data = data[n:]
+	}
+	return data, nil
+}
+
+// schemaCache caches schema IDs and schemas from the registry, which never
+// change once registered.
+type schemaCache struct {
+	registry SchemaRegistry
+
+	mu      sync.Mutex
+	ids     map[string]int // subject + "\x00" + schema -> ID
+	schemas map[int]Schema
+	codecs  map[string]*goavro.Codec // Avro schema -> codec
+}
+
+func newSchemaCache(registry SchemaRegistry) *schemaCache {
+	return &schemaCache{
+		registry: registry,
+		ids:      make(map[string]int),
+		schemas:  make(map[int]Schema),
+		codecs:   make(map[string]*goavro.Codec),
+	}
+}
+
+// id registers schema under subject on first use and returns its ID.
+func (c *schemaCache) id(ctx context.Context, subject string, schema Schema) (int, error) {
+	key := subject + "\x00" + schema.Schema
+
+	c.mu.Lock()
+	id, ok := c.ids[key]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	id, err := c.registry.Register(ctx, subject, schema)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema for %s: %w", subject, err)
+	}
+
+	c.mu.Lock()
+	c.ids[key] = id
+	c.schemas[id] = schema
+	c.mu.Unlock()
+	return id, nil
+}
+
+// schema returns the schema with id.
+func (c *schemaCache) schema(ctx context.Context, id int) (Schema, error) {
+	c.mu.Lock()
+	schema, ok := c.schemas[id]
+	c.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	schema, err := c.registry.Schema(ctx, id)
+	if err != nil {
+		return Schema{}, fmt.Errorf("failed to fetch schema %d: %w: %w", id, ErrSerializerUnavailable, err)
+	}
+
+	c.mu.Lock()
+	c.schemas[id] = schema
+	c.mu.Unlock()
+	return schema, nil
+}
+
+func (c *schemaCache) avroCodec(schema string) (*goavro.Codec, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if codec, ok := c.codecs[schema]; ok {
+		return codec, nil
+	}
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %w", err)
+	}
+	c.codecs[schema] = codec
+	return codec, nil
+}
@@ -0,0 +1,172 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestSerializers_RoundTrip(t *testing.T) {
+	t.Setenv("SCHEMA_REGISTRY_URL", "")
+
+	for _, format := range []string{FormatJSON, FormatAvro, FormatProtobuf} {
+		t.Run(format, func(t *testing.T) {
+			t.Setenv("SCHEMA_REGISTRY_FILE", filepath.Join(t.TempDir(), "schemas.json"))
+			t.Setenv("KAFKA_SERIALIZERS", "rebalance="+format)
+			if err := ConfigureSerializers(); err != nil {
+				t.Fatalf("ConfigureSerializers() error = %v", err)
+			}
+			defer resetSerializers(t)
+
+			env, err := NewEnvelope(EventRebalanceRequested, RebalanceRequestedVersion, goldenRebalance)
+			if err != nil {
+				t.Fatalf("NewEnvelope() error = %v", err)
+			}
+			env.ProducedAt = env.ProducedAt.Truncate(time.Millisecond)
+
+			msg, err := encodeMessage(context.Background(), "rebalance", "user1", env)
+			if err != nil {
+				t.Fatalf("encodeMessage() error = %v", err)
+			}
+			if format != FormatJSON && msg.Value[0] != 0 {
+				t.Errorf("expected schema registry wire format, got magic byte %d", msg.Value[0])
+			}
+
+			got, err := DecodeMessage(context.Background(), msg)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v", err)
+			}
+			if got.EventType != env.EventType || got.SchemaVersion != env.SchemaVersion ||
+				got.MessageID != env.MessageID || !got.ProducedAt.Equal(env.ProducedAt) {
+				t.Errorf("expected envelope %+v, got %+v", env, got)
+			}
+
+			var payload models.RebalancePortfolioKafka
+			if err := json.Unmarshal(got.Payload, &payload); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(payload, goldenRebalance) {
+				t.Errorf("expected payload %+v, got %+v", goldenRebalance, payload)
+			}
+		})
+	}
+}
+
+func TestSerializers_RoundTripCompleted(t *testing.T) {
+	t.Setenv("SCHEMA_REGISTRY_URL", "")
+
+	completed := models.RebalanceCompleted{
+		UserID:    "user1",
+		RequestID: "0123456789abcdef0123456789abcdef",
+		Transactions: []models.RebalanceTransaction{
+			{UserID: "user1", Action: "SELL", Asset: "bonds", RebalancePercent: 10},
+			{UserID: "user1", Action: "BUY", Asset: "stocks", RebalancePercent: 10},
+		},
+	}
+
+	for _, format := range []string{FormatJSON, FormatAvro, FormatProtobuf} {
+		t.Run(format, func(t *testing.T) {
+			t.Setenv("SCHEMA_REGISTRY_FILE", filepath.Join(t.TempDir(), "schemas.json"))
+			t.Setenv("KAFKA_SERIALIZERS", "rebalance.completed="+format)
+			if err := ConfigureSerializers(); err != nil {
+				t.Fatalf("ConfigureSerializers() error = %v", err)
+			}
+			defer resetSerializers(t)
+
+			env, err := NewEnvelope(EventRebalanceCompleted, RebalanceCompletedVersion, completed)
+			if err != nil {
+				t.Fatalf("NewEnvelope() error = %v", err)
+			}
+			msg, err := encodeMessage(context.Background(), "rebalance.completed", "user1", env)
+			if err != nil {
+				t.Fatalf("encodeMessage() error = %v", err)
+			}
+			got, err := DecodeMessage(context.Background(), msg)
+			if err != nil {
+				t.Fatalf("DecodeMessage() error = %v", err)
+			}
+
+			var payload models.RebalanceCompleted
+			if err := json.Unmarshal(got.Payload, &payload); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(payload, completed) {
+				t.Errorf("expected payload %+v, got %+v", completed, payload)
+			}
+		})
+	}
+}
+
+func TestSerializers_RequireRegistry(t *testing.T) {
+	t.Setenv("SCHEMA_REGISTRY_URL", "")
+	t.Setenv("SCHEMA_REGISTRY_FILE", "")
+	t.Setenv("KAFKA_SERIALIZERS", "rebalance=avro")
+	defer resetSerializers(t)
+
+	if err := ConfigureSerializers(); err == nil {
+		t.Error("expected error for avro without a schema registry")
+	}
+
+	msg := kafka.Message{
+		Value:   []byte{0, 0, 0, 0, 1},
+		Headers: []kafka.Header{{Key: HeaderContentType, Value: []byte(ContentTypeAvro)}},
+	}
+	if _, err := DecodeMessage(context.Background(), msg); !errors.Is(err, ErrSerializerUnavailable) {
+		t.Errorf("expected ErrSerializerUnavailable, got %v", err)
+	}
+}
+
+func TestParseSerializers(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"rebalance=avro, *=protobuf", map[string]string{"rebalance": "avro", "*": "protobuf"}, false},
+		{"rebalance", nil, true},
+		{"rebalance=xml", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseSerializers(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSerializers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUnframe(t *testing.T) {
+	id, data, err := unframe(append(frame(42, nil), 'x'))
+	if err != nil || id != 42 || string(data) != "x" {
+		t.Errorf("unframe() = %d, %q, %v", id, data, err)
+	}
+
+	for _, value := range [][]byte{nil, []byte(`{"a":1}`), {0, 0, 1}} {
+		if _, _, err := unframe(value); err == nil {
+			t.Errorf("expected error for %v", value)
+		}
+	}
+}
+
+func resetSerializers(t *testing.T) {
+	t.Helper()
+	t.Setenv("KAFKA_SERIALIZERS", "")
+	t.Setenv("SCHEMA_REGISTRY_FILE", "")
+	if err := ConfigureSerializers(); err != nil {
+		t.Fatalf("ConfigureSerializers() error = %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package kafka
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Defaults for KAFKA_WORKERS and KAFKA_MAX_IN_FLIGHT.
+const (
+	DefaultWorkers     = 8
+	DefaultMaxInFlight = 64
+)
+
+// workerPool processes the messages of one reader concurrently. Messages are
+// dispatched to a worker by the hash of their key, the user ID, so messages for
+// the same user are processed one at a time in the order they were fetched.
+//
+// At most maxInFlight messages are dispatched but not yet processed; submit
+// blocks until a slot is free, which stops the reader fetching further ahead.
+type workerPool struct {
+	queues  []chan kafka.Message
+	slots   chan struct{}
+	process func(msg kafka.Message) error
+	commits *commitTracker
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	failOnce sync.Once
+	failed   chan struct{}
+	err      error // set before failed is closed
+}
+
+// newWorkerPool starts workers goroutines. If process returns an error the pool
+// stops processing, calls cancel and reports the error from close.
+func newWorkerPool(workers, maxInFlight int, process func(msg kafka.Message) error, commits *commitTracker, cancel context.CancelFunc) *workerPool {
+	p := &workerPool{
+		queues:  make([]chan kafka.Message, workers),
+		slots:   make(chan struct{}, maxInFlight),
+		process: process,
+		commits: commits,
+		cancel:  cancel,
+		failed:  make(chan struct{}),
+	}
+	for i := range p.queues {
+		// A queue never holds more than maxInFlight messages, so sends never block
+		p.queues[i] = make(chan kafka.Message, maxInFlight)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+// submit dispatches msg to its worker once a slot is free. It returns an error
+// if ctx is cancelled or the pool failed first.
+func (p *workerPool) submit(ctx context.Context, msg kafka.Message) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.failed:
+		return p.err
+	}
+
+	p.commits.add(msg)
+	metrics.KafkaMessagesInFlight.WithLabelValues(msg.Topic).Inc()
+	p.queues[p.worker(msg)] <- msg
+	return nil
+}
+
+// skip marks msg as processed without dispatching it, so its offset is
+// committed once the messages fetched before it are done.
+func (p *workerPool) skip(msg kafka.Message) {
+	p.commits.add(msg)
+	p.commits.done(msg)
+}
+
+// close waits for the dispatched messages to be processed and returns the
+// error that stopped the pool, if any.
+func (p *workerPool) close() error {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+
+	select {
+	case <-p.failed:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+func (p *workerPool) worker(msg kafka.Message) int {
+	if len(msg.Key) == 0 {
+		return msg.Partition % len(p.queues)
+	}
+	h := fnv.New32a()
+	h.Write(msg.Key)
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+func (p *workerPool) work(queue <-chan kafka.Message) {
+	defer p.wg.Done()
+	for msg := range queue {
+		select {
+		case <-p.failed:
+			// Neither processed nor committed, so it is redelivered after a restart
+		default:
+			if err := p.process(msg); err != nil {
+				p.fail(err)
+			} else {
+				p.commits.done(msg)
+			}
+		}
+		metrics.KafkaMessagesInFlight.WithLabelValues(msg.Topic).Dec()
+		<-p.slots
+	}
+}
+
+func (p *workerPool) fail(err error) {
+	p.failOnce.Do(func() {
+		p.err = err
+		close(p.failed)
+		p.cancel()
+	})
+}
+
+// commitTracker commits offsets in the order messages were fetched. Messages of
+// a partition can finish out of order when they have different keys; an offset
+// is committed only once every message fetched before it on the partition is
+// done, so a crash never skips an unprocessed message.
+type commitTracker struct {
+	mu      sync.Mutex
+	pending map[int][]trackedMessage // per partition, in fetch order
+	commit  func(msg kafka.Message) error
+}
+
+type trackedMessage struct {
+	msg  kafka.Message
+	done bool
+}
+
+func newCommitTracker(commit func(msg kafka.Message) error) *commitTracker {
+	return &commitTracker{pending: make(map[int][]trackedMessage), commit: commit}
+}
+
+// add records msg as fetched.
+func (t *commitTracker) add(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[msg.Partition] = append(t.pending[msg.Partition], trackedMessage{msg: msg})
+}
+
+// done marks msg as processed and commits the last offset of the partition
+// whose predecessors are all done.
+func (t *commitTracker) done(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := t.pending[msg.Partition]
+	for i := range pending {
+		if pending[i].msg.Offset == msg.Offset && !pending[i].done {
+			pending[i].done = true
+			break
+		}
+	}
+
+	n := 0
+	for n < len(pending) && pending[n].done {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	last := pending[n-1].msg
+	t.pending[msg.Partition] = pending[n:]
+
+	// Committed under the lock so commits of a partition are never reordered.
+	// A failed commit only means the messages are redelivered and caught by
+	// the idempotency check.
+	if err := t.commit(last); err != nil {
+		slog.Error("Failed to commit offset", logging.KeyTopic, last.Topic, logging.KeyPartition, last.Partition, logging.KeyOffset, last.Offset, logging.Err(err))
+	}
+}
@@ -0,0 +1,139 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestCommitTracker_CommitsInFetchOrder(t *testing.T) {
+	var committed []int64
+	tracker := newCommitTracker(func(msg kafka.Message) error {
+		committed = append(committed, msg.Offset)
+		return nil
+	})
+
+	msgs := []kafka.Message{{Offset: 1}, {Offset: 2}, {Offset: 3}, {Offset: 4}}
+	for _, m := range msgs {
+		tracker.add(m)
+	}
+
+	tracker.done(msgs[1]) // 1 still pending
+	tracker.done(msgs[3])
+	if len(committed) != 0 {
+		t.Fatalf("expected no commits before offset 1 is done, got %v", committed)
+	}
+
+	tracker.done(msgs[0]) // 1 and 2 are done, 3 is pending
+	tracker.done(msgs[2])
+
+	want := []int64{2, 4}
+	if len(committed) != len(want) || committed[0] != want[0] || committed[1] != want[1] {
+		t.Errorf("expected commits %v, got %v", want, committed)
+	}
+}
+
+func TestCommitTracker_PartitionsAreIndependent(t *testing.T) {
+	var committed []kafka.Message
+	tracker := newCommitTracker(func(msg kafka.Message) error {
+		committed = append(committed, msg)
+		return nil
+	})
+
+	a := kafka.Message{Partition: 0, Offset: 10}
+	b := kafka.Message{Partition: 1, Offset: 5}
+	tracker.add(a)
+	tracker.add(b)
+	tracker.done(b)
+
+	if len(committed) != 1 || committed[0].Partition != 1 || committed[0].Offset != 5 {
+		t.Errorf("expected partition 1 offset 5 to be committed, got %v", committed)
+	}
+}
+
+func TestWorkerPool_PreservesOrderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string][]int64)
+	var committed []int64
+
+	tracker := newCommitTracker(func(msg kafka.Message) error {
+		mu.Lock()
+		committed = append(committed, msg.Offset)
+		mu.Unlock()
+		return nil
+	})
+	pool := newWorkerPool(4, 8, func(msg kafka.Message) error {
+		// Slow down one user so the others overtake it
+		if string(msg.Key) == "slow" {
+			time.Sleep(time.Millisecond)
+		}
+		mu.Lock()
+		seen[string(msg.Key)] = append(seen[string(msg.Key)], msg.Offset)
+		mu.Unlock()
+		return nil
+	}, tracker, func() {})
+
+	keys := []string{"slow", "user1", "user2", "slow", "user1", "user2"}
+	for i := 0; i < 60; i++ {
+		msg := kafka.Message{Topic: "rebalance", Key: []byte(keys[i%len(keys)]), Offset: int64(i)}
+		if err := pool.submit(context.Background(), msg); err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+	}
+	if err := pool.close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	for key, offsets := range seen {
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Errorf("messages for %s processed out of order: %v", key, offsets)
+				break
+			}
+		}
+	}
+	if n := len(committed); n == 0 || committed[n-1] != 59 {
+		t.Errorf("expected last commit at offset 59, got %v", committed)
+	}
+	for i := 1; i < len(committed); i++ {
+		if committed[i] <= committed[i-1] {
+			t.Errorf("commits not in order: %v", committed)
+			break
+		}
+	}
+}
+
+func TestWorkerPool_FailureStopsCommits(t *testing.T) {
+	var committed []int64
+	tracker := newCommitTracker(func(msg kafka.Message) error {
+		committed = append(committed, msg.Offset)
+		return nil
+	})
+
+	cancelled := false
+	routeErr := errors.New("dead-letter topic unavailable")
+	pool := newWorkerPool(1, 4, func(msg kafka.Message) error {
+		if msg.Offset == 1 {
+			return routeErr
+		}
+		return nil
+	}, tracker, func() { cancelled = true })
+
+	for i := 0; i < 3; i++ {
+		pool.submit(context.Background(), kafka.Message{Topic: "rebalance", Key: []byte("user1"), Offset: int64(i)})
+	}
+
+	if err := pool.close(); !errors.Is(err, routeErr) {
+		t.Fatalf("expected %v, got %v", routeErr, err)
+	}
+	if !cancelled {
+		t.Error("expected the pool to cancel the reader")
+	}
+	if len(committed) != 1 || committed[0] != 0 {
+		t.Errorf("expected only offset 0 to be committed, got %v", committed)
+	}
+}
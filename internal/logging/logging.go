@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Field names shared by all log records.
+const (
+	KeyRequestID     = "request_id"
+	KeyCorrelationID = "correlation_id"
+	KeyUserID        = "user_id"
+	KeyJobID         = "job_id"
+	KeyPartition     = "kafka_partition"
+	KeyOffset        = "kafka_offset"
+	KeyTopic         = "kafka_topic"
+	KeyMessageID     = "message_id"
+	KeyError         = "error"
+)
+
+// Init installs a JSON logger at LOG_LEVEL (debug, info, warn, error; default info)
+// as the default slog logger. Output from the standard log package is routed
+// through it as well.
+func Init(service string) {
+	slog.SetDefault(New(os.Stdout, service, parseLevel(os.Getenv("LOG_LEVEL"))))
+}
+
+// New creates a JSON logger writing to w that adds the fields stored in the
+// context of each record.
+func New(w io.Writer, service string, level slog.Level) *slog.Logger {
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	return slog.New(contextHandler{h}).With("service", service)
+}
+
+func parseLevel(s string) slog.Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+type fieldsKey struct{}
+
+// With returns a copy of ctx whose log records carry the given key/value pairs
+// in addition to the fields already stored in ctx.
+func With(ctx context.Context, args ...any) context.Context {
+	existing, _ := ctx.Value(fieldsKey{}).([]slog.Attr)
+	fields := append(append([]slog.Attr(nil), existing...), argsToAttrs(args)...)
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+func argsToAttrs(args []any) []slog.Attr {
+	r := slog.Record{}
+	r.Add(args...)
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return attrs
+}
+
+type correlationKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the correlation ID, which is
+// also added to every log record written with ctx.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, correlationKey{}, id)
+	return With(ctx, KeyCorrelationID, id)
+}
+
+// CorrelationID returns the correlation ID stored in ctx.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// contextHandler adds the fields stored with With and the active trace to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if fields, ok := ctx.Value(fieldsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(fields...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Payload returns a log attribute for a message or request body. Payloads contain
+// user allocations and are redacted unless LOG_PAYLOADS=true.
+func Payload(body []byte) slog.Attr {
+	if os.Getenv("LOG_PAYLOADS") == "true" {
+		return slog.String("payload", string(body))
+	}
+	return slog.String("payload", fmt.Sprintf("[REDACTED %d bytes]", len(body)))
+}
+
+// Err returns a log attribute for err.
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+	return slog.String(KeyError, err.Error())
+}
+
+// Fatal logs msg at error level and exits the process.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestContextFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, "test-service", slog.LevelInfo)
+
+	ctx := WithCorrelationID(context.Background(), "corr-1")
+	ctx = With(ctx, KeyUserID, "user1", KeyPartition, 2)
+
+	logger.DebugContext(ctx, "hidden")
+	logger.InfoContext(ctx, "Processing rebalance")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single JSON record, got %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]interface{}{
+		"msg":            "Processing rebalance",
+		"level":          "INFO",
+		"service":        "test-service",
+		KeyCorrelationID: "corr-1",
+		KeyUserID:        "user1",
+		KeyPartition:     float64(2),
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("expected %s=%v, got %v", k, v, record[k])
+		}
+	}
+
+	if got := CorrelationID(ctx); got != "corr-1" {
+		t.Errorf("CorrelationID() = %q, want corr-1", got)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	body := []byte(`{"user_id":"1","new_allocation":{"stocks":70}}`)
+
+	t.Setenv("LOG_PAYLOADS", "")
+	if got := Payload(body).Value.String(); got != "[REDACTED 46 bytes]" {
+		t.Errorf("expected payload to be redacted by default, got %q", got)
+	}
+
+	t.Setenv("LOG_PAYLOADS", "true")
+	if got := Payload(body).Value.String(); got != string(body) {
+		t.Errorf("expected payload to be logged when enabled, got %q", got)
+	}
+}
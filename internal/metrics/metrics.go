@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Result label values shared by several metrics.
+const (
+	ResultSuccess  = "success"
+	ResultError    = "error"
+	ResultNotFound = "not_found"
+)
+
+// Consume result label values for KafkaMessagesConsumed.
+const (
+	ConsumeProcessed = "processed" // transactions calculated and saved
+	ConsumeDuplicate = "duplicate" // skipped by the AllocationHash idempotency check
+	ConsumeInvalid   = "invalid"   // not a valid rebalance message
+	ConsumeFailed    = "failed"    // processing failed
+	ConsumeControl   = "control"   // control message, skipped
+)
+
+var (
+	// HTTPRequests counts API requests.
+	// Labels: route (matched route pattern, "unmatched" otherwise), method, status (HTTP status code).
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebalancer_http_requests_total",
+		Help: "Total number of HTTP requests handled by the API.",
+	}, []string{"route", "method", "status"})
+
+	// HTTPRequestDuration observes API request latency in seconds.
+	// Labels: route, method, status (same as HTTPRequests).
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rebalancer_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests handled by the API.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// KafkaMessagesPublished counts messages written to Kafka.
+	// Labels: topic, result (success|error).
+	KafkaMessagesPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebalancer_kafka_messages_published_total",
+		Help: "Total number of messages published to Kafka.",
+	}, []string{"topic", "result"})
+
+	// KafkaMessagesConsumed counts messages read from Kafka by the consumer.
+	// Labels: topic, result (processed|duplicate|invalid|failed).
+	KafkaMessagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebalancer_kafka_messages_consumed_total",
+		Help: "Total number of messages consumed from Kafka.",
+	}, []string{"topic", "result"})
+
+	// KafkaConsumerLag is the number of messages the consumer is behind the end of the topic.
+	// Labels: topic.
+	KafkaConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rebalancer_kafka_consumer_lag",
+		Help: "Number of messages the consumer is behind the end of the topic.",
+	}, []string{"topic"})
+
+	// KafkaMessagesInFlight is the number of messages fetched by the consumer and
+	// waiting for or being processed by a worker.
+	// Labels: topic.
+	KafkaMessagesInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rebalancer_kafka_messages_in_flight",
+		Help: "Number of fetched messages waiting for or being processed by a worker.",
+	}, []string{"topic"})
+
+	// RebalanceProcessingDuration observes how long the consumer takes to process one
+	// rebalance message, including storage retries, in seconds.
+	RebalanceProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rebalancer_rebalance_processing_duration_seconds",
+		Help:    "Time taken to process a rebalance message.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+
+	// RebalanceDuplicatesSkipped counts rebalance messages skipped because the
+	// new allocation matches the stored AllocationHash or one in its history.
+	RebalanceDuplicatesSkipped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rebalancer_rebalance_duplicates_skipped_total",
+		Help: "Total number of rebalance messages skipped as duplicates.",
+	})
+
+	// RebalanceRequestConflicts counts rebalance requests checked again because
+	// the user's idempotency record changed between reading and saving it.
+	RebalanceRequestConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rebalancer_rebalance_request_conflicts_total",
+		Help: "Total number of conflicting updates of rebalance request records.",
+	})
+
+	// TransactionSaveRetries counts retry attempts made after a failed save of
+	// rebalance transactions (the first attempt is not counted).
+	TransactionSaveRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "rebalancer_transaction_save_retries_total",
+		Help: "Total number of retries when saving rebalance transactions.",
+	})
+
+	// OutboxRelayed counts outbox entries the relay attempted to publish.
+	// Labels: result (success|error).
+	OutboxRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebalancer_outbox_relayed_total",
+		Help: "Total number of outbox entries relayed to Kafka.",
+	}, []string{"result"})
+
+	// ElasticsearchRequestDuration observes Elasticsearch call latency in seconds.
+	// Labels: operation (e.g. save_portfolio, get_portfolio), result (success|not_found|error).
+	ElasticsearchRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rebalancer_elasticsearch_request_duration_seconds",
+		Help:    "Latency of Elasticsearch calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	// ElasticsearchErrors counts failed Elasticsearch calls.
+	// Labels: operation.
+	ElasticsearchErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebalancer_elasticsearch_errors_total",
+		Help: "Total number of failed Elasticsearch calls.",
+	}, []string{"operation"})
+
+	// PostgresQueryDuration observes PostgreSQL call latency in seconds.
+	// Labels: operation (e.g. save_portfolio, get_portfolio), result (success|not_found|error).
+	PostgresQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rebalancer_postgres_query_duration_seconds",
+		Help:    "Latency of PostgreSQL calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	// PostgresErrors counts failed PostgreSQL calls.
+	// Labels: operation.
+	PostgresErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebalancer_postgres_errors_total",
+		Help: "Total number of failed PostgreSQL calls.",
+	}, []string{"operation"})
+
+	// BoltOperationDuration observes the latency of embedded Bolt store calls in seconds.
+	// Labels: operation (e.g. save_portfolio, get_portfolio), result (success|not_found|error).
+	BoltOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rebalancer_bolt_operation_duration_seconds",
+		Help:    "Latency of embedded Bolt store calls.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	// BoltErrors counts failed embedded Bolt store calls.
+	// Labels: operation.
+	BoltErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rebalancer_bolt_errors_total",
+		Help: "Total number of failed embedded Bolt store calls.",
+	}, []string{"operation"})
+)
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveElasticsearch records the latency and result (success|not_found|error) of an Elasticsearch call.
+func ObserveElasticsearch(operation, result string, duration time.Duration) {
+	if result == ResultError {
+		ElasticsearchErrors.WithLabelValues(operation).Inc()
+	}
+	ElasticsearchRequestDuration.WithLabelValues(operation, result).Observe(duration.Seconds())
+}
+
+// ObservePostgres records the latency and result (success|not_found|error) of a PostgreSQL call.
+func ObservePostgres(operation, result string, duration time.Duration) {
+	if result == ResultError {
+		PostgresErrors.WithLabelValues(operation).Inc()
+	}
+	PostgresQueryDuration.WithLabelValues(operation, result).Observe(duration.Seconds())
+}
+
+// ObserveBolt records the latency and result (success|not_found|error) of an embedded Bolt store call.
+func ObserveBolt(operation, result string, duration time.Duration) {
+	if result == ResultError {
+		BoltErrors.WithLabelValues(operation).Inc()
+	}
+	BoltOperationDuration.WithLabelValues(operation, result).Observe(duration.Seconds())
+}
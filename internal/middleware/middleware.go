@@ -0,0 +1,294 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/router"
+	"portfolio-rebalancer/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Headers carrying the request and correlation IDs in both requests and responses.
+const (
+	HeaderRequestID     = "X-Request-ID"
+	HeaderCorrelationID = "X-Correlation-ID"
+)
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the request ID assigned by RequestID.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestID reuses the caller's X-Request-ID or generates a new one, and echoes it in the response.
+// The caller's X-Correlation-ID, or the request ID if there is none, becomes the correlation ID
+// that is passed on to Kafka. Both are added to every log record of the request.
+func RequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+
+		correlationID := r.Header.Get(HeaderCorrelationID)
+		if correlationID == "" || len(correlationID) > 128 {
+			correlationID = id
+		}
+
+		w.Header().Set(HeaderRequestID, id)
+		w.Header().Set(HeaderCorrelationID, correlationID)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = logging.With(ctx, logging.KeyRequestID, id)
+		ctx = logging.WithCorrelationID(ctx, correlationID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Recover turns a panic in the handler into a 500 response instead of dropping the connection.
+func Recover(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				slog.ErrorContext(r.Context(), "Panic serving request",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"panic", fmt.Sprint(rec),
+					"stack", string(debug.Stack()),
+				)
+				writeError(w, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+		next(w, r)
+	}
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// AccessLog logs method, path, status, size and latency of every request. Query
+// strings are not logged since they may contain user IDs of other users.
+func AccessLog(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		slog.InfoContext(r.Context(), "HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	}
+}
+
+// Metrics records request count and latency by route pattern, method and status.
+// It must run as global router middleware so unmatched requests are counted too.
+func Metrics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := router.Pattern(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(rec.status)
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, status).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Tracing starts a server span for every request, continuing the trace from the
+// caller's traceparent header if present. The span is named after the matched route.
+func Tracing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(ctx)
+
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if route := router.Pattern(r); route != "" {
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(rec.status),
+			attribute.String("http.request_id", RequestIDFromContext(r.Context())),
+		)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
+// CORS allows cross-origin requests from allowedOrigins ("*" allows any origin)
+// and answers preflight requests directly.
+func CORS(allowedOrigins []string) router.Middleware {
+	allowAll := false
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		if o == "*" {
+			allowAll = true
+		}
+		allowed[o] = true
+	}
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && (allowAll || allowed[origin]) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID, X-Correlation-ID, X-Provider-ID, X-Timestamp, X-Signature")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Correlation-ID, Deprecation, Link")
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// AllowedOrigins returns the comma separated CORS_ALLOWED_ORIGINS.
+func AllowedOrigins() []string {
+	var origins []string
+	for _, o := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// BodyLimit rejects request bodies larger than maxBytes.
+func BodyLimit(maxBytes int64) router.Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next(w, r)
+		}
+	}
+}
+
+// Timeout cancels the request context and responds with 503 if the handler runs longer than d.
+func Timeout(d time.Duration) router.Middleware {
+	body, _ := json.Marshal(models.APIResponse{
+		Success: false,
+		Message: "Request timed out",
+	})
+
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		h := http.TimeoutHandler(next, d, string(body))
+		return func(w http.ResponseWriter, r *http.Request) {
+			// Set here so the timeout response is also sent as JSON
+			w.Header().Set("Content-Type", "application/json")
+			h.ServeHTTP(w, r)
+		}
+	}
+}
+
+// Deprecated marks a route as deprecated in favour of the same path below successorPrefix.
+func Deprecated(successorPrefix string) router.Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", successorPrefix, r.URL.Path))
+			next(w, r)
+		}
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(models.APIResponse{
+		Success: false,
+		Message: message,
+	})
+}
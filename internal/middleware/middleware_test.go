@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/router"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	h(w, req)
+	if seen == "" || w.Header().Get(HeaderRequestID) != seen {
+		t.Errorf("expected generated request ID to be echoed, got %q and %q", seen, w.Header().Get(HeaderRequestID))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderRequestID, "abc")
+	w = httptest.NewRecorder()
+	h(w, req)
+	if seen != "abc" {
+		t.Errorf("expected caller request ID to be reused, got %q", seen)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := Recover(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	h := BodyLimit(4)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too long")))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	h := Timeout(10 * time.Millisecond)(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON timeout response, got %q", ct)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	h := CORS([]string{"https://app.example.com"})(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodOptions, "/v1/portfolio", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	h(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Expected allowed origin, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/portfolio", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	h(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected no CORS headers for unknown origin, got %q", got)
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	h := Deprecated("/v1")(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodPost, "/rebalance", nil))
+
+	if w.Header().Get("Deprecation") != "true" {
+		t.Error("expected Deprecation header")
+	}
+	if got := w.Header().Get("Link"); got != `</v1/rebalance>; rel="successor-version"` {
+		t.Errorf("unexpected Link header %q", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	rt := router.New(Metrics)
+	rt.Get("/v1/portfolio/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	counter := metrics.HTTPRequests.WithLabelValues("/v1/portfolio/{user_id}", http.MethodGet, "404")
+	before := testutil.ToFloat64(counter)
+
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/portfolio/user1", nil))
+
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("Expected request to be counted under its route pattern once, got %v", got)
+	}
+}
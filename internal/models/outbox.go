@@ -0,0 +1,30 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Outbox entry states.
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed" // publishing was given up after too many attempts
+)
+
+// OutboxEntry is an event accepted by the API that the outbox relay publishes to Kafka.
+// The ID is used as the message ID of the published envelope.
+type OutboxEntry struct {
+	ID            string            `json:"id"`
+	Key           string            `json:"key"`
+	EventType     string            `json:"event_type"`
+	SchemaVersion int               `json:"schema_version"`
+	Producer      string            `json:"producer"`
+	Payload       json.RawMessage   `json:"payload"`
+	Headers       map[string]string `json:"headers,omitempty"` // correlation ID and trace context of the request
+	Status        string            `json:"status"`
+	CreatedAt     time.Time         `json:"created_at"`
+	SentAt        *time.Time        `json:"sent_at,omitempty"`
+	Attempts      int               `json:"attempts"`
+	LastError     string            `json:"last_error,omitempty"`
+}
@@ -23,9 +23,33 @@ type RebalanceTransaction struct {
 	RebalancePercent float64 `json:"rebalance_percent"` // percentage to buy/sell
 }
 
+// RebalanceCompleted is published after the transactions of a rebalance request are saved.
+type RebalanceCompleted struct {
+	UserID       string                 `json:"user_id"`
+	RequestID    string                 `json:"request_id"` // Message ID of the rebalance request
+	Transactions []RebalanceTransaction `json:"transactions"`
+}
+
 type RebalanceRequest struct {
-	UserID         string `json:"user_id"`
-	AllocationHash string `json:"allocation_hash"` // Hash of the updated allocation json from the provider
+	UserID         string   `json:"user_id"`
+	AllocationHash string   `json:"allocation_hash"`      // Hash of the updated allocation json from the provider
+	RequestID      string   `json:"request_id,omitempty"` // Message ID of the request
+	History        []string `json:"history,omitempty"`    // Hashes of the recently processed allocations, oldest first
+	Revision       string   `json:"-"`                    // Revision of the stored record, empty if it is not stored
+}
+
+// HasProcessed reports whether the allocation with hash is the last one or one
+// of the recent ones processed for the user.
+func (r *RebalanceRequest) HasProcessed(hash string) bool {
+	if r.AllocationHash == hash {
+		return true
+	}
+	for _, h := range r.History {
+		if h == hash {
+			return true
+		}
+	}
+	return false
 }
 
 type APIResponse struct {
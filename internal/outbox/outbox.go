@@ -0,0 +1,87 @@
+// Package outbox implements the transactional outbox: events are stored in
+// Elasticsearch as part of handling a request and published to Kafka by a
+// separate relay, so an accepted request always results in an event even if
+// Kafka is unavailable when it is accepted.
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/storage"
+	"portfolio-rebalancer/internal/tracing"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Queue stores events in the outbox.
+type Queue struct {
+	entries storage.OutboxRepository
+}
+
+// NewQueue returns a queue that stores its events in entries.
+func NewQueue(entries storage.OutboxRepository) *Queue {
+	return &Queue{entries: entries}
+}
+
+// Enqueue stores payload as a pending eventType event at version, to be
+// published with key by the relay.
+func (q *Queue) Enqueue(ctx context.Context, key, eventType string, version int, payload interface{}) error {
+	e, err := NewEntry(ctx, key, eventType, version, payload)
+	if err != nil {
+		return err
+	}
+	return q.entries.SaveOutboxEntry(ctx, e)
+}
+
+// NewEntry builds a pending outbox entry. The correlation ID and trace context
+// of ctx are kept so the published message continues the request's trace.
+func NewEntry(ctx context.Context, key, eventType string, version int, payload interface{}) (*models.OutboxEntry, error) {
+	env, err := kafka.NewEnvelope(eventType, version, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]string)
+	tracing.Inject(ctx, propagation.MapCarrier(headers))
+	if id := logging.CorrelationID(ctx); id != "" {
+		headers[kafka.HeaderCorrelationID] = id
+	}
+
+	return &models.OutboxEntry{
+		ID:            env.MessageID,
+		Key:           key,
+		EventType:     env.EventType,
+		SchemaVersion: env.SchemaVersion,
+		Producer:      env.Producer,
+		Payload:       env.Payload,
+		Headers:       headers,
+		Status:        models.OutboxPending,
+		CreatedAt:     env.ProducedAt,
+	}, nil
+}
+
+// envelope rebuilds the envelope of e. The message ID is the entry ID, so every
+// publish of the same entry carries the same ID.
+func envelope(e models.OutboxEntry) kafka.Envelope {
+	return kafka.Envelope{
+		EventType:     e.EventType,
+		SchemaVersion: e.SchemaVersion,
+		MessageID:     e.ID,
+		ProducedAt:    time.Now().UTC(),
+		Producer:      e.Producer,
+		Payload:       e.Payload,
+	}
+}
+
+// entryContext restores the correlation ID and trace context stored with e.
+func entryContext(ctx context.Context, e models.OutboxEntry) context.Context {
+	ctx = tracing.Extract(ctx, propagation.MapCarrier(e.Headers))
+	if id := e.Headers[kafka.HeaderCorrelationID]; id != "" {
+		ctx = logging.WithCorrelationID(ctx, id)
+	}
+	return logging.With(ctx, logging.KeyMessageID, e.ID)
+}
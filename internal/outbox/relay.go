@@ -0,0 +1,160 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/storage"
+)
+
+// Relay publishes pending outbox entries to Kafka in the order they were
+// created. Delivery is at least once: an entry published but not marked sent
+// (e.g. the relay crashed in between) is published again with the same message
+// ID. Only one relay should run at a time, otherwise entries may be published
+// out of order.
+type Relay struct {
+	entries     storage.OutboxRepository
+	pub         kafka.Publisher
+	topic       string
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int // publish attempts before an entry is marked failed, unlimited if not positive
+}
+
+// NewRelay returns a relay that publishes the entries in entries to topic with
+// pub, polling for up to batchSize pending entries every interval. An entry
+// that failed to publish maxAttempts times is marked failed, together with the
+// later entries for its key, until they are requeued. Entries are retried
+// without limit if maxAttempts is not positive.
+func NewRelay(entries storage.OutboxRepository, pub kafka.Publisher, topic string, interval time.Duration, batchSize, maxAttempts int) *Relay {
+	return &Relay{entries: entries, pub: pub, topic: topic, interval: interval, batchSize: batchSize, maxAttempts: maxAttempts}
+}
+
+// maxBackoff bounds the wait between polls after failed batches.
+const maxBackoff = time.Minute
+
+// Run relays pending entries until ctx is cancelled. The wait between polls
+// doubles after each failed batch, up to maxBackoff.
+func (r *Relay) Run(ctx context.Context) error {
+	failures := 0
+	for {
+		// Keep draining while full batches are returned
+		for {
+			n, err := r.relayBatch(ctx)
+			if err != nil {
+				failures++
+				slog.ErrorContext(ctx, "Failed to relay outbox entries", "failures", failures, logging.Err(err))
+				break
+			}
+			failures = 0
+			if n < r.batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.backoff(failures)):
+		}
+	}
+}
+
+// backoff returns the wait before the next poll after failures failed batches
+// in a row.
+func (r *Relay) backoff(failures int) time.Duration {
+	wait := r.interval
+	for i := 0; i < failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, maxBackoff)
+}
+
+// relayBatch publishes one batch of pending entries and returns how many are
+// no longer pending. It stops at the first failure so later entries for the
+// same key are not published before it. An entry that ran out of attempts is
+// marked failed instead, and so are the later entries for its key, so they
+// are not published before it is requeued.
+func (r *Relay) relayBatch(ctx context.Context) (int, error) {
+	entries, err := r.entries.GetPendingOutboxEntries(ctx, r.batchSize)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	keys, err := r.entries.GetFailedOutboxKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	failed := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		failed[k] = true
+	}
+
+	for i, e := range entries {
+		if failed[e.Key] {
+			if err := r.holdBack(ctx, e); err != nil {
+				return i, err
+			}
+			continue
+		}
+		if err := r.relay(ctx, e); errors.Is(err, errEntryFailed) {
+			failed[e.Key] = true
+		} else if err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// holdBack marks e failed without publishing it, as an earlier entry for its
+// key failed.
+func (r *Relay) holdBack(ctx context.Context, e models.OutboxEntry) error {
+	ctx = entryContext(ctx, e)
+	if err := r.entries.MarkOutboxEntryFailed(ctx, e.ID, e.Attempts, errEarlierEntryFailed.Error()); err != nil {
+		return err
+	}
+	slog.WarnContext(ctx, "Outbox entry held back behind a failed entry", logging.KeyUserID, e.Key)
+	return nil
+}
+
+// errEarlierEntryFailed is recorded on entries held back behind a failed entry
+// for their key.
+var errEarlierEntryFailed = errors.New("an earlier entry for the key failed")
+
+// errEntryFailed is returned by relay when an entry was marked failed.
+var errEntryFailed = errors.New("outbox entry failed")
+
+func (r *Relay) relay(ctx context.Context, e models.OutboxEntry) error {
+	ctx = entryContext(ctx, e)
+
+	if err := r.pub.Publish(ctx, r.topic, e.Key, envelope(e)); err != nil {
+		metrics.OutboxRelayed.WithLabelValues(metrics.ResultError).Inc()
+		attempts := e.Attempts + 1
+		if r.maxAttempts > 0 && attempts >= r.maxAttempts {
+			if ferr := r.entries.MarkOutboxEntryFailed(ctx, e.ID, attempts, err.Error()); ferr != nil {
+				slog.WarnContext(ctx, "Failed to mark outbox entry failed", logging.Err(ferr))
+				return err
+			}
+			slog.ErrorContext(ctx, "Outbox entry failed, giving up", logging.KeyUserID, e.Key, "attempts", attempts, logging.Err(err))
+			return errEntryFailed
+		}
+		if rerr := r.entries.RecordOutboxFailure(ctx, e.ID, attempts, err.Error()); rerr != nil {
+			slog.WarnContext(ctx, "Failed to record outbox failure", logging.Err(rerr))
+		}
+		return err
+	}
+	metrics.OutboxRelayed.WithLabelValues(metrics.ResultSuccess).Inc()
+
+	// The entry is not returned as pending once this succeeds. If it fails the
+	// entry is published again on the next poll with the same message ID.
+	if err := r.entries.MarkOutboxEntrySent(ctx, e.ID, time.Now().UTC()); err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "Outbox entry relayed", logging.KeyUserID, e.Key)
+	return nil
+}
@@ -0,0 +1,245 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/kafka"
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/models"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// mockOutbox implements storage.OutboxRepository with the given functions.
+type mockOutbox struct {
+	save    func(ctx context.Context, e *models.OutboxEntry) error
+	pending func(ctx context.Context, limit int) ([]models.OutboxEntry, error)
+	sent    func(ctx context.Context, id string, sentAt time.Time) error
+	failure func(ctx context.Context, id string, attempts int, reason string) error
+	gaveUp  func(ctx context.Context, id string, attempts int, reason string) error
+	failed  []string // keys with failed entries
+}
+
+func (m mockOutbox) SaveOutboxEntry(ctx context.Context, e *models.OutboxEntry) error {
+	return m.save(ctx, e)
+}
+
+func (m mockOutbox) GetPendingOutboxEntries(ctx context.Context, limit int) ([]models.OutboxEntry, error) {
+	return m.pending(ctx, limit)
+}
+
+func (m mockOutbox) MarkOutboxEntrySent(ctx context.Context, id string, sentAt time.Time) error {
+	return m.sent(ctx, id, sentAt)
+}
+
+func (m mockOutbox) RecordOutboxFailure(ctx context.Context, id string, attempts int, reason string) error {
+	return m.failure(ctx, id, attempts, reason)
+}
+
+func (m mockOutbox) MarkOutboxEntryFailed(ctx context.Context, id string, attempts int, reason string) error {
+	return m.gaveUp(ctx, id, attempts, reason)
+}
+
+func (m mockOutbox) GetFailedOutboxKeys(ctx context.Context) ([]string, error) {
+	return m.failed, nil
+}
+
+func (m mockOutbox) RequeueFailedOutboxEntries(ctx context.Context) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+func TestQueue_Enqueue(t *testing.T) {
+	var saved *models.OutboxEntry
+	q := NewQueue(mockOutbox{save: func(ctx context.Context, e *models.OutboxEntry) error {
+		saved = e
+		return nil
+	}})
+
+	ctx := logging.WithCorrelationID(context.Background(), "corr-1")
+	payload := models.RebalancePortfolioKafka{UserID: "user1"}
+	if err := q.Enqueue(ctx, "user1", kafka.EventRebalanceRequested, kafka.RebalanceRequestedVersion, payload); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	if saved == nil {
+		t.Fatal("expected entry to be saved")
+	}
+	if saved.ID == "" || saved.Key != "user1" || saved.Status != models.OutboxPending {
+		t.Errorf("unexpected entry %+v", saved)
+	}
+	if saved.EventType != kafka.EventRebalanceRequested || saved.SchemaVersion != kafka.RebalanceRequestedVersion {
+		t.Errorf("unexpected event %s version %d", saved.EventType, saved.SchemaVersion)
+	}
+	if got := saved.Headers[kafka.HeaderCorrelationID]; got != "corr-1" {
+		t.Errorf("expected correlation ID corr-1, got %q", got)
+	}
+}
+
+func TestRelay_RelayBatch(t *testing.T) {
+	entries := []models.OutboxEntry{
+		{ID: "a", Key: "user1", EventType: kafka.EventRebalanceRequested, SchemaVersion: 1, Payload: []byte(`{}`)},
+		{ID: "b", Key: "user1", EventType: kafka.EventRebalanceRequested, SchemaVersion: 1, Payload: []byte(`{}`)},
+		{ID: "c", Key: "user2", EventType: kafka.EventRebalanceRequested, SchemaVersion: 1, Payload: []byte(`{}`)},
+		{ID: "d", Key: "user1", EventType: kafka.EventRebalanceRequested, SchemaVersion: 1, Payload: []byte(`{}`)},
+	}
+
+	tests := []struct {
+		name        string
+		failID      string
+		maxAttempts int
+		failedKeys  []string
+		wantCount   int
+		wantSent    []string
+		wantFailed  []string
+		wantGaveUp  []string
+		wantErr     bool
+	}{
+		{"All published", "", 10, nil, 4, []string{"a", "b", "c", "d"}, nil, nil, false},
+		{"Stops at first failure", "b", 10, nil, 1, []string{"a"}, []string{"b"}, nil, true},
+		{"Holds back key of entry out of attempts", "b", 1, nil, 4, []string{"a", "c"}, nil, []string{"b", "d"}, false},
+		{"Holds back key with failed entries", "", 10, []string{"user1"}, 4, []string{"c"}, nil, []string{"a", "b", "d"}, false},
+		{"Unlimited attempts", "b", 0, nil, 1, []string{"a"}, []string{"b"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent, failed, gaveUp, published []string
+			pub := publisherFunc(func(ctx context.Context, topic, key string, env kafka.Envelope) error {
+				if topic != "rebalance" {
+					t.Errorf("expected topic rebalance, got %s", topic)
+				}
+				published = append(published, env.MessageID)
+				if env.MessageID == tt.failID {
+					return errors.New("kafka error")
+				}
+				return nil
+			})
+			repo := mockOutbox{
+				pending: func(ctx context.Context, limit int) ([]models.OutboxEntry, error) {
+					return entries, nil
+				},
+				sent: func(ctx context.Context, id string, sentAt time.Time) error {
+					sent = append(sent, id)
+					return nil
+				},
+				failure: func(ctx context.Context, id string, attempts int, reason string) error {
+					if attempts != 1 {
+						t.Errorf("expected attempt 1, got %d", attempts)
+					}
+					failed = append(failed, id)
+					return nil
+				},
+				gaveUp: func(ctx context.Context, id string, attempts int, reason string) error {
+					gaveUp = append(gaveUp, id)
+					return nil
+				},
+				failed: tt.failedKeys,
+			}
+
+			n, err := NewRelay(repo, pub, "rebalance", time.Second, 10, tt.maxAttempts).relayBatch(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if n != tt.wantCount {
+				t.Errorf("expected %d relayed, got %d", tt.wantCount, n)
+			}
+			if !equal(sent, tt.wantSent) {
+				t.Errorf("expected sent %v, got %v", tt.wantSent, sent)
+			}
+			if !equal(failed, tt.wantFailed) {
+				t.Errorf("expected failed %v, got %v", tt.wantFailed, failed)
+			}
+			if !equal(gaveUp, tt.wantGaveUp) {
+				t.Errorf("expected marked failed %v, got %v", tt.wantGaveUp, gaveUp)
+			}
+			// Entries after a failure are not attempted
+			if tt.wantErr && published[len(published)-1] != tt.failID {
+				t.Errorf("expected publishing to stop at %s, got %v", tt.failID, published)
+			}
+		})
+	}
+}
+
+type publisherFunc func(ctx context.Context, topic, key string, env kafka.Envelope) error
+
+func (f publisherFunc) Publish(ctx context.Context, topic, key string, env kafka.Envelope) error {
+	return f(ctx, topic, key, env)
+}
+
+func TestRelay_Backoff(t *testing.T) {
+	r := NewRelay(mockOutbox{}, nil, "rebalance", time.Second, 10, 0)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := r.backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRelay_MemoryBroker(t *testing.T) {
+	ctx := logging.WithCorrelationID(context.Background(), "corr-1")
+	e, err := NewEntry(ctx, "user1", kafka.EventRebalanceRequested, kafka.RebalanceRequestedVersion, models.RebalancePortfolioKafka{UserID: "user1"})
+	if err != nil {
+		t.Fatalf("NewEntry failed: %v", err)
+	}
+	repo := mockOutbox{
+		pending: func(ctx context.Context, limit int) ([]models.OutboxEntry, error) {
+			return []models.OutboxEntry{*e}, nil
+		},
+		sent: func(ctx context.Context, id string, sentAt time.Time) error { return nil },
+	}
+
+	broker := kafka.NewMemoryBroker()
+	if _, err := NewRelay(repo, broker, "rebalance", time.Second, 10, 10).relayBatch(context.Background()); err != nil {
+		t.Fatalf("relayBatch failed: %v", err)
+	}
+
+	subCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan kafka.Envelope, 1)
+	var correlationID string
+	go broker.Subscribe(subCtx, "rebalance", func(ctx context.Context, msg kafkago.Message) error {
+		env, err := kafka.DecodeMessage(ctx, msg)
+		if err != nil {
+			return err
+		}
+		correlationID = logging.CorrelationID(ctx)
+		received <- env
+		return nil
+	})
+
+	select {
+	case env := <-received:
+		if env.MessageID != e.ID {
+			t.Errorf("expected message ID %s, got %s", e.ID, env.MessageID)
+		}
+		if correlationID != "corr-1" {
+			t.Errorf("expected correlation ID corr-1, got %q", correlationID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the relayed event")
+	}
+}
@@ -0,0 +1,192 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+// Middleware wraps a handler with additional behaviour, e.g. authentication or logging.
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Chain applies mw to h so that the first middleware is the outermost one.
+func Chain(h http.HandlerFunc, mw ...Middleware) http.HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+type routeTable struct {
+	routes []route
+}
+
+// Router dispatches requests by method and path. Path segments written as
+// {name} match any single segment and are available through Param.
+type Router struct {
+	table      *routeTable
+	prefix     string
+	middleware []Middleware
+	handler    http.HandlerFunc // dispatch wrapped in the global middleware
+}
+
+// New creates a router. The middleware wraps every request, including ones
+// that do not match a route.
+func New(mw ...Middleware) *Router {
+	rt := &Router{table: &routeTable{}}
+	rt.handler = Chain(rt.dispatch, mw...)
+	return rt
+}
+
+// Group returns a router registering routes below prefix, wrapped in mw in
+// addition to the middleware of the parent group.
+func (rt *Router) Group(prefix string, mw ...Middleware) *Router {
+	return &Router{
+		table:      rt.table,
+		prefix:     rt.prefix + strings.TrimSuffix(prefix, "/"),
+		middleware: append(append([]Middleware(nil), rt.middleware...), mw...),
+	}
+}
+
+// Handle registers h for method and pattern.
+func (rt *Router) Handle(method, pattern string, h http.HandlerFunc, mw ...Middleware) {
+	full := rt.prefix + pattern
+	all := append(append([]Middleware(nil), rt.middleware...), mw...)
+	rt.table.routes = append(rt.table.routes, route{
+		method:   method,
+		pattern:  full,
+		segments: splitPath(full),
+		handler:  Chain(h, all...),
+	})
+}
+
+// Get registers h for GET requests on pattern.
+func (rt *Router) Get(pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(http.MethodGet, pattern, h, mw...)
+}
+
+// Post registers h for POST requests on pattern.
+func (rt *Router) Post(pattern string, h http.HandlerFunc, mw ...Middleware) {
+	rt.Handle(http.MethodPost, pattern, h, mw...)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The route context is added before the global middleware runs so that
+	// middleware can read the matched pattern once the request is handled.
+	r = r.WithContext(context.WithValue(r.Context(), routeKey{}, &routeContext{}))
+
+	if rt.handler == nil {
+		rt.dispatch(w, r)
+		return
+	}
+	rt.handler(w, r)
+}
+
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	rc, _ := r.Context().Value(routeKey{}).(*routeContext)
+
+	var allowed []string
+	for _, rte := range rt.table.routes {
+		params, ok := match(rte.segments, segments)
+		if !ok {
+			continue
+		}
+		if rte.method != r.Method {
+			allowed = append(allowed, rte.method)
+			continue
+		}
+
+		if rc != nil {
+			rc.pattern = rte.pattern
+			rc.params = params
+		}
+		rte.handler(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(models.APIResponse{
+			Success: false,
+			Message: "Method not allowed",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(models.APIResponse{
+		Success: false,
+		Message: "Not found",
+	})
+}
+
+type routeKey struct{}
+
+// routeContext records the route matched for a request.
+type routeContext struct {
+	pattern string
+	params  map[string]string
+}
+
+// Param returns the value of the path parameter name for the matched route.
+func Param(r *http.Request, name string) string {
+	rc, _ := r.Context().Value(routeKey{}).(*routeContext)
+	if rc == nil {
+		return ""
+	}
+	return rc.params[name]
+}
+
+// Pattern returns the pattern of the matched route, e.g. "/v1/portfolio/{user_id}",
+// or an empty string if no route matched.
+func Pattern(r *http.Request) string {
+	rc, _ := r.Context().Value(routeKey{}).(*routeContext)
+	if rc == nil {
+		return ""
+	}
+	return rc.pattern
+}
+
+func match(pattern, path []string) (map[string]string, bool) {
+	if len(pattern) != len(path) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, seg := range pattern {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg[1:len(seg)-1]] = path[i]
+			continue
+		}
+		if seg != path[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
@@ -0,0 +1,120 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var gotParam, gotPattern string
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		gotParam = Param(r, "user_id")
+		w.WriteHeader(http.StatusOK)
+	}
+	tag := func(value string) Middleware {
+		return func(next http.HandlerFunc) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Tag", value)
+				next(w, r)
+			}
+		}
+	}
+	// Global middleware sees the matched pattern after the request is handled
+	recordPattern := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			next(w, r)
+			gotPattern = Pattern(r)
+		}
+	}
+
+	rt := New(recordPattern, tag("global"))
+	v1 := rt.Group("/v1", tag("v1"))
+	v1.Get("/portfolio/{user_id}", ok)
+	v1.Post("/portfolio", ok)
+	rt.Post("/rebalance", ok)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+		expectedParam  string
+		expectedRoute  string
+		expectedTags   []string
+		expectedAllow  string
+	}{
+		{
+			name:           "Path parameter",
+			method:         http.MethodGet,
+			path:           "/v1/portfolio/user1",
+			expectedStatus: http.StatusOK,
+			expectedParam:  "user1",
+			expectedRoute:  "/v1/portfolio/{user_id}",
+			expectedTags:   []string{"global", "v1"},
+		},
+		{
+			name:           "Trailing slash",
+			method:         http.MethodPost,
+			path:           "/v1/portfolio/",
+			expectedStatus: http.StatusOK,
+			expectedRoute:  "/v1/portfolio",
+			expectedTags:   []string{"global", "v1"},
+		},
+		{
+			name:           "Root route skips group middleware",
+			method:         http.MethodPost,
+			path:           "/rebalance",
+			expectedStatus: http.StatusOK,
+			expectedRoute:  "/rebalance",
+			expectedTags:   []string{"global"},
+		},
+		{
+			name:           "Method not allowed",
+			method:         http.MethodDelete,
+			path:           "/v1/portfolio",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedTags:   []string{"global"},
+			expectedAllow:  http.MethodPost,
+		},
+		{
+			name:           "Not found",
+			method:         http.MethodGet,
+			path:           "/v2/portfolio",
+			expectedStatus: http.StatusNotFound,
+			expectedTags:   []string{"global"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotParam, gotPattern = "", ""
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+
+			rt.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, w.Code)
+			}
+			if gotParam != tt.expectedParam {
+				t.Errorf("Expected param %q, got %q", tt.expectedParam, gotParam)
+			}
+			if gotPattern != tt.expectedRoute {
+				t.Errorf("Expected route %q, got %q", tt.expectedRoute, gotPattern)
+			}
+			tags := w.Header().Values("X-Tag")
+			if len(tags) != len(tt.expectedTags) {
+				t.Fatalf("Expected middleware %v, got %v", tt.expectedTags, tags)
+			}
+			for i := range tags {
+				if tags[i] != tt.expectedTags[i] {
+					t.Errorf("Expected middleware %v, got %v", tt.expectedTags, tags)
+				}
+			}
+			if allow := w.Header().Get("Allow"); allow != tt.expectedAllow {
+				t.Errorf("Expected Allow %q, got %q", tt.expectedAllow, allow)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"math"
+	"sort"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+// percentTolerance absorbs floating point noise when comparing rebalance percentages.
+const percentTolerance = 1e-9
+
+// TransactionChange is a transaction for an asset that differs between two runs.
+type TransactionChange struct {
+	Asset  string                      `json:"asset"`
+	Before models.RebalanceTransaction `json:"before"`
+	After  models.RebalanceTransaction `json:"after"`
+}
+
+// TransactionDiff lists how the transactions of a request differ between two runs.
+type TransactionDiff struct {
+	Added   []models.RebalanceTransaction `json:"added,omitempty"`   // only in after
+	Removed []models.RebalanceTransaction `json:"removed,omitempty"` // only in before
+	Changed []TransactionChange           `json:"changed,omitempty"` // different action or percent
+}
+
+// Empty reports whether both runs produced the same transactions.
+func (d TransactionDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffTransactions compares the transactions of a request, one per asset,
+// before and after it was processed again. The results are sorted by asset.
+func DiffTransactions(before, after []models.RebalanceTransaction) TransactionDiff {
+	old := make(map[string]models.RebalanceTransaction, len(before))
+	for _, tx := range before {
+		old[tx.Asset] = tx
+	}
+
+	var d TransactionDiff
+	for _, tx := range after {
+		prev, ok := old[tx.Asset]
+		if !ok {
+			d.Added = append(d.Added, tx)
+			continue
+		}
+		delete(old, tx.Asset)
+		if prev.Action != tx.Action || math.Abs(prev.RebalancePercent-tx.RebalancePercent) > percentTolerance {
+			d.Changed = append(d.Changed, TransactionChange{Asset: tx.Asset, Before: prev, After: tx})
+		}
+	}
+	for _, tx := range old {
+		d.Removed = append(d.Removed, tx)
+	}
+
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Asset < d.Added[j].Asset })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Asset < d.Removed[j].Asset })
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Asset < d.Changed[j].Asset })
+	return d
+}
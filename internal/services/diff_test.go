@@ -0,0 +1,73 @@
+package services
+
+import (
+	"portfolio-rebalancer/internal/models"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTransactions(t *testing.T) {
+	buyStocks := models.RebalanceTransaction{UserID: "user1", Asset: "Stocks", Action: "BUY", RebalancePercent: 10.0}
+	sellBonds := models.RebalanceTransaction{UserID: "user1", Asset: "Bonds", Action: "SELL", RebalancePercent: 10.0}
+	buyGold := models.RebalanceTransaction{UserID: "user1", Asset: "Gold", Action: "BUY", RebalancePercent: 5.0}
+
+	tests := []struct {
+		name     string
+		before   []models.RebalanceTransaction
+		after    []models.RebalanceTransaction
+		expected TransactionDiff
+	}{
+		{
+			name:     "Same transactions in a different order",
+			before:   []models.RebalanceTransaction{buyStocks, sellBonds},
+			after:    []models.RebalanceTransaction{sellBonds, buyStocks},
+			expected: TransactionDiff{},
+		},
+		{
+			name:     "Floating point noise is ignored",
+			before:   []models.RebalanceTransaction{{UserID: "user1", Asset: "Stocks", Action: "BUY", RebalancePercent: 0.3}},
+			after:    []models.RebalanceTransaction{{UserID: "user1", Asset: "Stocks", Action: "BUY", RebalancePercent: 0.1 + 0.2}},
+			expected: TransactionDiff{},
+		},
+		{
+			name:   "Added and removed assets",
+			before: []models.RebalanceTransaction{buyStocks, sellBonds},
+			after:  []models.RebalanceTransaction{buyStocks, buyGold},
+			expected: TransactionDiff{
+				Added:   []models.RebalanceTransaction{buyGold},
+				Removed: []models.RebalanceTransaction{sellBonds},
+			},
+		},
+		{
+			name:   "Changed action and percent",
+			before: []models.RebalanceTransaction{buyStocks, sellBonds},
+			after: []models.RebalanceTransaction{
+				{UserID: "user1", Asset: "Stocks", Action: "SELL", RebalancePercent: 10.0},
+				{UserID: "user1", Asset: "Bonds", Action: "SELL", RebalancePercent: 20.0},
+			},
+			expected: TransactionDiff{
+				Changed: []TransactionChange{
+					{Asset: "Bonds", Before: sellBonds, After: models.RebalanceTransaction{UserID: "user1", Asset: "Bonds", Action: "SELL", RebalancePercent: 20.0}},
+					{Asset: "Stocks", Before: buyStocks, After: models.RebalanceTransaction{UserID: "user1", Asset: "Stocks", Action: "SELL", RebalancePercent: 10.0}},
+				},
+			},
+		},
+		{
+			name:     "Nothing saved before",
+			after:    []models.RebalanceTransaction{buyStocks},
+			expected: TransactionDiff{Added: []models.RebalanceTransaction{buyStocks}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DiffTransactions(tt.before, tt.after)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("DiffTransactions() = %+v, want %+v", got, tt.expected)
+			}
+			if got.Empty() != tt.expected.Empty() {
+				t.Errorf("Empty() = %v, want %v", got.Empty(), tt.expected.Empty())
+			}
+		})
+	}
+}
@@ -0,0 +1,507 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
+	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/utils"
+
+	bolt "go.etcd.io/bbolt"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// Buckets of the Bolt store. Transactions are keyed by request ID and asset,
+// pending and failed outbox entries are indexed by creation time.
+var (
+	bucketPortfolios    = []byte("portfolios")
+	bucketRequests      = []byte("rebalance_requests")
+	bucketTransactions  = []byte("rebalance_transactions")
+	bucketOutbox        = []byte("outbox")
+	bucketOutboxPending = []byte("outbox_pending")
+	bucketOutboxFailed  = []byte("outbox_failed")
+)
+
+// BoltConfig is the configuration of the embedded Bolt repositories.
+type BoltConfig struct {
+	Path        string        // database file, created if missing
+	OpenTimeout time.Duration // wait for the file lock held by another process
+}
+
+// LoadBoltConfig reads the configuration from the environment:
+//
+//	BOLT_PATH           database file (default rebalancer.db)
+//	BOLT_OPEN_TIMEOUT   wait for the file lock at startup (default 5s)
+func LoadBoltConfig() BoltConfig {
+	path := os.Getenv("BOLT_PATH")
+	if path == "" {
+		path = "rebalancer.db"
+	}
+	return BoltConfig{
+		Path:        path,
+		OpenTimeout: utils.EnvDuration("BOLT_OPEN_TIMEOUT", 5*time.Second),
+	}
+}
+
+// Bolt implements the repositories on an embedded bbolt database file, for
+// demos, edge deployments and tests without a database server. The file is
+// locked by the process that opens it, so it only suits a single process,
+// e.g. the API with BROKER=memory.
+type Bolt struct {
+	db *bolt.DB
+}
+
+var (
+	_ PortfolioRepository        = (*Bolt)(nil)
+	_ RebalanceRequestRepository = (*Bolt)(nil)
+	_ TransactionRepository      = (*Bolt)(nil)
+	_ OutboxRepository           = (*Bolt)(nil)
+)
+
+// NewBolt opens or creates the database file and its buckets.
+func NewBolt(cfg BoltConfig) (*Bolt, error) {
+	db, err := bolt.Open(cfg.Path, 0o600, &bolt.Options{Timeout: cfg.OpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Bolt database %s: %w", cfg.Path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketPortfolios, bucketRequests, bucketTransactions, bucketOutbox, bucketOutboxPending, bucketOutboxFailed} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create Bolt buckets: %w", err)
+	}
+
+	slog.Info("Opened Bolt database", "path", cfg.Path)
+	return &Bolt{db: db}, nil
+}
+
+// Close closes the database file and releases its lock.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// instrumentBolt is instrument for Bolt calls.
+func instrumentBolt(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	return instrumentCall(ctx, "bolt", semconv.DBSystemKey.String("bolt"), operation, metrics.ObserveBolt)
+}
+
+// CheckHealth returns an error if the database has been closed.
+func (b *Bolt) CheckHealth(ctx context.Context) (err error) {
+	_, done := instrumentBolt(ctx, "ping")
+	defer done(&err)
+
+	return b.db.View(func(*bolt.Tx) error { return nil })
+}
+
+func (b *Bolt) SavePortfolio(ctx context.Context, p *models.Portfolio) (err error) {
+	ctx, done := instrumentBolt(ctx, "save_portfolio")
+	defer done(&err)
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(bucketPortfolios), []byte(p.UserID), p)
+	})
+	if err != nil {
+		return fmt.Errorf("error saving portfolio: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Portfolio saved", logging.KeyUserID, p.UserID)
+	return nil
+}
+
+func (b *Bolt) GetPortfolio(ctx context.Context, userID string) (_ *models.Portfolio, err error) {
+	_, done := instrumentBolt(ctx, "get_portfolio")
+	defer done(&err)
+
+	var p models.Portfolio
+	found, err := b.getJSON(bucketPortfolios, []byte(userID), &p)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrUserNotFound
+	}
+	return &p, nil
+}
+
+// requestRecord is a rebalance request as stored, with its revision.
+type requestRecord struct {
+	models.RebalanceRequest
+	Version int64 `json:"revision"`
+}
+
+// SaveRebalanceRequest records p as the last request processed for the user and
+// saves its transactions in one commit. Transactions already saved for the
+// request are kept, so a redelivered request cannot duplicate its trades. The
+// record is created only if it does not exist, or replaced only if its
+// revision is still p.Revision; otherwise nothing is saved.
+func (b *Bolt) SaveRebalanceRequest(ctx context.Context, p *models.RebalanceRequest, txs []models.RebalanceTransaction) (err error) {
+	ctx, done := instrumentBolt(ctx, "save_rebalance_request")
+	defer done(&err)
+	return b.saveRebalanceRequest(ctx, p, txs, false)
+}
+
+// ReplaceRebalanceRequest is SaveRebalanceRequest, deleting the transactions
+// saved for the request before in the same commit.
+func (b *Bolt) ReplaceRebalanceRequest(ctx context.Context, p *models.RebalanceRequest, txs []models.RebalanceTransaction) (err error) {
+	ctx, done := instrumentBolt(ctx, "replace_rebalance_request")
+	defer done(&err)
+	return b.saveRebalanceRequest(ctx, p, txs, true)
+}
+
+func (b *Bolt) saveRebalanceRequest(ctx context.Context, p *models.RebalanceRequest, txs []models.RebalanceTransaction, replace bool) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		requests := tx.Bucket(bucketRequests)
+		record := requestRecord{RebalanceRequest: *p, Version: 1}
+		if data := requests.Get([]byte(p.UserID)); data != nil {
+			var stored requestRecord
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			if p.Revision != strconv.FormatInt(stored.Version, 10) {
+				return ErrRequestConflict
+			}
+			record.Version = stored.Version + 1
+		} else if p.Revision != "" {
+			return ErrRequestConflict
+		}
+
+		transactions := tx.Bucket(bucketTransactions)
+		if replace && p.RequestID != "" {
+			if err := deleteTransactions(transactions, p.RequestID); err != nil {
+				return err
+			}
+		}
+		if err := putTransactions(transactions, p.RequestID, txs); err != nil {
+			return err
+		}
+		return putJSON(requests, []byte(p.UserID), record)
+	})
+	if errors.Is(err, ErrRequestConflict) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error saving rebalance request: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Rebalance request saved", logging.KeyUserID, p.UserID, "transactions", len(txs))
+	return nil
+}
+
+func (b *Bolt) GetRebalanceRequest(ctx context.Context, userID string) (_ *models.RebalanceRequest, err error) {
+	_, done := instrumentBolt(ctx, "get_rebalance_request")
+	defer done(&err)
+
+	var record requestRecord
+	found, err := b.getJSON(bucketRequests, []byte(userID), &record)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrRequestNotFound
+	}
+	record.Revision = strconv.FormatInt(record.Version, 10)
+	return &record.RebalanceRequest, nil
+}
+
+// SaveRebalanceTransactions saves the transactions of the rebalance request
+// requestID without recording the request.
+func (b *Bolt) SaveRebalanceTransactions(ctx context.Context, requestID string, txs []models.RebalanceTransaction) (err error) {
+	_, done := instrumentBolt(ctx, "save_rebalance_transactions")
+	defer done(&err)
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putTransactions(tx.Bucket(bucketTransactions), requestID, txs)
+	})
+}
+
+// transactionPrefix returns the key prefix of the transactions of a request.
+func transactionPrefix(requestID string) []byte {
+	return append([]byte(requestID), 0)
+}
+
+// putTransactions stores txs of request requestID under <request ID>\0<asset>,
+// skipping assets already saved for the request. Transactions of requests
+// without an ID get a sequence number instead of the asset, so they never
+// overwrite each other.
+func putTransactions(bucket *bolt.Bucket, requestID string, txs []models.RebalanceTransaction) error {
+	prefix := transactionPrefix(requestID)
+	now := time.Now().UTC()
+	for _, t := range txs {
+		key := append(bytes.Clone(prefix), t.Asset...)
+		if requestID == "" {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			key = binary.BigEndian.AppendUint64(bytes.Clone(prefix), seq)
+		} else if bucket.Get(key) != nil {
+			continue
+		}
+		if err := putJSON(bucket, key, transactionDoc{RebalanceTransaction: t, RequestID: requestID, CreatedAt: now}); err != nil {
+			return fmt.Errorf("error saving rebalance transactions: %w", err)
+		}
+	}
+	return nil
+}
+
+func (b *Bolt) GetRebalanceTransactions(ctx context.Context, requestID string) (_ []models.RebalanceTransaction, err error) {
+	_, done := instrumentBolt(ctx, "get_rebalance_transactions")
+	defer done(&err)
+
+	if requestID == "" {
+		return nil, errors.New("request ID is required")
+	}
+
+	var txs []models.RebalanceTransaction
+	err = b.db.View(func(tx *bolt.Tx) error {
+		prefix := transactionPrefix(requestID)
+		c := tx.Bucket(bucketTransactions).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var doc transactionDoc
+			if err := json.Unmarshal(v, &doc); err != nil {
+				return err
+			}
+			txs = append(txs, doc.RebalanceTransaction)
+		}
+		return nil
+	})
+	return txs, err
+}
+
+func (b *Bolt) DeleteRebalanceTransactions(ctx context.Context, requestID string) (err error) {
+	_, done := instrumentBolt(ctx, "delete_rebalance_transactions")
+	defer done(&err)
+
+	if requestID == "" {
+		return errors.New("request ID is required")
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return deleteTransactions(tx.Bucket(bucketTransactions), requestID)
+	})
+}
+
+// deleteTransactions deletes the transactions of the request requestID from bucket.
+func deleteTransactions(bucket *bolt.Bucket, requestID string) error {
+	prefix := transactionPrefix(requestID)
+	c := bucket.Cursor()
+	// Deleting moves the cursor to the next key
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outboxPendingKey orders pending and failed outbox entries by creation time,
+// then ID.
+func outboxPendingKey(e *models.OutboxEntry) []byte {
+	key := binary.BigEndian.AppendUint64(nil, uint64(e.CreatedAt.UnixNano()))
+	return append(key, e.ID...)
+}
+
+// SaveOutboxEntry stores a new pending outbox entry. It fails if an entry with
+// the same ID already exists.
+func (b *Bolt) SaveOutboxEntry(ctx context.Context, e *models.OutboxEntry) (err error) {
+	_, done := instrumentBolt(ctx, "save_outbox_entry")
+	defer done(&err)
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(bucketOutbox)
+		if outbox.Get([]byte(e.ID)) != nil {
+			return fmt.Errorf("outbox entry %s already exists", e.ID)
+		}
+		if err := putJSON(outbox, []byte(e.ID), e); err != nil {
+			return err
+		}
+		if e.Status != models.OutboxPending {
+			return nil
+		}
+		return tx.Bucket(bucketOutboxPending).Put(outboxPendingKey(e), []byte(e.ID))
+	})
+	if err != nil {
+		return fmt.Errorf("error saving outbox entry: %w", err)
+	}
+	return nil
+}
+
+// GetPendingOutboxEntries returns up to limit pending entries, oldest first.
+func (b *Bolt) GetPendingOutboxEntries(ctx context.Context, limit int) (_ []models.OutboxEntry, err error) {
+	_, done := instrumentBolt(ctx, "get_pending_outbox_entries")
+	defer done(&err)
+
+	var entries []models.OutboxEntry
+	err = b.db.View(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(bucketOutbox)
+		c := tx.Bucket(bucketOutboxPending).Cursor()
+		for k, id := c.First(); k != nil && len(entries) < limit; k, id = c.Next() {
+			var e models.OutboxEntry
+			if err := json.Unmarshal(outbox.Get(id), &e); err != nil {
+				return fmt.Errorf("invalid outbox entry %s: %w", id, err)
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// MarkOutboxEntrySent marks an entry as published.
+func (b *Bolt) MarkOutboxEntrySent(ctx context.Context, id string, sentAt time.Time) (err error) {
+	_, done := instrumentBolt(ctx, "mark_outbox_entry_sent")
+	defer done(&err)
+
+	return b.updateOutboxEntry(id, func(tx *bolt.Tx, e *models.OutboxEntry) error {
+		e.Status = models.OutboxSent
+		e.SentAt = &sentAt
+		return tx.Bucket(bucketOutboxPending).Delete(outboxPendingKey(e))
+	})
+}
+
+// RecordOutboxFailure stores a failed publish attempt of a pending entry.
+func (b *Bolt) RecordOutboxFailure(ctx context.Context, id string, attempts int, reason string) (err error) {
+	_, done := instrumentBolt(ctx, "record_outbox_failure")
+	defer done(&err)
+
+	return b.updateOutboxEntry(id, func(_ *bolt.Tx, e *models.OutboxEntry) error {
+		e.Attempts = attempts
+		e.LastError = reason
+		return nil
+	})
+}
+
+// MarkOutboxEntryFailed records the last failed attempt of an entry that is
+// no longer published.
+func (b *Bolt) MarkOutboxEntryFailed(ctx context.Context, id string, attempts int, reason string) (err error) {
+	_, done := instrumentBolt(ctx, "mark_outbox_entry_failed")
+	defer done(&err)
+
+	return b.updateOutboxEntry(id, func(tx *bolt.Tx, e *models.OutboxEntry) error {
+		e.Status = models.OutboxFailed
+		e.Attempts = attempts
+		e.LastError = reason
+		if err := tx.Bucket(bucketOutboxPending).Delete(outboxPendingKey(e)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketOutboxFailed).Put(outboxPendingKey(e), []byte(e.ID))
+	})
+}
+
+// GetFailedOutboxKeys returns the keys that have failed entries.
+func (b *Bolt) GetFailedOutboxKeys(ctx context.Context) (_ []string, err error) {
+	_, done := instrumentBolt(ctx, "get_failed_outbox_keys")
+	defer done(&err)
+
+	var keys []string
+	seen := make(map[string]bool)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(bucketOutbox)
+		return tx.Bucket(bucketOutboxFailed).ForEach(func(_, id []byte) error {
+			var e models.OutboxEntry
+			if err := json.Unmarshal(outbox.Get(id), &e); err != nil {
+				return fmt.Errorf("invalid outbox entry %s: %w", id, err)
+			}
+			if !seen[e.Key] {
+				seen[e.Key] = true
+				keys = append(keys, e.Key)
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// RequeueFailedOutboxEntries returns the failed entries to pending with no
+// attempts recorded and returns how many were requeued.
+func (b *Bolt) RequeueFailedOutboxEntries(ctx context.Context) (_ int, err error) {
+	_, done := instrumentBolt(ctx, "requeue_failed_outbox_entries")
+	defer done(&err)
+
+	var n int
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(bucketOutbox)
+		pending := tx.Bucket(bucketOutboxPending)
+		failed := tx.Bucket(bucketOutboxFailed)
+		c := failed.Cursor()
+		// Deleting moves the cursor to the next key
+		for k, id := c.First(); k != nil; k, id = c.First() {
+			var e models.OutboxEntry
+			if err := json.Unmarshal(outbox.Get(id), &e); err != nil {
+				return fmt.Errorf("invalid outbox entry %s: %w", id, err)
+			}
+			e.Status = models.OutboxPending
+			e.Attempts = 0
+			if err := putJSON(outbox, id, &e); err != nil {
+				return err
+			}
+			if err := pending.Put(k, id); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// updateOutboxEntry applies update to the stored entry id in one transaction.
+func (b *Bolt) updateOutboxEntry(id string, update func(tx *bolt.Tx, e *models.OutboxEntry) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(bucketOutbox)
+		data := outbox.Get([]byte(id))
+		if data == nil {
+			return fmt.Errorf("outbox entry %s not found", id)
+		}
+		var e models.OutboxEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if err := update(tx, &e); err != nil {
+			return err
+		}
+		return putJSON(outbox, []byte(id), &e)
+	})
+}
+
+// getJSON decodes the value of key in bucket into v and reports whether it exists.
+func (b *Bolt) getJSON(bucket, key []byte, v interface{}) (found bool, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get(key)
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	return found, err
+}
+
+// putJSON stores v encoded as JSON under key.
+func putJSON(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
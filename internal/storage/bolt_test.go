@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+func newTestBolt(t *testing.T) *Bolt {
+	t.Helper()
+	b, err := NewBolt(BoltConfig{Path: filepath.Join(t.TempDir(), "test.db"), OpenTimeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewBolt() error = %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestBolt_Portfolio(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	if _, err := b.GetPortfolio(ctx, "user1"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	p := &models.Portfolio{UserID: "user1", Allocation: map[string]float64{"stocks": 60, "bonds": 40}}
+	if err := b.SavePortfolio(ctx, p); err != nil {
+		t.Fatalf("SavePortfolio() error = %v", err)
+	}
+	got, err := b.GetPortfolio(ctx, "user1")
+	if err != nil {
+		t.Fatalf("GetPortfolio() error = %v", err)
+	}
+	if got.Allocation["stocks"] != 60 || got.Allocation["bonds"] != 40 {
+		t.Errorf("expected saved allocation, got %v", got.Allocation)
+	}
+}
+
+func TestBolt_RebalanceRequest(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	if _, err := b.GetRebalanceRequest(ctx, "user1"); !errors.Is(err, ErrRequestNotFound) {
+		t.Fatalf("expected ErrRequestNotFound, got %v", err)
+	}
+
+	txs := []models.RebalanceTransaction{
+		{UserID: "user1", Action: "BUY", Asset: "stocks", RebalancePercent: 10},
+		{UserID: "user1", Action: "SELL", Asset: "bonds", RebalancePercent: 10},
+	}
+	r := &models.RebalanceRequest{UserID: "user1", AllocationHash: "h1", RequestID: "req-1"}
+	if err := b.SaveRebalanceRequest(ctx, r, txs); err != nil {
+		t.Fatalf("SaveRebalanceRequest() error = %v", err)
+	}
+	// The record is only created once
+	if err := b.SaveRebalanceRequest(ctx, r, txs); !errors.Is(err, ErrRequestConflict) {
+		t.Fatalf("expected ErrRequestConflict creating the request again, got %v", err)
+	}
+
+	got, err := b.GetRebalanceRequest(ctx, "user1")
+	if err != nil {
+		t.Fatalf("GetRebalanceRequest() error = %v", err)
+	}
+	if got.AllocationHash != "h1" || got.RequestID != "req-1" || got.Revision == "" {
+		t.Errorf("expected request h1/req-1 with a revision, got %+v", got)
+	}
+
+	// Saving a redelivered request again must not duplicate its transactions
+	got.History = []string{"h1"}
+	if err := b.SaveRebalanceRequest(ctx, got, txs); err != nil {
+		t.Fatalf("SaveRebalanceRequest() error = %v", err)
+	}
+	// The revision read before the last save is stale
+	if err := b.SaveRebalanceRequest(ctx, got, nil); !errors.Is(err, ErrRequestConflict) {
+		t.Fatalf("expected ErrRequestConflict with a stale revision, got %v", err)
+	}
+	if got, _ := b.GetRebalanceRequest(ctx, "user1"); len(got.History) != 1 {
+		t.Errorf("expected history saved, got %+v", got)
+	}
+
+	// Transactions of other requests are kept apart
+	if err := b.SaveRebalanceTransactions(ctx, "req-10", txs[:1]); err != nil {
+		t.Fatalf("SaveRebalanceTransactions() error = %v", err)
+	}
+
+	saved, err := b.GetRebalanceTransactions(ctx, "req-1")
+	if err != nil {
+		t.Fatalf("GetRebalanceTransactions() error = %v", err)
+	}
+	if len(saved) != 2 {
+		t.Fatalf("expected 2 transactions, got %v", saved)
+	}
+
+	if err := b.DeleteRebalanceTransactions(ctx, "req-1"); err != nil {
+		t.Fatalf("DeleteRebalanceTransactions() error = %v", err)
+	}
+	if saved, _ := b.GetRebalanceTransactions(ctx, "req-1"); len(saved) != 0 {
+		t.Errorf("expected transactions deleted, got %v", saved)
+	}
+	if saved, _ := b.GetRebalanceTransactions(ctx, "req-10"); len(saved) != 1 {
+		t.Errorf("expected transactions of other requests kept, got %v", saved)
+	}
+}
+
+func TestBolt_ReplaceRebalanceRequest(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	txs := []models.RebalanceTransaction{
+		{UserID: "user1", Action: "BUY", Asset: "stocks", RebalancePercent: 10},
+		{UserID: "user1", Action: "SELL", Asset: "bonds", RebalancePercent: 10},
+	}
+	r := &models.RebalanceRequest{UserID: "user1", AllocationHash: "h1", RequestID: "req-1"}
+	if err := b.SaveRebalanceRequest(ctx, r, txs); err != nil {
+		t.Fatalf("SaveRebalanceRequest() error = %v", err)
+	}
+
+	// A conflicting replace keeps the previous transactions
+	if err := b.ReplaceRebalanceRequest(ctx, r, txs[:1]); !errors.Is(err, ErrRequestConflict) {
+		t.Fatalf("expected ErrRequestConflict, got %v", err)
+	}
+	if saved, _ := b.GetRebalanceTransactions(ctx, "req-1"); len(saved) != 2 {
+		t.Errorf("expected the previous transactions kept, got %v", saved)
+	}
+
+	got, _ := b.GetRebalanceRequest(ctx, "user1")
+	if err := b.ReplaceRebalanceRequest(ctx, got, txs[:1]); err != nil {
+		t.Fatalf("ReplaceRebalanceRequest() error = %v", err)
+	}
+	if saved, _ := b.GetRebalanceTransactions(ctx, "req-1"); len(saved) != 1 || saved[0] != txs[0] {
+		t.Errorf("expected the transactions replaced, got %v", saved)
+	}
+}
+
+func TestBolt_Outbox(t *testing.T) {
+	b := newTestBolt(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	for _, e := range []models.OutboxEntry{
+		{ID: "b", Key: "user1", Status: models.OutboxPending, CreatedAt: now.Add(time.Second)},
+		{ID: "a", Key: "user1", Status: models.OutboxPending, CreatedAt: now},
+		{ID: "c", Key: "user2", Status: models.OutboxPending, CreatedAt: now.Add(2 * time.Second)},
+	} {
+		if err := b.SaveOutboxEntry(ctx, &e); err != nil {
+			t.Fatalf("SaveOutboxEntry(%s) error = %v", e.ID, err)
+		}
+	}
+	if err := b.SaveOutboxEntry(ctx, &models.OutboxEntry{ID: "a", Status: models.OutboxPending, CreatedAt: now}); err == nil {
+		t.Error("expected an error saving an existing entry")
+	}
+
+	pending, err := b.GetPendingOutboxEntries(ctx, 2)
+	if err != nil {
+		t.Fatalf("GetPendingOutboxEntries() error = %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != "a" || pending[1].ID != "b" {
+		t.Fatalf("expected entries a and b, got %+v", pending)
+	}
+
+	if err := b.MarkOutboxEntrySent(ctx, "a", now); err != nil {
+		t.Fatalf("MarkOutboxEntrySent() error = %v", err)
+	}
+	if err := b.RecordOutboxFailure(ctx, "b", 1, "broker down"); err != nil {
+		t.Fatalf("RecordOutboxFailure() error = %v", err)
+	}
+
+	pending, err = b.GetPendingOutboxEntries(ctx, 10)
+	if err != nil {
+		t.Fatalf("GetPendingOutboxEntries() error = %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != "b" || pending[1].ID != "c" {
+		t.Fatalf("expected entries b and c, got %+v", pending)
+	}
+	if pending[0].Attempts != 1 || pending[0].LastError != "broker down" {
+		t.Errorf("expected failure recorded, got %+v", pending[0])
+	}
+
+	// An entry marked failed is no longer pending
+	if err := b.MarkOutboxEntryFailed(ctx, "b", 10, "broker down"); err != nil {
+		t.Fatalf("MarkOutboxEntryFailed() error = %v", err)
+	}
+	pending, err = b.GetPendingOutboxEntries(ctx, 10)
+	if err != nil {
+		t.Fatalf("GetPendingOutboxEntries() error = %v", err)
+	}
+	if len(pending) != 1 || pending[0].ID != "c" {
+		t.Fatalf("expected entry c, got %+v", pending)
+	}
+	keys, err := b.GetFailedOutboxKeys(ctx)
+	if err != nil {
+		t.Fatalf("GetFailedOutboxKeys() error = %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "user1" {
+		t.Errorf("expected failed key user1, got %v", keys)
+	}
+
+	// A requeued entry is pending again, in creation order
+	n, err := b.RequeueFailedOutboxEntries(ctx)
+	if err != nil {
+		t.Fatalf("RequeueFailedOutboxEntries() error = %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 entry requeued, got %d", n)
+	}
+	pending, err = b.GetPendingOutboxEntries(ctx, 10)
+	if err != nil {
+		t.Fatalf("GetPendingOutboxEntries() error = %v", err)
+	}
+	if len(pending) != 2 || pending[0].ID != "b" || pending[1].ID != "c" {
+		t.Fatalf("expected entries b and c, got %+v", pending)
+	}
+	if pending[0].Status != models.OutboxPending || pending[0].Attempts != 0 {
+		t.Errorf("expected entry b pending without attempts, got %+v", pending[0])
+	}
+	if keys, err := b.GetFailedOutboxKeys(ctx); err != nil || len(keys) != 0 {
+		t.Errorf("expected no failed keys, got %v, %v", keys, err)
+	}
+}
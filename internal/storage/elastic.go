@@ -6,126 +6,242 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/metrics"
 	"portfolio-rebalancer/internal/models"
+	"portfolio-rebalancer/internal/tracing"
+	"portfolio-rebalancer/internal/utils"
 
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var esClient *elasticsearch.Client
 var ErrUserNotFound = errors.New("user not found")
 var ErrRequestNotFound = errors.New("rebalance request not found")
 
-// InitElastic initializes elasticsearch connection with retry logic
-func InitElastic() error {
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			os.Getenv("ELASTICSEARCH_URL"),
-		},
+// ErrRequestConflict is returned when a rebalance request record was created or
+// updated since it was read.
+var ErrRequestConflict = errors.New("rebalance request was updated concurrently")
+
+// ElasticConfig is the configuration of the Elasticsearch repositories.
+type ElasticConfig struct {
+	Addresses         []string      // node URLs
+	ConnectAttempts   int           // connection attempts before NewElastic fails
+	ConnectRetryDelay time.Duration // wait between connection attempts
+	TransactionsIndex string        // index of the rebalance transactions
+	SkipIndexSetup    bool          // connect without installing templates or creating indices
+}
+
+// LoadElasticConfig reads the configuration from the environment:
+//
+//	ELASTICSEARCH_URL                 comma-separated node URLs
+//	ELASTICSEARCH_CONNECT_ATTEMPTS    connection attempts at startup (default 5)
+//	ELASTICSEARCH_CONNECT_RETRY_DELAY wait between connection attempts (default 5s)
+func LoadElasticConfig() ElasticConfig {
+	cfg := ElasticConfig{
+		ConnectAttempts:   utils.EnvInt("ELASTICSEARCH_CONNECT_ATTEMPTS", 5),
+		ConnectRetryDelay: utils.EnvDuration("ELASTICSEARCH_CONNECT_RETRY_DELAY", 5*time.Second),
+		TransactionsIndex: TransactionsIndex,
+	}
+	for _, addr := range strings.Split(os.Getenv("ELASTICSEARCH_URL"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.Addresses = append(cfg.Addresses, addr)
+		}
+	}
+	return cfg
+}
+
+// Elastic implements the repositories on Elasticsearch.
+type Elastic struct {
+	client            *elasticsearch.Client
+	transactionsIndex string
+}
+
+var (
+	_ PortfolioRepository        = (*Elastic)(nil)
+	_ RebalanceRequestRepository = (*Elastic)(nil)
+	_ TransactionRepository      = (*Elastic)(nil)
+	_ OutboxRepository           = (*Elastic)(nil)
+)
+
+// NewElastic connects to Elasticsearch with retry logic, installs the index
+// templates and creates the managed indices that do not exist yet, unless
+// cfg.SkipIndexSetup is set.
+func NewElastic(cfg ElasticConfig) (*Elastic, error) {
+	if cfg.TransactionsIndex == "" {
+		cfg.TransactionsIndex = TransactionsIndex
 	}
+	attempts := max(cfg.ConnectAttempts, 1)
 
 	var client *elasticsearch.Client
 	var err error
 
-	for i := 1; i <= 5; i++ {
-		client, err = elasticsearch.NewClient(cfg)
+	for i := 1; i <= attempts; i++ {
+		client, err = elasticsearch.NewClient(elasticsearch.Config{Addresses: cfg.Addresses})
 		if err != nil {
-			log.Printf("Failed to create client: %v", err)
+			slog.Warn("Failed to create client", logging.Err(err))
 		} else {
 			_, err = client.Info()
 			if err == nil {
-				log.Println("Connected to Elasticsearch")
-				esClient = client
-				return nil
+				slog.Info("Connected to Elasticsearch")
+				es := &Elastic{client: client, transactionsIndex: cfg.TransactionsIndex}
+				if cfg.SkipIndexSetup {
+					return es, nil
+				}
+				if err := es.ensureIndices(context.Background()); err != nil {
+					return nil, err
+				}
+				return es, nil
 			}
-			log.Printf("Client created, but ES not ready: %v", err)
+			slog.Warn("Client created, but ES not ready", logging.Err(err))
 		}
 
-		log.Printf("Retrying connection to Elasticsearch... (%d/5)", i)
-		time.Sleep(5 * time.Second)
+		if i < attempts {
+			slog.Info("Retrying connection to Elasticsearch...", "attempt", i, "max_attempts", attempts)
+			time.Sleep(cfg.ConnectRetryDelay)
+		}
 	}
 
-	return fmt.Errorf("failed to connect to Elasticsearch after retries: %w", err)
+	return nil, fmt.Errorf("failed to connect to Elasticsearch after retries: %w", err)
 }
 
-func SavePortfolio(ctx context.Context, p *models.Portfolio) error {
-	body, err := json.Marshal(p)
-	if err != nil {
-		return err
-	}
+// Close releases the client. The HTTP connections are closed with the process.
+func (es *Elastic) Close() error {
+	return nil
+}
 
-	res, err := esClient.Index("portfolios", bytes.NewReader(body), esClient.Index.WithDocumentID(p.UserID))
+// WithTransactionsIndex returns a copy of es that keeps the rebalance
+// transactions in index, e.g. a shadow index written by a replay.
+func (es *Elastic) WithTransactionsIndex(index string) *Elastic {
+	c := *es
+	c.transactionsIndex = index
+	return &c
+}
+
+// CheckHealth returns an error if Elasticsearch is unreachable or the cluster health is red
+func (es *Elastic) CheckHealth(ctx context.Context) (err error) {
+	ctx, done := instrument(ctx, "cluster_health")
+	defer done(&err)
+
+	res, err := es.client.Cluster.Health(es.client.Cluster.Health.WithContext(ctx))
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return fmt.Errorf("error saving portfolio: %s", res.String())
+		return fmt.Errorf("cluster health request failed: %s", res.Status())
 	}
 
-	log.Printf("Portfolio saved for user %s", p.UserID)
-	return nil
-}
-
-func GetPortfolio(ctx context.Context, userID string) (*models.Portfolio, error) {
-	res, err := esClient.Get("portfolios", userID)
-	if err != nil {
-		return nil, err
+	var health struct {
+		Status string `json:"status"`
 	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		return nil, ErrUserNotFound
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return fmt.Errorf("failed to parse cluster health: %w", err)
 	}
 
-	var esResp struct {
-		Source models.Portfolio `json:"_source"`
+	if health.Status == "red" {
+		return errors.New("cluster health is red")
 	}
+	return nil
+}
 
-	if err := json.NewDecoder(res.Body).Decode(&esResp); err != nil {
-		return nil, err
+// instrument starts a span for an Elasticsearch call. The returned function ends
+// the span and records latency and result metrics; it takes a pointer so it can be
+// deferred before the returned error is known.
+func instrument(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	return instrumentCall(ctx, "elasticsearch", semconv.DBSystemElasticsearch, operation, metrics.ObserveElasticsearch)
+}
+
+// instrumentCall starts a client span for operation on a database system and
+// records its result with observe.
+func instrumentCall(ctx context.Context, name string, system attribute.KeyValue, operation string, observe func(operation, result string, duration time.Duration)) (context.Context, func(err *error)) {
+	start := time.Now()
+	ctx, span := tracing.Tracer().Start(ctx, name+" "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			system,
+			semconv.DBOperation(operation),
+		),
+	)
+
+	return ctx, func(err *error) {
+		result := metrics.ResultSuccess
+		switch {
+		case *err == nil:
+		case errors.Is(*err, ErrUserNotFound), errors.Is(*err, ErrRequestNotFound):
+			result = metrics.ResultNotFound
+		default:
+			result = metrics.ResultError
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		observe(operation, result, time.Since(start))
+		span.End()
 	}
+}
 
-	return &esResp.Source, nil
+// portfolioDoc is a portfolio as stored, with the time it was last saved.
+type portfolioDoc struct {
+	models.Portfolio
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// requestDoc is a rebalance request as stored, with the time it was recorded.
+type requestDoc struct {
+	models.RebalanceRequest
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-func SaveRebalanceRequest(ctx context.Context, p *models.RebalanceRequest) error {
-	body, err := json.Marshal(p)
+func (es *Elastic) SavePortfolio(ctx context.Context, p *models.Portfolio) (err error) {
+	ctx, done := instrument(ctx, "save_portfolio")
+	defer done(&err)
+
+	body, err := json.Marshal(portfolioDoc{Portfolio: *p, UpdatedAt: time.Now().UTC()})
 	if err != nil {
 		return err
 	}
 
-	res, err := esClient.Index("rebalance_requests", bytes.NewReader(body), esClient.Index.WithDocumentID(p.UserID))
+	res, err := es.client.Index(portfoliosIndex, bytes.NewReader(body), es.client.Index.WithDocumentID(p.UserID), es.client.Index.WithContext(ctx))
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return fmt.Errorf("error saving rebalance request: %s", res.String())
+		return fmt.Errorf("error saving portfolio: %s", res.String())
 	}
 
-	log.Printf("Rebalance request saved for user %s", p.UserID)
+	slog.InfoContext(ctx, "Portfolio saved", logging.KeyUserID, p.UserID)
 	return nil
 }
 
-func GetRebalanceRequest(ctx context.Context, userID string) (*models.RebalanceRequest, error) {
-	res, err := esClient.Get("rebalance_requests", userID)
+func (es *Elastic) GetPortfolio(ctx context.Context, userID string) (_ *models.Portfolio, err error) {
+	ctx, done := instrument(ctx, "get_portfolio")
+	defer done(&err)
+
+	res, err := es.client.Get(portfoliosIndex, userID, es.client.Get.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
-		return nil, ErrRequestNotFound
+		return nil, ErrUserNotFound
 	}
 
 	var esResp struct {
-		Source models.RebalanceRequest `json:"_source"`
+		Source models.Portfolio `json:"_source"`
 	}
 
 	if err := json.NewDecoder(res.Body).Decode(&esResp); err != nil {
@@ -135,42 +251,110 @@ func GetRebalanceRequest(ctx context.Context, userID string) (*models.RebalanceR
 	return &esResp.Source, nil
 }
 
-func SaveRebalanceTransactions(ctx context.Context, txs []models.RebalanceTransaction) error {
-	if len(txs) == 0 {
-		return nil
+// SaveRebalanceRequest records p as the last request processed for the user
+// together with its transactions. Elasticsearch has no transactions, so the
+// request is written first: it is created with op_type create, or replaced
+// only if its seq_no and primary term are still the ones read. The
+// transactions are only written once that succeeded, so a request that fails
+// with ErrRequestConflict leaves nothing behind. If writing the transactions
+// fails, the error is returned but the request stays recorded; the consumer
+// saves them when the request is delivered again.
+func (es *Elastic) SaveRebalanceRequest(ctx context.Context, p *models.RebalanceRequest, txs []models.RebalanceTransaction) (err error) {
+	ctx, done := instrument(ctx, "save_rebalance_request")
+	defer done(&err)
+	return es.saveRebalanceRequest(ctx, p, txs, false)
+}
+
+// ReplaceRebalanceRequest is SaveRebalanceRequest, deleting the transactions
+// saved for the request before that txs did not overwrite. They are only
+// deleted once the request is recorded and txs are written.
+func (es *Elastic) ReplaceRebalanceRequest(ctx context.Context, p *models.RebalanceRequest, txs []models.RebalanceTransaction) (err error) {
+	ctx, done := instrument(ctx, "replace_rebalance_request")
+	defer done(&err)
+	return es.saveRebalanceRequest(ctx, p, txs, true)
+}
+
+func (es *Elastic) saveRebalanceRequest(ctx context.Context, p *models.RebalanceRequest, txs []models.RebalanceTransaction, replace bool) error {
+	body, err := json.Marshal(requestDoc{RebalanceRequest: *p, UpdatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
 	}
 
-	var buf bytes.Buffer
-	for _, tx := range txs {
-		meta := []byte(fmt.Sprintf(`{ "index" : { "_index" : "rebalance_transactions" } }%s`, "\n"))
-		data, err := json.Marshal(tx)
-		if err != nil {
+	var res *esapi.Response
+	if p.Revision == "" {
+		res, err = es.client.Create(requestsIndex, p.UserID, bytes.NewReader(body), es.client.Create.WithContext(ctx))
+	} else {
+		var seqNo, primaryTerm int
+		if _, err := fmt.Sscanf(p.Revision, "%d:%d", &seqNo, &primaryTerm); err != nil {
+			return fmt.Errorf("invalid rebalance request revision %q: %w", p.Revision, err)
+		}
+		res, err = es.client.Index(requestsIndex, bytes.NewReader(body),
+			es.client.Index.WithDocumentID(p.UserID),
+			es.client.Index.WithIfSeqNo(seqNo),
+			es.client.Index.WithIfPrimaryTerm(primaryTerm),
+			es.client.Index.WithContext(ctx),
+		)
+	}
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return ErrRequestConflict
+	}
+	if res.IsError() {
+		return fmt.Errorf("error saving rebalance request: %s", res.String())
+	}
+
+	if len(txs) > 0 {
+		var buf bytes.Buffer
+		if err := es.appendTransactions(&buf, p.RequestID, txs); err != nil {
 			return err
 		}
-		data = append(data, '\n')
-		buf.Write(meta)
-		buf.Write(data)
+		if err := es.bulk(ctx, &buf); err != nil {
+			return fmt.Errorf("error saving transactions of rebalance request: %w", err)
+		}
 	}
+	if replace && p.RequestID != "" {
+		if err := es.deleteStaleTransactions(ctx, p.RequestID, txs); err != nil {
+			return err
+		}
+	}
+
+	slog.InfoContext(ctx, "Rebalance request saved", logging.KeyUserID, p.UserID, "transactions", len(txs))
+	return nil
+}
 
-	res, err := esClient.Bulk(bytes.NewReader(buf.Bytes()), esClient.Bulk.WithContext(ctx))
+// GetRebalanceRequest returns the last request processed for the user. Its
+// revision is the seq_no and primary term of the document.
+func (es *Elastic) GetRebalanceRequest(ctx context.Context, userID string) (_ *models.RebalanceRequest, err error) {
+	ctx, done := instrument(ctx, "get_rebalance_request")
+	defer done(&err)
+
+	res, err := es.client.Get(requestsIndex, userID, es.client.Get.WithContext(ctx))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrRequestNotFound
+	}
 	if res.IsError() {
-		return fmt.Errorf("error saving rebalance transactions: %s", res.String())
+		return nil, fmt.Errorf("error getting rebalance request: %s", res.String())
 	}
 
-	var raw map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
-		return fmt.Errorf("failure to to parse response body: %s", err)
+	var esResp struct {
+		SeqNo       int64                   `json:"_seq_no"`
+		PrimaryTerm int64                   `json:"_primary_term"`
+		Source      models.RebalanceRequest `json:"_source"`
 	}
 
-	if hasErrors, ok := raw["errors"].(bool); ok && hasErrors {
-		return fmt.Errorf("bulk request contained errors: %v", raw)
+	if err := json.NewDecoder(res.Body).Decode(&esResp); err != nil {
+		return nil, err
 	}
 
-	log.Printf("Saved %d rebalance transactions for user %s", len(txs), txs[0].UserID)
-	return nil
+	esResp.Source.Revision = fmt.Sprintf("%d:%d", esResp.SeqNo, esResp.PrimaryTerm)
+	return &esResp.Source, nil
 }
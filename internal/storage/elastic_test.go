@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// fakeElastic answers the requests for the request record with status and
+// records the URIs of the other requests.
+type fakeElastic struct {
+	status int
+
+	mu   sync.Mutex
+	uris []string
+}
+
+func (f *fakeElastic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if strings.HasPrefix(r.URL.Path, "/"+requestsIndex+"/") {
+		w.WriteHeader(f.status)
+		w.Write([]byte(`{}`))
+		return
+	}
+	f.mu.Lock()
+	f.uris = append(f.uris, r.URL.RequestURI())
+	f.mu.Unlock()
+	w.Write([]byte(`{"errors": false, "items": []}`))
+}
+
+func newTestElastic(t *testing.T, f *fakeElastic) *Elastic {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Elastic{client: client, transactionsIndex: TransactionsIndex}
+}
+
+func TestElastic_SaveRebalanceRequest(t *testing.T) {
+	txs := []models.RebalanceTransaction{{UserID: "user1", Action: "BUY", Asset: "stocks", RebalancePercent: 10}}
+
+	tests := []struct {
+		name     string
+		status   int
+		revision string
+		wantErr  error
+		wantBulk bool
+	}{
+		{"created", http.StatusCreated, "", nil, true},
+		{"updated", http.StatusOK, "3:1", nil, true},
+		{"created concurrently", http.StatusConflict, "", ErrRequestConflict, false},
+		{"updated concurrently", http.StatusConflict, "3:1", ErrRequestConflict, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeElastic{status: tt.status}
+			es := newTestElastic(t, f)
+
+			// A request without a message ID has its transactions indexed with
+			// random IDs, so transactions of a request that lost the race
+			// could never be overwritten
+			r := &models.RebalanceRequest{UserID: "user1", AllocationHash: "h", Revision: tt.revision}
+			err := es.SaveRebalanceRequest(context.Background(), r, txs)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SaveRebalanceRequest() error = %v, want %v", err, tt.wantErr)
+			}
+			if wrote := len(f.uris) > 0; wrote != tt.wantBulk {
+				t.Errorf("expected transactions written = %v, got requests %v", tt.wantBulk, f.uris)
+			}
+		})
+	}
+}
+
+func TestElastic_GetRebalanceRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		wantNotFound bool
+	}{
+		{"missing", http.StatusNotFound, true},
+		{"unavailable", http.StatusServiceUnavailable, false},
+		{"forbidden", http.StatusForbidden, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := newTestElastic(t, &fakeElastic{status: tt.status})
+
+			_, err := es.GetRebalanceRequest(context.Background(), "user1")
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if errors.Is(err, ErrRequestNotFound) != tt.wantNotFound {
+				t.Errorf("expected ErrRequestNotFound = %v, got %v", tt.wantNotFound, err)
+			}
+		})
+	}
+}
+
+func TestElastic_MarkOutboxEntrySent(t *testing.T) {
+	f := &fakeElastic{}
+	es := newTestElastic(t, f)
+
+	if err := es.MarkOutboxEntrySent(context.Background(), "entry-1", time.Now()); err != nil {
+		t.Fatalf("MarkOutboxEntrySent() error = %v", err)
+	}
+	// The relay polls for pending entries again right after a full batch
+	if len(f.uris) != 1 || !strings.Contains(f.uris[0], "refresh=wait_for") {
+		t.Errorf("expected the update to wait for a refresh, got requests %v", f.uris)
+	}
+}
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Aliases of the portfolio and rebalance request indices.
+const (
+	portfoliosIndex = "portfolios"
+	requestsIndex   = "rebalance_requests"
+)
+
+// indexSpec is an Elasticsearch index managed by the services. Documents are
+// read and written through the alias, which points to the versioned index
+// <alias>_v<version>. The index template <alias> applies the mapping to every
+// index named <alias>_*, including shadow indices written by a replay.
+//
+// Bump the version whenever the mapping changes; the migrate command creates
+// the new index, reindexes the data and moves the alias.
+type indexSpec struct {
+	alias   string
+	version int
+	mapping string
+}
+
+// managedIndices are the indices created by the services. Unmapped fields are
+// kept in _source but not indexed, so the mappings only change here.
+var managedIndices = []indexSpec{
+	{
+		alias:   portfoliosIndex,
+		version: 1,
+		mapping: `{
+  "dynamic": false,
+  "properties": {
+    "user_id":    {"type": "keyword"},
+    "allocation": {"type": "flattened"},
+    "updated_at": {"type": "date"}
+  }
+}`,
+	},
+	{
+		alias:   requestsIndex,
+		version: 2, // history
+		mapping: `{
+  "dynamic": false,
+  "properties": {
+    "user_id":         {"type": "keyword"},
+    "allocation_hash": {"type": "keyword"},
+    "request_id":      {"type": "keyword"},
+    "history":         {"type": "keyword"},
+    "updated_at":      {"type": "date"}
+  }
+}`,
+	},
+	{
+		alias:   TransactionsIndex,
+		version: 1,
+		mapping: `{
+  "dynamic": false,
+  "properties": {
+    "request_id":        {"type": "keyword"},
+    "user_id":           {"type": "keyword"},
+    "action":            {"type": "keyword"},
+    "asset":             {"type": "keyword"},
+    "rebalance_percent": {"type": "double"},
+    "created_at":        {"type": "date"}
+  }
+}`,
+	},
+	{
+		// The payload is kept out of the index; only the fields the relay
+		// queries on and the ones useful for debugging are mapped
+		alias:   outboxIndex,
+		version: 1,
+		mapping: `{
+  "dynamic": false,
+  "properties": {
+    "id":             {"type": "keyword"},
+    "key":            {"type": "keyword"},
+    "event_type":     {"type": "keyword"},
+    "schema_version": {"type": "integer"},
+    "producer":       {"type": "keyword"},
+    "status":         {"type": "keyword"},
+    "created_at":     {"type": "date"},
+    "sent_at":        {"type": "date"},
+    "attempts":       {"type": "integer"},
+    "last_error":     {"type": "text"},
+    "payload":        {"type": "object", "enabled": false},
+    "headers":        {"type": "object", "enabled": false}
+  }
+}`,
+	},
+}
+
+// index returns the name of the current versioned index.
+func (s indexSpec) index() string {
+	return fmt.Sprintf("%s_v%d", s.alias, s.version)
+}
+
+// template returns the body of the index template.
+func (s indexSpec) template() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"index_patterns": []string{s.alias + "_*"},
+		"template": map[string]interface{}{
+			"mappings": json.RawMessage(s.mapping),
+		},
+		"_meta": map[string]interface{}{"version": s.version},
+	})
+}
+
+// indexState is where the alias of a managed index currently points.
+type indexState struct {
+	aliased []string // indices the alias points to
+	legacy  bool     // a concrete index has the alias name, created by dynamic mapping
+}
+
+// indexPlan is what migrating a managed index to its current version involves.
+type indexPlan struct {
+	create  bool     // create the versioned index
+	sources []string // indices to reindex from
+	remove  []string // versioned indices to move the alias from
+	legacy  bool     // delete the concrete index named like the alias
+}
+
+// upToDate reports whether the alias already points to the current index only.
+func (p indexPlan) upToDate() bool {
+	return !p.create && len(p.sources) == 0 && len(p.remove) == 0 && !p.legacy
+}
+
+// planIndex returns the steps moving the alias of spec from its state to the
+// current versioned index.
+func planIndex(spec indexSpec, state indexState) indexPlan {
+	target := spec.index()
+	plan := indexPlan{create: !slices.Contains(state.aliased, target), legacy: state.legacy}
+	for _, index := range state.aliased {
+		if index != target {
+			plan.sources = append(plan.sources, index)
+			plan.remove = append(plan.remove, index)
+		}
+	}
+	if state.legacy {
+		plan.sources = append(plan.sources, spec.alias)
+	}
+	return plan
+}
+
+// IndexMigration reports the migration of a managed index.
+type IndexMigration struct {
+	Alias     string   `json:"alias"`
+	Index     string   `json:"index"`               // current versioned index
+	From      []string `json:"from,omitempty"`      // indices the data is reindexed from
+	Deleted   []string `json:"deleted,omitempty"`   // indices deleted after moving the alias
+	Reindexed int64    `json:"reindexed,omitempty"` // documents copied to the index
+	UpToDate  bool     `json:"up_to_date"`
+}
+
+// ensureIndices installs the index templates and creates the managed indices
+// that do not exist yet. Indices at an older version are left alone and used
+// as they are until MigrateIndices is run.
+func (es *Elastic) ensureIndices(ctx context.Context) error {
+	for _, spec := range managedIndices {
+		if err := es.putTemplate(ctx, spec); err != nil {
+			return err
+		}
+		state, err := es.indexState(ctx, spec.alias)
+		if err != nil {
+			return err
+		}
+		if len(state.aliased) == 0 && !state.legacy {
+			if err := es.createIndex(ctx, spec, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if !planIndex(spec, state).upToDate() {
+			slog.Warn("Elasticsearch index is not at the current version, run the migrate command",
+				"alias", spec.alias, "index", spec.index(), "current", state.aliased, "legacy", state.legacy)
+		}
+	}
+	return nil
+}
+
+// MigrateIndices installs the index templates and moves every managed alias to
+// the current versioned index, reindexing the data of the indices it pointed
+// to. A concrete index named like an alias, created by dynamic mapping, is
+// reindexed and deleted. Previous versioned indices are deleted only if
+// deleteOld is set. With dryRun the indices are left unchanged and the plan is
+// reported.
+//
+// Documents written to the old indices while their data is reindexed are not
+// copied, so stop the services writing to Elasticsearch first.
+func (es *Elastic) MigrateIndices(ctx context.Context, dryRun, deleteOld bool) ([]IndexMigration, error) {
+	var migrations []IndexMigration
+	for _, spec := range managedIndices {
+		if !dryRun {
+			if err := es.putTemplate(ctx, spec); err != nil {
+				return migrations, err
+			}
+		}
+		state, err := es.indexState(ctx, spec.alias)
+		if err != nil {
+			return migrations, err
+		}
+		plan := planIndex(spec, state)
+		m := IndexMigration{Alias: spec.alias, Index: spec.index(), From: plan.sources, UpToDate: plan.upToDate()}
+		if dryRun || m.UpToDate {
+			migrations = append(migrations, m)
+			continue
+		}
+
+		if plan.create {
+			if err := es.createIndex(ctx, spec, false); err != nil {
+				return migrations, err
+			}
+		}
+		if len(plan.sources) > 0 {
+			if m.Reindexed, err = es.reindex(ctx, plan.sources, spec.index()); err != nil {
+				return migrations, err
+			}
+		}
+		if err := es.moveAlias(ctx, spec, plan); err != nil {
+			return migrations, err
+		}
+		if plan.legacy {
+			m.Deleted = append(m.Deleted, spec.alias)
+		}
+		if deleteOld && len(plan.remove) > 0 {
+			if err := es.deleteIndices(ctx, plan.remove); err != nil {
+				return migrations, err
+			}
+			m.Deleted = append(m.Deleted, plan.remove...)
+		}
+		slog.InfoContext(ctx, "Migrated Elasticsearch index", "alias", spec.alias, "index", spec.index(),
+			"from", plan.sources, "reindexed", m.Reindexed)
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+// putTemplate creates or replaces the index template of spec.
+func (es *Elastic) putTemplate(ctx context.Context, spec indexSpec) error {
+	body, err := spec.template()
+	if err != nil {
+		return err
+	}
+	res, err := es.client.Indices.PutIndexTemplate(spec.alias, bytes.NewReader(body),
+		es.client.Indices.PutIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error putting index template %s: %s", spec.alias, res.String())
+	}
+	return nil
+}
+
+// indexState looks up the indices alias points to, and whether a concrete
+// index has its name instead.
+func (es *Elastic) indexState(ctx context.Context, alias string) (indexState, error) {
+	var state indexState
+
+	res, err := es.client.Indices.GetAlias(es.client.Indices.GetAlias.WithName(alias),
+		es.client.Indices.GetAlias.WithContext(ctx))
+	if err != nil {
+		return state, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == 200:
+		var indices map[string]json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+			return state, fmt.Errorf("failed to parse aliases of %s: %w", alias, err)
+		}
+		for index := range indices {
+			state.aliased = append(state.aliased, index)
+		}
+		slices.Sort(state.aliased)
+		return state, nil
+	case res.StatusCode != 404:
+		return state, fmt.Errorf("error getting alias %s: %s", alias, res.String())
+	}
+
+	// Not an alias; Exists also reports aliases, but there are none by now
+	res, err = es.client.Indices.Exists([]string{alias}, es.client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return state, err
+	}
+	res.Body.Close()
+	state.legacy = res.StatusCode == 200
+	return state, nil
+}
+
+// createIndex creates the current versioned index of spec, which gets its
+// mapping from the template. With withAlias the alias is added in the same
+// request, for a new cluster.
+func (es *Elastic) createIndex(ctx context.Context, spec indexSpec, withAlias bool) error {
+	body := `{}`
+	if withAlias {
+		body = fmt.Sprintf(`{"aliases": {%q: {"is_write_index": true}}}`, spec.alias)
+	}
+	res, err := es.client.Indices.Create(spec.index(),
+		es.client.Indices.Create.WithBody(strings.NewReader(body)),
+		es.client.Indices.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Another instance may have created it concurrently, or a migration was interrupted
+	if res.IsError() && !strings.Contains(res.String(), "resource_already_exists_exception") {
+		return fmt.Errorf("error creating index %s: %s", spec.index(), res.String())
+	}
+	return nil
+}
+
+// reindex copies the documents of sources to dest, keeping their IDs, and
+// returns the number of documents copied.
+func (es *Elastic) reindex(ctx context.Context, sources []string, dest string) (int64, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"source": map[string]interface{}{"index": sources},
+		"dest":   map[string]interface{}{"index": dest},
+	})
+	if err != nil {
+		return 0, err
+	}
+	res, err := es.client.Reindex(bytes.NewReader(body),
+		es.client.Reindex.WithWaitForCompletion(true),
+		es.client.Reindex.WithRefresh(true),
+		es.client.Reindex.WithContext(ctx),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("error reindexing %v to %s: %s", sources, dest, res.String())
+	}
+	var result struct {
+		Total    int64             `json:"total"`
+		Failures []json.RawMessage `json:"failures"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("failed to parse reindex response: %w", err)
+	}
+	if len(result.Failures) > 0 {
+		return 0, fmt.Errorf("reindexing %v to %s failed for %d documents: %s", sources, dest, len(result.Failures), result.Failures[0])
+	}
+	return result.Total, nil
+}
+
+// moveAlias points the alias of spec to the current versioned index only, in
+// one atomic request that also deletes a concrete index with the alias name.
+func (es *Elastic) moveAlias(ctx context.Context, spec indexSpec, plan indexPlan) error {
+	actions := []map[string]interface{}{}
+	if plan.legacy {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]string{"index": spec.alias}})
+	}
+	for _, index := range plan.remove {
+		actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": index, "alias": spec.alias}})
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": spec.index(), "alias": spec.alias, "is_write_index": true},
+	})
+
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	res, err := es.client.Indices.UpdateAliases(bytes.NewReader(body), es.client.Indices.UpdateAliases.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error moving alias %s to %s: %s", spec.alias, spec.index(), res.String())
+	}
+	return nil
+}
+
+// deleteIndices deletes indices no alias points to anymore.
+func (es *Elastic) deleteIndices(ctx context.Context, indices []string) error {
+	res, err := es.client.Indices.Delete(indices, es.client.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error deleting indices %v: %s", indices, res.String())
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPlanIndex(t *testing.T) {
+	spec := indexSpec{alias: "portfolios", version: 2}
+
+	tests := []struct {
+		name     string
+		state    indexState
+		expected indexPlan
+		upToDate bool
+	}{
+		{
+			name:     "up to date",
+			state:    indexState{aliased: []string{"portfolios_v2"}},
+			expected: indexPlan{},
+			upToDate: true,
+		},
+		{
+			name:     "new cluster",
+			state:    indexState{},
+			expected: indexPlan{create: true},
+		},
+		{
+			name:  "previous version",
+			state: indexState{aliased: []string{"portfolios_v1"}},
+			expected: indexPlan{
+				create:  true,
+				sources: []string{"portfolios_v1"},
+				remove:  []string{"portfolios_v1"},
+			},
+		},
+		{
+			name:  "dynamic mapping",
+			state: indexState{legacy: true},
+			expected: indexPlan{
+				create:  true,
+				sources: []string{"portfolios"},
+				legacy:  true,
+			},
+		},
+		{
+			// An interrupted migration moved nothing yet but created the index
+			name:  "current and previous version",
+			state: indexState{aliased: []string{"portfolios_v1", "portfolios_v2"}},
+			expected: indexPlan{
+				sources: []string{"portfolios_v1"},
+				remove:  []string{"portfolios_v1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planIndex(spec, tt.state)
+			if !reflect.DeepEqual(plan, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, plan)
+			}
+			if plan.upToDate() != tt.upToDate {
+				t.Errorf("expected upToDate() = %v", tt.upToDate)
+			}
+		})
+	}
+}
+
+func TestManagedIndices_Templates(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, spec := range managedIndices {
+		if seen[spec.alias] {
+			t.Errorf("alias %s is managed twice", spec.alias)
+		}
+		seen[spec.alias] = true
+
+		body, err := spec.template()
+		if err != nil {
+			t.Fatalf("%s: template() error = %v", spec.alias, err)
+		}
+		var template struct {
+			IndexPatterns []string `json:"index_patterns"`
+			Template      struct {
+				Mappings struct {
+					Properties map[string]struct {
+						Type string `json:"type"`
+					} `json:"properties"`
+				} `json:"mappings"`
+			} `json:"template"`
+		}
+		if err := json.Unmarshal(body, &template); err != nil {
+			t.Fatalf("%s: invalid template: %v", spec.alias, err)
+		}
+		if len(template.IndexPatterns) != 1 || template.IndexPatterns[0] != spec.alias+"_*" {
+			t.Errorf("%s: expected the template to match %s_*, got %v", spec.alias, spec.alias, template.IndexPatterns)
+		}
+		if id, ok := template.Template.Mappings.Properties["user_id"]; ok && id.Type != "keyword" {
+			t.Errorf("%s: expected user_id to be a keyword, got %s", spec.alias, id.Type)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		expected []int
+		wantErr  bool
+	}{
+		{
+			name: "ordered by version",
+			files: fstest.MapFS{
+				"m/0010_outbox.sql": {Data: []byte("CREATE TABLE b ()")},
+				"m/0002_users.sql":  {Data: []byte("CREATE TABLE a ()")},
+				"m/README.md":       {Data: []byte("ignored")},
+			},
+			expected: []int{2, 10},
+		},
+		{
+			name:     "no migrations",
+			files:    fstest.MapFS{},
+			expected: nil,
+		},
+		{
+			name:    "missing version",
+			files:   fstest.MapFS{"m/init.sql": {}},
+			wantErr: true,
+		},
+		{
+			name:    "zero version",
+			files:   fstest.MapFS{"m/0000_init.sql": {}},
+			wantErr: true,
+		},
+		{
+			name: "duplicate version",
+			files: fstest.MapFS{
+				"m/0001_init.sql": {},
+				"m/1_other.sql":   {},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, "m")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadMigrations() error = %v", err)
+			}
+			if len(migrations) != len(tt.expected) {
+				t.Fatalf("expected %d migrations, got %d", len(tt.expected), len(migrations))
+			}
+			for i, m := range migrations {
+				if m.version != tt.expected[i] {
+					t.Errorf("migration %d: expected version %d, got %d", i, tt.expected[i], m.version)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	migrations, err := loadMigrations(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		t.Fatalf("loadMigrations() error = %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].version != 1 || migrations[0].sql == "" {
+		t.Errorf("expected the embedded migrations to start at version 1, got %+v", migrations)
+	}
+}
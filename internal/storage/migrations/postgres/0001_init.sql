@@ -0,0 +1,45 @@
+CREATE TABLE portfolios (
+    user_id    TEXT PRIMARY KEY,
+    allocation JSONB NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Last rebalance request processed for each user, for the consumer's idempotency check
+CREATE TABLE rebalance_requests (
+    user_id         TEXT PRIMARY KEY,
+    allocation_hash TEXT NOT NULL,
+    request_id      TEXT,
+    updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE rebalance_transactions (
+    id                BIGSERIAL PRIMARY KEY,
+    request_id        TEXT,
+    user_id           TEXT NOT NULL,
+    action            TEXT NOT NULL CHECK (action IN ('BUY', 'SELL')),
+    asset             TEXT NOT NULL,
+    rebalance_percent DOUBLE PRECISION NOT NULL,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- A request has one transaction per asset, so a redelivered request cannot
+    -- save its trades twice. Requests without a message ID are not covered.
+    CONSTRAINT rebalance_transactions_request_asset_key UNIQUE (request_id, asset)
+);
+
+CREATE INDEX rebalance_transactions_user_id_idx ON rebalance_transactions (user_id);
+
+CREATE TABLE outbox (
+    id             TEXT PRIMARY KEY,
+    key            TEXT NOT NULL,
+    event_type     TEXT NOT NULL,
+    schema_version INT NOT NULL,
+    producer       TEXT NOT NULL,
+    payload        JSONB NOT NULL,
+    headers        JSONB NOT NULL DEFAULT '{}',
+    status         TEXT NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL,
+    sent_at        TIMESTAMPTZ,
+    attempts       INT NOT NULL DEFAULT 0,
+    last_error     TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (created_at) WHERE status = 'pending';
@@ -0,0 +1,5 @@
+-- Recently processed allocation hashes, oldest first, and a revision for
+-- conditional updates of the idempotency record
+ALTER TABLE rebalance_requests
+    ADD COLUMN history  TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN revision BIGINT NOT NULL DEFAULT 1;
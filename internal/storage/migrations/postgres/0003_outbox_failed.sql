@@ -0,0 +1,2 @@
+-- Keys with failed entries, which hold back the later entries for the key
+CREATE INDEX outbox_failed_idx ON outbox (key) WHERE status = 'failed';
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+// outboxIndex is the alias of the outbox index.
+const outboxIndex = "outbox"
+
+// SaveOutboxEntry stores a new pending outbox entry. It fails if an entry with
+// the same ID already exists.
+func (es *Elastic) SaveOutboxEntry(ctx context.Context, e *models.OutboxEntry) (err error) {
+	ctx, done := instrument(ctx, "save_outbox_entry")
+	defer done(&err)
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	res, err := es.client.Create(outboxIndex, e.ID, bytes.NewReader(body), es.client.Create.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error saving outbox entry: %s", res.String())
+	}
+	return nil
+}
+
+// GetPendingOutboxEntries returns up to limit pending entries, oldest first.
+func (es *Elastic) GetPendingOutboxEntries(ctx context.Context, limit int) (_ []models.OutboxEntry, err error) {
+	ctx, done := instrument(ctx, "get_pending_outbox_entries")
+	defer done(&err)
+
+	query := fmt.Sprintf(`{
+  "query": {"term": {"status": %q}},
+  "sort": [{"created_at": "asc"}],
+  "size": %d
+}`, models.OutboxPending, limit)
+
+	res, err := es.client.Search(
+		es.client.Search.WithIndex(outboxIndex),
+		es.client.Search.WithBody(strings.NewReader(query)),
+		es.client.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error searching outbox: %s", res.String())
+	}
+
+	var esResp struct {
+		Hits struct {
+			Hits []struct {
+				Source models.OutboxEntry `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&esResp); err != nil {
+		return nil, err
+	}
+
+	entries := make([]models.OutboxEntry, 0, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		entries = append(entries, hit.Source)
+	}
+	return entries, nil
+}
+
+// MarkOutboxEntrySent marks an entry as published.
+func (es *Elastic) MarkOutboxEntrySent(ctx context.Context, id string, sentAt time.Time) (err error) {
+	ctx, done := instrument(ctx, "mark_outbox_entry_sent")
+	defer done(&err)
+
+	return es.updateOutboxEntry(ctx, id, map[string]interface{}{
+		"status":  models.OutboxSent,
+		"sent_at": sentAt,
+	})
+}
+
+// RecordOutboxFailure stores a failed publish attempt of a pending entry.
+func (es *Elastic) RecordOutboxFailure(ctx context.Context, id string, attempts int, reason string) (err error) {
+	ctx, done := instrument(ctx, "record_outbox_failure")
+	defer done(&err)
+
+	return es.updateOutboxEntry(ctx, id, map[string]interface{}{
+		"attempts":   attempts,
+		"last_error": reason,
+	})
+}
+
+// MarkOutboxEntryFailed records the last failed attempt of an entry that is
+// no longer published.
+func (es *Elastic) MarkOutboxEntryFailed(ctx context.Context, id string, attempts int, reason string) (err error) {
+	ctx, done := instrument(ctx, "mark_outbox_entry_failed")
+	defer done(&err)
+
+	return es.updateOutboxEntry(ctx, id, map[string]interface{}{
+		"status":     models.OutboxFailed,
+		"attempts":   attempts,
+		"last_error": reason,
+	})
+}
+
+// maxFailedOutboxKeys bounds the keys returned by GetFailedOutboxKeys.
+const maxFailedOutboxKeys = 10000
+
+// GetFailedOutboxKeys returns the keys that have failed entries, up to
+// maxFailedOutboxKeys.
+func (es *Elastic) GetFailedOutboxKeys(ctx context.Context) (_ []string, err error) {
+	ctx, done := instrument(ctx, "get_failed_outbox_keys")
+	defer done(&err)
+
+	query := fmt.Sprintf(`{
+  "query": {"term": {"status": %q}},
+  "aggs": {"keys": {"terms": {"field": "key", "size": %d}}},
+  "size": 0
+}`, models.OutboxFailed, maxFailedOutboxKeys)
+
+	res, err := es.client.Search(
+		es.client.Search.WithIndex(outboxIndex),
+		es.client.Search.WithBody(strings.NewReader(query)),
+		es.client.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error searching outbox: %s", res.String())
+	}
+
+	var esResp struct {
+		Aggregations struct {
+			Keys struct {
+				Buckets []struct {
+					Key string `json:"key"`
+				} `json:"buckets"`
+			} `json:"keys"`
+		} `json:"aggregations"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&esResp); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(esResp.Aggregations.Keys.Buckets))
+	for _, b := range esResp.Aggregations.Keys.Buckets {
+		keys = append(keys, b.Key)
+	}
+	return keys, nil
+}
+
+// RequeueFailedOutboxEntries returns the failed entries to pending with no
+// attempts recorded and returns how many were requeued.
+func (es *Elastic) RequeueFailedOutboxEntries(ctx context.Context) (_ int, err error) {
+	ctx, done := instrument(ctx, "requeue_failed_outbox_entries")
+	defer done(&err)
+
+	query := fmt.Sprintf(`{
+  "query": {"term": {"status": %q}},
+  "script": {
+    "source": "ctx._source.status = params.status; ctx._source.attempts = 0",
+    "params": {"status": %q}
+  }
+}`, models.OutboxFailed, models.OutboxPending)
+
+	res, err := es.client.UpdateByQuery(
+		[]string{outboxIndex},
+		es.client.UpdateByQuery.WithBody(strings.NewReader(query)),
+		es.client.UpdateByQuery.WithRefresh(true),
+		es.client.UpdateByQuery.WithContext(ctx),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return 0, fmt.Errorf("error requeuing outbox entries: %s", res.String())
+	}
+
+	var esResp struct {
+		Updated int `json:"updated"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&esResp); err != nil {
+		return 0, err
+	}
+	return esResp.Updated, nil
+}
+
+// updateOutboxEntry updates fields of an entry and waits until the change is
+// visible to search, so the next GetPendingOutboxEntries does not return the
+// entry as it was.
+func (es *Elastic) updateOutboxEntry(ctx context.Context, id string, fields map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"doc": fields})
+	if err != nil {
+		return err
+	}
+
+	res, err := es.client.Update(outboxIndex, id, bytes.NewReader(body),
+		es.client.Update.WithRefresh("wait_for"),
+		es.client.Update.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error updating outbox entry: %s", res.String())
+	}
+	return nil
+}
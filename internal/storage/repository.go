@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"portfolio-rebalancer/internal/models"
+)
+
+// PortfolioRepository stores the portfolios of the users.
+type PortfolioRepository interface {
+	SavePortfolio(ctx context.Context, p *models.Portfolio) error
+	// GetPortfolio returns ErrUserNotFound if the user has no portfolio.
+	GetPortfolio(ctx context.Context, userID string) (*models.Portfolio, error)
+}
+
+// RebalanceRequestRepository stores the last rebalance request processed for
+// each user, used by the consumer's idempotency check.
+type RebalanceRequestRepository interface {
+	// SaveRebalanceRequest records r as the last request processed for the user
+	// together with the transactions calculated for it. The record is only
+	// created if r.Revision is empty, and only replaced if r.Revision is the
+	// revision read by GetRebalanceRequest; otherwise it returns
+	// ErrRequestConflict.
+	SaveRebalanceRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction) error
+	// ReplaceRebalanceRequest is SaveRebalanceRequest for a request processed
+	// again: the transactions saved for r.RequestID before are replaced by txs,
+	// and kept if the record cannot be saved.
+	ReplaceRebalanceRequest(ctx context.Context, r *models.RebalanceRequest, txs []models.RebalanceTransaction) error
+	// GetRebalanceRequest returns ErrRequestNotFound if no request was processed for the user.
+	GetRebalanceRequest(ctx context.Context, userID string) (*models.RebalanceRequest, error)
+}
+
+// TransactionRepository stores the transactions calculated for rebalance
+// requests, by the message ID of the request.
+type TransactionRepository interface {
+	SaveRebalanceTransactions(ctx context.Context, requestID string, txs []models.RebalanceTransaction) error
+	GetRebalanceTransactions(ctx context.Context, requestID string) ([]models.RebalanceTransaction, error)
+	DeleteRebalanceTransactions(ctx context.Context, requestID string) error
+}
+
+// OutboxRepository stores the outbox entries published by the relay.
+type OutboxRepository interface {
+	SaveOutboxEntry(ctx context.Context, e *models.OutboxEntry) error
+	GetPendingOutboxEntries(ctx context.Context, limit int) ([]models.OutboxEntry, error)
+	MarkOutboxEntrySent(ctx context.Context, id string, sentAt time.Time) error
+	RecordOutboxFailure(ctx context.Context, id string, attempts int, reason string) error
+	// MarkOutboxEntryFailed records the last failed attempt of an entry and
+	// stops returning it as pending.
+	MarkOutboxEntryFailed(ctx context.Context, id string, attempts int, reason string) error
+	// GetFailedOutboxKeys returns the keys that have failed entries.
+	GetFailedOutboxKeys(ctx context.Context) ([]string, error)
+	// RequeueFailedOutboxEntries returns the failed entries to pending with no
+	// attempts recorded and returns how many were requeued.
+	RequeueFailedOutboxEntries(ctx context.Context) (int, error)
+}
+
+// Storage backends selected by STORAGE_BACKEND.
+const (
+	BackendElasticsearch = "elasticsearch"
+	BackendPostgres      = "postgres"
+	BackendBolt          = "bolt"
+)
+
+// Store implements every repository on one backend and must be closed after use.
+type Store interface {
+	PortfolioRepository
+	RebalanceRequestRepository
+	TransactionRepository
+	OutboxRepository
+	CheckHealth(ctx context.Context) error
+	Close() error
+}
+
+// Open connects to the backend selected by STORAGE_BACKEND: "elasticsearch"
+// (the default) configured by the ELASTICSEARCH_* variables, "postgres"
+// configured by the POSTGRES_* variables, or the embedded "bolt" configured by
+// the BOLT_* variables.
+func Open() (Store, error) {
+	var store Store
+	var err error
+	switch kind := BackendKind(); kind {
+	case BackendElasticsearch:
+		store, err = NewElastic(LoadElasticConfig())
+	case BackendPostgres:
+		store, err = NewPostgres(LoadPostgresConfig())
+	case BackendBolt:
+		store, err = NewBolt(LoadBoltConfig())
+	default:
+		return nil, fmt.Errorf("unsupported STORAGE_BACKEND %q: expected %s, %s or %s", kind, BackendElasticsearch, BackendPostgres, BackendBolt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// BackendKind returns STORAGE_BACKEND, or "elasticsearch" if it is not set.
+func BackendKind() string {
+	if kind := os.Getenv("STORAGE_BACKEND"); kind != "" {
+		return kind
+	}
+	return BackendElasticsearch
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"portfolio-rebalancer/internal/logging"
+	"portfolio-rebalancer/internal/models"
+)
+
+// TransactionsIndex is the default index of the rebalance transactions.
+const TransactionsIndex = "rebalance_transactions"
+
+// transactionDoc is a transaction as stored, linked to the message ID of the
+// rebalance request it was calculated for.
+type transactionDoc struct {
+	models.RebalanceTransaction
+	RequestID string    `json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SaveRebalanceTransactions saves the transactions of the rebalance request
+// requestID to the transactions index.
+func (es *Elastic) SaveRebalanceTransactions(ctx context.Context, requestID string, txs []models.RebalanceTransaction) (err error) {
+	ctx, done := instrument(ctx, "save_rebalance_transactions")
+	defer done(&err)
+
+	if len(txs) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := es.appendTransactions(&buf, requestID, txs); err != nil {
+		return err
+	}
+	if err := es.bulk(ctx, &buf); err != nil {
+		return fmt.Errorf("error saving rebalance transactions: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Saved rebalance transactions", "count", len(txs), logging.KeyUserID, txs[0].UserID, "index", es.transactionsIndex)
+	return nil
+}
+
+// appendTransactions appends the bulk actions indexing txs to buf. Transactions
+// of a request with an ID are indexed by request and asset, so saving them
+// again overwrites them.
+func (es *Elastic) appendTransactions(buf *bytes.Buffer, requestID string, txs []models.RebalanceTransaction) error {
+	now := time.Now().UTC()
+	for _, tx := range txs {
+		meta := map[string]string{"_index": es.transactionsIndex}
+		if requestID != "" {
+			meta["_id"] = requestID + "-" + tx.Asset
+		}
+		if err := appendAction(buf, meta, transactionDoc{RebalanceTransaction: tx, RequestID: requestID, CreatedAt: now}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendAction appends an index action for doc to a bulk request body.
+func appendAction(buf *bytes.Buffer, meta map[string]string, doc interface{}) error {
+	line, err := json.Marshal(map[string]interface{}{"index": meta})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+	buf.Write(data)
+	buf.WriteByte('\n')
+	return nil
+}
+
+// bulk sends the actions in buf and returns an error if any of them failed.
+func (es *Elastic) bulk(ctx context.Context, buf *bytes.Buffer) error {
+	res, err := es.client.Bulk(bytes.NewReader(buf.Bytes()), es.client.Bulk.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return errors.New(res.String())
+	}
+
+	var raw map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("failure to to parse response body: %s", err)
+	}
+
+	if hasErrors, ok := raw["errors"].(bool); ok && hasErrors {
+		return fmt.Errorf("bulk request contained errors: %v", raw)
+	}
+	return nil
+}
+
+// requestQuery matches the transactions of the rebalance request requestID.
+func requestQuery(requestID string) string {
+	return fmt.Sprintf(`{"match": {"request_id": %q}}`, requestID)
+}
+
+// GetRebalanceTransactions returns the transactions saved for the rebalance
+// request requestID. Transactions saved before they were linked to
+// their request are never returned.
+func (es *Elastic) GetRebalanceTransactions(ctx context.Context, requestID string) (_ []models.RebalanceTransaction, err error) {
+	ctx, done := instrument(ctx, "get_rebalance_transactions")
+	defer done(&err)
+
+	if requestID == "" {
+		return nil, errors.New("request ID is required")
+	}
+
+	res, err := es.client.Search(
+		es.client.Search.WithIndex(es.transactionsIndex),
+		es.client.Search.WithBody(strings.NewReader(`{"query": `+requestQuery(requestID)+`, "size": 1000}`)),
+		es.client.Search.WithIgnoreUnavailable(true),
+		es.client.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("error searching rebalance transactions: %s", res.String())
+	}
+
+	var esResp struct {
+		Hits struct {
+			Hits []struct {
+				Source models.RebalanceTransaction `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&esResp); err != nil {
+		return nil, err
+	}
+
+	txs := make([]models.RebalanceTransaction, 0, len(esResp.Hits.Hits))
+	for _, hit := range esResp.Hits.Hits {
+		txs = append(txs, hit.Source)
+	}
+	return txs, nil
+}
+
+// DeleteRebalanceTransactions deletes the transactions saved for the rebalance
+// request requestID.
+func (es *Elastic) DeleteRebalanceTransactions(ctx context.Context, requestID string) (err error) {
+	ctx, done := instrument(ctx, "delete_rebalance_transactions")
+	defer done(&err)
+
+	if requestID == "" {
+		return errors.New("request ID is required")
+	}
+
+	res, err := es.client.DeleteByQuery(
+		[]string{es.transactionsIndex},
+		strings.NewReader(`{"query": `+requestQuery(requestID)+`}`),
+		es.client.DeleteByQuery.WithIgnoreUnavailable(true),
+		es.client.DeleteByQuery.WithRefresh(true),
+		es.client.DeleteByQuery.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error deleting rebalance transactions: %s", res.String())
+	}
+	return nil
+}
+
+// deleteStaleTransactions deletes the transactions saved for the rebalance
+// request requestID other than txs, which overwrote the ones of their assets.
+func (es *Elastic) deleteStaleTransactions(ctx context.Context, requestID string, txs []models.RebalanceTransaction) error {
+	ids := make([]string, 0, len(txs))
+	for _, tx := range txs {
+		ids = append(ids, requestID+"-"+tx.Asset)
+	}
+	query, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter":   []interface{}{json.RawMessage(requestQuery(requestID))},
+				"must_not": []interface{}{map[string]interface{}{"ids": map[string]interface{}{"values": ids}}},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := es.client.DeleteByQuery(
+		[]string{es.transactionsIndex},
+		bytes.NewReader(query),
+		es.client.DeleteByQuery.WithIgnoreUnavailable(true),
+		es.client.DeleteByQuery.WithRefresh(true),
+		es.client.DeleteByQuery.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error deleting previous rebalance transactions: %s", res.String())
+	}
+	return nil
+}
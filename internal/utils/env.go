@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// EnvDuration returns the environment variable key parsed as a duration (e.g. "30s"),
+// or def if it is unset, invalid or not positive.
+func EnvDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// EnvInt returns the environment variable key parsed as an integer,
+// or def if it is unset, invalid or not positive.
+func EnvInt(key string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}